@@ -0,0 +1,226 @@
+package kv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"rush-shopping/metrics"
+)
+
+// AdminOptions configure an AdminServer.
+type AdminOptions struct {
+	// Secret is required in the X-Admin-Secret header of every request.
+	Secret string
+	// SnapshotPath is where POST /snapshot writes the snapshot.
+	SnapshotPath string
+}
+
+// AdminServer serves the operations of a store in HTTP/JSON:
+//
+//	GET  /keys/{key}                   the value and the TTL of a key
+//	GET  /keys?prefix=...&limit=...    the keys with a prefix, in order
+//	GET  /stats                        the keys, memory and RPC counters
+//	POST /snapshot                     writes a snapshot to SnapshotPath
+//	PUT  /readonly {"read_only":true}  toggles the read-only mode
+//	GET  /metrics                      the metrics in the Prometheus format
+//
+// The secret may be given as a bearer token too, as Prometheus does.
+type AdminServer struct {
+	ks   *KVStore
+	opts AdminOptions
+	l    net.Listener
+}
+
+// ListenAdmin serves the admin API of ks on addr. The secret must be set.
+func ListenAdmin(ks *KVStore, network, addr string, opts AdminOptions) (*AdminServer, error) {
+	if opts.Secret == "" {
+		return nil, errors.New("kv: no admin secret")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Start kvstore admin service on %s\n", addr)
+	s := &AdminServer{ks: ks, opts: opts, l: l}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", s.listKeys)
+	mux.HandleFunc("/keys/", s.getKey)
+	mux.HandleFunc("/stats", s.stats)
+	mux.HandleFunc("/snapshot", s.snapshot)
+	mux.HandleFunc("/readonly", s.readOnly)
+	mux.Handle("/metrics", metrics.Handler(metrics.Default, s.ks.RPCMetrics(), s.storeMetrics()))
+	go http.Serve(l, s.authorize(mux))
+	return s, nil
+}
+
+func (s *AdminServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *AdminServer) Close() error {
+	return s.l.Close()
+}
+
+func (s *AdminServer) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-Admin-Secret")
+		if secret == "" {
+			secret = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s.opts.Secret)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "invalid admin secret")
+			return
+		}
+		defer func() {
+			if rec := recover(); rec != nil {
+				requestID := s.ks.Recovered("admin "+r.Method+" "+r.URL.Path, rec)
+				writeAdminError(w, http.StatusInternalServerError, "internal error, request "+requestID)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// storeMetrics are the gauges of the store served, while Default has the
+// metrics of the process, and RPCMetrics the counters of the store.
+func (s *AdminServer) storeMetrics() *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.GaugeFunc("kv_keys", "The keys which haven't expired.", func() float64 {
+		keys, _ := s.ks.Usage()
+		return float64(keys)
+	})
+	r.GaugeFunc("kv_data_bytes", "The bytes of the keys and values.", func() float64 {
+		_, bytes := s.ks.Usage()
+		return float64(bytes)
+	})
+	r.GaugeFunc("kv_read_only", "1 if the store is read-only.", func() float64 {
+		if s.ks.ReadOnly() {
+			return 1
+		}
+		return 0
+	})
+	return r
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func (s *AdminServer) getKey(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	value, existed := s.ks.Get(key)
+	if !existed {
+		writeAdminError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	ttl, _ := s.ks.TTL(key)
+	writeAdminJSON(w, http.StatusOK, struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		TTLMs int64  `json:"ttl_ms"` // 0 if it doesn't expire
+	}{key, value, int64(ttl / time.Millisecond)})
+}
+
+// DefaultAdminKeysLimit is the keys listed if the limit isn't given.
+const DefaultAdminKeysLimit = 1000
+
+func (s *AdminServer) listKeys(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	limit := DefaultAdminKeysLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			writeAdminError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	keys, truncated := s.ks.Keys(r.URL.Query().Get("prefix"), limit)
+	writeAdminJSON(w, http.StatusOK, struct {
+		Keys      []string `json:"keys"`
+		Truncated bool     `json:"truncated"`
+	}{keys, truncated})
+}
+
+func (s *AdminServer) stats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	keys, bytes := s.ks.Usage()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeAdminJSON(w, http.StatusOK, struct {
+		Keys      int                `json:"keys"`
+		DataBytes int64              `json:"data_bytes"` // of the keys and values
+		HeapBytes uint64             `json:"heap_bytes"`
+		Shards    int                `json:"shards"`
+		ReadOnly  bool               `json:"read_only"`
+		Panics    uint64             `json:"panics"`
+		RPCs      map[string]RPCStat `json:"rpcs"`
+	}{keys, bytes, mem.HeapAlloc, len(s.ks.shards), s.ks.ReadOnly(), s.ks.Panics(), s.ks.RPCStats()})
+}
+
+func (s *AdminServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if s.opts.SnapshotPath == "" {
+		writeAdminError(w, http.StatusNotImplemented, "no snapshot path")
+		return
+	}
+	start := time.Now()
+	keys, err := s.ks.WriteSnapshot(s.opts.SnapshotPath)
+	if err != nil {
+		log.Println("Snapshot error:", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct {
+		Path   string `json:"path"`
+		Keys   int    `json:"keys"`
+		CostMs int64  `json:"cost_ms"`
+	}{s.opts.SnapshotPath, keys, int64(time.Since(start) / time.Millisecond)})
+}
+
+func (s *AdminServer) readOnly(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "PUT") {
+		return
+	}
+	var mode struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil || mode.ReadOnly == nil {
+		writeAdminError(w, http.StatusBadRequest, `expected {"read_only":true|false}`)
+		return
+	}
+	s.ks.SetReadOnly(*mode.ReadOnly)
+	log.Printf("Kvstore read-only mode set to %v\n", *mode.ReadOnly)
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"read_only": *mode.ReadOnly})
+}
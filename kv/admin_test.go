@@ -0,0 +1,130 @@
+package kv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	ks := NewKVStore()
+	dir, err := ioutil.TempDir("", "kvadmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+	if _, err := ListenAdmin(ks, "tcp", "localhost:0", AdminOptions{}); err == nil {
+		t.Fatal("admin served without a secret")
+	}
+	s, err := ListenAdmin(ks, "tcp", "localhost:0", AdminOptions{Secret: "s3cret", SnapshotPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	base := "http://" + s.Addr().String()
+	do := func(method, url, secret, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, base+url, strings.NewReader(body))
+		req.Header.Set("X-Admin-Secret", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+
+	ks.PutTTL("user:1", "a", time.Minute)
+	ks.Put("user:2", "b")
+	ks.Put("item:1", "c")
+	var reply Reply
+	ks.RPCGet(&GetArgs{Key: "user:1"}, &reply)
+
+	if status := do("GET", "/stats", "wrong", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("GET /stats with a wrong secret = %v", status)
+	}
+	var key struct {
+		Value string `json:"value"`
+		TTLMs int64  `json:"ttl_ms"`
+	}
+	if status := do("GET", "/keys/user:1", "s3cret", "", &key); status != http.StatusOK ||
+		key.Value != "a" || key.TTLMs <= 0 || key.TTLMs > 60000 {
+		t.Fatalf("GET /keys/user:1 = %v %+v", status, key)
+	}
+	if status := do("GET", "/keys/none", "s3cret", "", nil); status != http.StatusNotFound {
+		t.Fatalf("GET /keys/none = %v", status)
+	}
+	var list struct {
+		Keys      []string `json:"keys"`
+		Truncated bool     `json:"truncated"`
+	}
+	if do("GET", "/keys?prefix=user:&limit=1", "s3cret", "", &list); len(list.Keys) != 1 ||
+		list.Keys[0] != "user:1" || !list.Truncated {
+		t.Fatalf("GET /keys = %+v", list)
+	}
+	var stats struct {
+		Keys     int                `json:"keys"`
+		ReadOnly bool               `json:"read_only"`
+		RPCs     map[string]RPCStat `json:"rpcs"`
+	}
+	if do("GET", "/stats", "s3cret", "", &stats); stats.Keys != 3 || stats.RPCs["KVStore.RPCGet"].Calls == 0 {
+		t.Fatalf("GET /stats = %+v", stats)
+	}
+	// The other stores of the process count their own RPCs.
+	if other := NewKVStore(); len(other.RPCStats()) != 0 {
+		t.Fatalf("RPCStats of another store = %+v", other.RPCStats())
+	}
+
+	req, _ := http.NewRequest("GET", base+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{"\nkv_keys 3\n", "kv_rpc_requests_total{method=\"KVStore.RPCGet\"}",
+		"kv_rpc_duration_seconds_count{method=\"KVStore.RPCGet\"}"} {
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), line) {
+			t.Fatalf("GET /metrics = %v, no %q in\n%s", resp.StatusCode, line, body)
+		}
+	}
+
+	if status := do("PUT", "/readonly", "s3cret", `{"read_only":true}`, nil); status != http.StatusOK {
+		t.Fatalf("PUT /readonly = %v", status)
+	}
+	if err := ks.RPCPut(&PutArgs{Key: "k", Value: "v"}, &reply); err != ErrReadOnly {
+		t.Fatalf("RPCPut in read-only mode = %v", err)
+	}
+	if err := ks.RPCGet(&GetArgs{Key: "item:1"}, &reply); err != nil || reply.Value != "c" {
+		t.Fatalf("RPCGet in read-only mode = %v, %+v", err, reply)
+	}
+	do("PUT", "/readonly", "s3cret", `{"read_only":false}`, nil)
+	if err := ks.RPCPut(&PutArgs{Key: "k", Value: "v"}, &reply); err != nil {
+		t.Fatalf("RPCPut = %v", err)
+	}
+
+	if status := do("POST", "/snapshot", "s3cret", "", nil); status != http.StatusOK {
+		t.Fatalf("POST /snapshot = %v", status)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Data) != 4 || snap.Data["k"] != "v" || snap.Expires["user:1"] == 0 {
+		t.Fatalf("snapshot %+v", snap)
+	}
+}
@@ -0,0 +1,201 @@
+package kv
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+type MGetArgs struct {
+	Keys []string
+}
+
+type MGetReply struct {
+	Replies []Reply // of RPCGet, one per key
+}
+
+type MPutArgs struct {
+	Pairs []PutArgs
+}
+
+type MPutReply struct {
+	Replies []Reply // of RPCPut, one per pair
+}
+
+// The operations of a batch.
+const (
+	OpGet    = "get"
+	OpPut    = "put"
+	OpPutNX  = "putnx"
+	OpExpire = "expire"
+	OpIncr   = "incr"
+	OpDel    = "del"
+)
+
+// BatchOp is an operation of a batch, with the arguments of its own RPC.
+type BatchOp struct {
+	Op    string
+	Key   string
+	Value string
+	TTLMs int64
+	Delta int
+}
+
+type BatchArgs struct {
+	Ops []BatchOp
+}
+
+type BatchReply struct {
+	Replies []Reply  // of the RPCs, one per operation
+	Errors  []string // "" if the operation succeeded
+}
+
+// rawPutArgs is RPCPut with the key held by LockKeys.
+func (ks *KVStore) rawPutArgs(args *PutArgs) (reply Reply) {
+	if args.TTLMs > 0 {
+		reply.Value, reply.Flag = ks.rawPutTTL(args.Key, args.Value, msToDuration(args.TTLMs))
+	} else {
+		reply.Value, reply.Flag = ks.rawPut(args.Key, args.Value)
+	}
+	return
+}
+
+// Return the values of the keys in one round trip.
+// @Replies: as RPCGet of every key.
+func (ks *KVStore) RPCMGet(args *MGetArgs, reply *MGetReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCMGet", time.Now(), &err)
+	op := ks.StartOp("KVStore.RPCMGet", args)
+	defer op.Finish()
+	reply.Replies = make([]Reply, len(args.Keys))
+	for i, key := range args.Keys {
+		unlock := op.RLock(key)
+		reply.Replies[i].Value, reply.Replies[i].Flag = ks.RawGet(key)
+		unlock()
+	}
+	return nil
+}
+
+// Put the k-v pairs in one round trip, in order.
+// @Replies: as RPCPut of every pair.
+func (ks *KVStore) RPCMPut(args *MPutArgs, reply *MPutReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCMPut", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCMPut", args)
+	defer op.Finish()
+	reply.Replies = make([]Reply, len(args.Pairs))
+	for i := range args.Pairs {
+		unlock := op.Lock(args.Pairs[i].Key)
+		reply.Replies[i] = ks.rawPutArgs(&args.Pairs[i])
+		unlock()
+	}
+	return nil
+}
+
+// Run the operations in one round trip, in order. The batch isn't atomic,
+// and an operation failed doesn't stop the others.
+// @Replies: as the RPC of every operation.
+// @Errors: the error of every operation, "" if none.
+func (ks *KVStore) RPCBatch(args *BatchArgs, reply *BatchReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCBatch", time.Now(), &err)
+	sop := ks.StartOp("KVStore.RPCBatch", args)
+	defer sop.Finish()
+	reply.Replies = make([]Reply, len(args.Ops))
+	reply.Errors = make([]string, len(args.Ops))
+	readOnly := ks.ReadOnly()
+	for i := range args.Ops {
+		op := &args.Ops[i]
+		switch {
+		case op.Op != OpGet && readOnly:
+			reply.Errors[i] = ErrReadOnly.Error()
+		case op.Op == OpGet:
+			unlock := sop.RLock(op.Key)
+			reply.Replies[i].Value, reply.Replies[i].Flag = ks.RawGet(op.Key)
+			unlock()
+		default:
+			if err := ks.batchWrite(sop, op, &reply.Replies[i]); err != nil {
+				reply.Errors[i] = err.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// batchWrite runs a write of a batch, locking its key by sop.
+func (ks *KVStore) batchWrite(sop *SlowOp, op *BatchOp, r *Reply) (err error) {
+	unlock := sop.Lock(op.Key)
+	defer unlock()
+	switch op.Op {
+	case OpPut:
+		*r = ks.rawPutArgs(&PutArgs{Key: op.Key, Value: op.Value, TTLMs: op.TTLMs})
+	case OpPutNX:
+		r.Value, r.Flag = ks.rawPutNX(op.Key, op.Value, msToDuration(op.TTLMs))
+	case OpExpire:
+		r.Flag = ks.RawExpire(op.Key, msToDuration(op.TTLMs))
+	case OpIncr:
+		r.Value, r.Flag, err = ks.rawIncr(op.Key, op.Delta)
+	case OpDel:
+		r.Flag = ks.RawDel(op.Key)
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return
+}
+
+// Pipeline sends many calls on one connection of a Pool without waiting
+// for the replies one by one:
+//
+//	pl := pool.Pipeline()
+//	pl.Go("KVStoreService.RPCPut", args1, &reply1)
+//	pl.Go("KVStoreService.RPCPut", args2, &reply2)
+//	err := pl.Wait()
+//
+// It isn't safe for concurrent use.
+type Pipeline struct {
+	pool   *Pool
+	client *rpc.Client
+	calls  []*rpc.Call
+	err    error
+}
+
+func (p *Pool) Pipeline() *Pipeline {
+	return &Pipeline{pool: p}
+}
+
+// Go sends the call. Its reply is set once Wait returns.
+func (pl *Pipeline) Go(method string, args interface{}, reply interface{}) {
+	if pl.err != nil {
+		return
+	}
+	if pl.client == nil {
+		if pl.client, _, pl.err = pl.pool.get(); pl.err != nil {
+			return
+		}
+	}
+	pl.calls = append(pl.calls, pl.client.Go(method, args, reply, make(chan *rpc.Call, 1)))
+}
+
+// Wait waits for the replies of the calls sent, and gives the connection
+// back. It returns the first error, as Pool.Call. The Pipeline may be
+// used again after.
+func (pl *Pipeline) Wait() error {
+	err, broken := pl.err, false
+	for _, call := range pl.calls {
+		<-call.Done
+		if call.Error == nil {
+			continue
+		}
+		if _, isServerErr := call.Error.(rpc.ServerError); !isServerErr {
+			broken = true
+		}
+		if err == nil {
+			err = call.Error
+		}
+	}
+	if pl.client != nil {
+		pl.pool.put(pl.client, broken)
+	}
+	pl.client, pl.calls, pl.err = nil, nil, nil
+	return err
+}
@@ -0,0 +1,64 @@
+package kv
+
+import "testing"
+
+func TestBatch(t *testing.T) {
+	srvAddr := "localhost:9092"
+	ts := NewKVStoreService("tcp", srvAddr)
+	ts.Serve()
+	defer ts.Kill()
+	client := NewClient(srvAddr)
+	defer client.Close()
+
+	ok, putReply := client.MPut([]PutArgs{{Key: "a", Value: "1"}, {Key: "b", Value: "x"}, {Key: "a", Value: "2"}})
+	if !ok || putReply.Replies[2] != (Reply{Flag: true, Value: "1"}) {
+		t.Fatalf("MPut = %v %+v", ok, putReply)
+	}
+	ok, getReply := client.MGet([]string{"a", "b", "c"})
+	if !ok || getReply.Replies[0].Value != "2" || getReply.Replies[1].Value != "x" || getReply.Replies[2].Flag {
+		t.Fatalf("MGet = %v %+v", ok, getReply)
+	}
+
+	ok, batchReply := client.Batch([]BatchOp{{Op: OpIncr, Key: "a", Delta: 3}, {Op: OpIncr, Key: "b", Delta: 1},
+		{Op: OpPutNX, Key: "c", Value: "y"}, {Op: OpDel, Key: "a"}, {Op: OpGet, Key: "a"}})
+	if !ok {
+		t.Fatal("batch failed")
+	}
+	if batchReply.Replies[0].Value != "5" || batchReply.Errors[1] == "" || batchReply.Replies[2].Flag ||
+		!batchReply.Replies[3].Flag || batchReply.Replies[4].Flag {
+		t.Fatalf("batch = %+v", batchReply)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	srvAddr := "localhost:9093"
+	ts := NewKVStoreService("tcp", srvAddr)
+	ts.Serve()
+	defer ts.Kill()
+	client := NewClient(srvAddr)
+	defer client.Close()
+
+	pl := client.Pipeline()
+	replies := make([]Reply, 100)
+	for i := range replies {
+		pl.Go("KVStoreService.RPCIncr", &IncrArgs{Key: "n", Delta: 1}, &replies[i])
+	}
+	if err := pl.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, reply := client.Get("n"); !ok || reply.Value != "100" {
+		t.Fatalf("n = %v after 100 increments", reply.Value)
+	}
+	if stats := client.Stats(); stats.Dials != 1 {
+		t.Fatalf("stats %+v; expected the calls on one connection", stats)
+	}
+
+	pl.Go("KVStoreService.RPCIncr", &IncrArgs{Key: "n", Delta: 1}, &replies[0])
+	pl.Go("KVStoreService.NoSuchMethod", &IncrArgs{}, &replies[1])
+	if err := pl.Wait(); err == nil {
+		t.Fatal("pipeline with a bad call returned no error")
+	}
+	if replies[0].Value != "101" {
+		t.Fatalf("reply %+v; expected 101", replies[0])
+	}
+}
@@ -3,28 +3,46 @@ package kv
 import (
 	"fmt"
 	"net"
-	"net/rpc"
 	"syscall"
+	"time"
 )
 
+// Client calls a KV-Store over a Pool of connections, so it is safe for
+// concurrent use.
 type Client struct {
-	SrvAddr   string
-	rpcClient *rpc.Client
+	SrvAddr string
+	pool    *Pool
 }
 
 func NewClient(srvAddr string) *Client {
-	rpcClient, err := rpc.Dial("tcp", srvAddr)
-	if err != nil {
-		err1 := err.(*net.OpError)
-		if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-			fmt.Printf("TinyKVStore Dial() failed: %v\n", err1)
+	return NewClientWithOptions(srvAddr, DefaultPoolOptions())
+}
+
+// NewClientWithOptions returns nil if the KV-Store can't be dialed.
+func NewClientWithOptions(srvAddr string, opts PoolOptions) *Client {
+	if opts.PingMethod == "" {
+		opts.PingMethod = "KVStoreService.RPCPing"
+	}
+	pool := NewPool("tcp", srvAddr, opts)
+	var reply Reply
+	if err := pool.Call(opts.PingMethod, &PingArgs{}, &reply); err != nil {
+		if err1, ok := err.(*net.OpError); !ok ||
+			err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
+			fmt.Printf("TinyKVStore Dial() failed: %v\n", err)
 		}
+		pool.Close()
 		return nil
 	}
-	return &Client{SrvAddr: srvAddr, rpcClient: rpcClient}
+	return &Client{SrvAddr: srvAddr, pool: pool}
 }
+
 func (c *Client) Close() {
-	c.rpcClient.Close()
+	c.pool.Close()
+}
+
+// Stats returns the stats of the connections.
+func (c *Client) Stats() PoolStats {
+	return c.pool.Stats()
 }
 
 func (c *Client) Put(key string, value string) (ok bool, reply Reply) {
@@ -33,6 +51,24 @@ func (c *Client) Put(key string, value string) (ok bool, reply Reply) {
 	return
 }
 
+func (c *Client) PutTTL(key string, value string, ttl time.Duration) (ok bool, reply Reply) {
+	args := &PutArgs{Key: key, Value: value, TTLMs: int64(ttl / time.Millisecond)}
+	ok = c.call("KVStoreService.RPCPut", args, &reply)
+	return
+}
+
+func (c *Client) PutNX(key string, value string, ttl time.Duration) (ok bool, reply Reply) {
+	args := &PutArgs{Key: key, Value: value, TTLMs: int64(ttl / time.Millisecond)}
+	ok = c.call("KVStoreService.RPCPutNX", args, &reply)
+	return
+}
+
+func (c *Client) Expire(key string, ttl time.Duration) (ok bool, reply Reply) {
+	args := &ExpireArgs{Key: key, TTLMs: int64(ttl / time.Millisecond)}
+	ok = c.call("KVStoreService.RPCExpire", args, &reply)
+	return
+}
+
 func (c *Client) Get(key string) (ok bool, reply Reply) {
 	args := &GetArgs{Key: key}
 	ok = c.call("KVStoreService.RPCGet", args, &reply)
@@ -45,8 +81,54 @@ func (c *Client) Incr(key string, delta int) (ok bool, reply Reply) {
 	return
 }
 
+func (c *Client) Scan(prefix string) (ok bool, reply ScanReply) {
+	args := &ScanArgs{Prefix: prefix}
+	ok = c.call("KVStoreService.RPCScan", args, &reply)
+	return
+}
+
+func (c *Client) MGet(keys []string) (ok bool, reply MGetReply) {
+	args := &MGetArgs{Keys: keys}
+	ok = c.call("KVStoreService.RPCMGet", args, &reply)
+	return
+}
+
+func (c *Client) MPut(pairs []PutArgs) (ok bool, reply MPutReply) {
+	args := &MPutArgs{Pairs: pairs}
+	ok = c.call("KVStoreService.RPCMPut", args, &reply)
+	return
+}
+
+// Batch runs the operations in one round trip, see KVStore.RPCBatch.
+func (c *Client) Batch(ops []BatchOp) (ok bool, reply BatchReply) {
+	args := &BatchArgs{Ops: ops}
+	ok = c.call("KVStoreService.RPCBatch", args, &reply)
+	return
+}
+
+// Slowlog returns the slow operations of the store, see KVStore.RPCSlowlog.
+func (c *Client) Slowlog(limit int, reset bool) (ok bool, reply SlowlogReply) {
+	args := &SlowlogArgs{Limit: limit, Reset: reset}
+	ok = c.call("KVStoreService.RPCSlowlog", args, &reply)
+	return
+}
+
+// Pipeline sends many calls at once on one connection, e.g.
+// "KVStoreService.RPCPut" of many keys.
+func (c *Client) Pipeline() *Pipeline {
+	return c.pool.Pipeline()
+}
+
+// Watch waits up to timeout for the changes of the keys with prefix after
+// versions. Empty versions return the current ones to start from.
+func (c *Client) Watch(prefix string, versions []int64, timeout time.Duration) (ok bool, reply WatchReply) {
+	args := &WatchArgs{Prefix: prefix, Versions: versions, TimeoutMs: int64(timeout / time.Millisecond)}
+	ok = c.call("KVStoreService.RPCWatch", args, &reply)
+	return
+}
+
 func (c *Client) call(name string, args interface{}, reply interface{}) bool {
-	err := c.rpcClient.Call(name, args, reply)
+	err := c.pool.Call(name, args, reply)
 	if err == nil {
 		return true
 	}
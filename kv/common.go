@@ -9,8 +9,16 @@ type DelArgs GetArgs
 type PutArgs struct {
 	Key   string
 	Value string
+	TTLMs int64 // no expiration if it's not positive
 }
 
+type ExpireArgs struct {
+	Key   string
+	TTLMs int64
+}
+
+type PingArgs struct{}
+
 type IncrArgs struct {
 	Key   string
 	Delta int
@@ -20,3 +28,11 @@ type Reply struct {
 	Flag  bool
 	Value string
 }
+
+type ScanArgs struct {
+	Prefix string
+}
+
+type ScanReply struct {
+	Data map[string]string
+}
@@ -0,0 +1,96 @@
+package kv
+
+import "time"
+
+// ExpireInterval is how often the expired keys are dropped. They are
+// invisible since they expire, but hold memory until then.
+const ExpireInterval = time.Second
+
+func msToDuration(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// RawExpire sets the key to expire after ttl, or persists it if ttl isn't
+// positive. The caller must hold the key by LockKeys.
+func (ks *KVStore) RawExpire(key string, ttl time.Duration) (existed bool) {
+	s := ks.shardOf(key)
+	if _, existed = s.get(key); !existed {
+		return
+	}
+	if ttl > 0 {
+		s.expires[key] = time.Now().Add(ttl).UnixNano()
+	} else {
+		delete(s.expires, key)
+	}
+	return
+}
+
+// PutTTL is Put with the key expiring after ttl.
+func (ks *KVStore) PutTTL(key, value string, ttl time.Duration) (oldValue string, existed bool) {
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.rawPutTTL(key, value, ttl)
+}
+
+// rawPutTTL is PutTTL with the key held by LockKeys.
+func (ks *KVStore) rawPutTTL(key, value string, ttl time.Duration) (oldValue string, existed bool) {
+	oldValue, existed = ks.rawPut(key, value)
+	ks.RawExpire(key, ttl)
+	return
+}
+
+// PutNX puts the key only if it doesn't exist, otherwise it returns the
+// existing value. The key expires after ttl if it's positive.
+func (ks *KVStore) PutNX(key, value string, ttl time.Duration) (oldValue string, existed bool) {
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.rawPutNX(key, value, ttl)
+}
+
+// rawPutNX is PutNX with the key held by LockKeys.
+func (ks *KVStore) rawPutNX(key, value string, ttl time.Duration) (oldValue string, existed bool) {
+	if oldValue, existed = ks.RawGet(key); existed {
+		return
+	}
+	ks.RawPut(key, value)
+	ks.RawExpire(key, ttl)
+	return
+}
+
+// Expire sets the key to expire after ttl, or persists it if ttl isn't
+// positive.
+func (ks *KVStore) Expire(key string, ttl time.Duration) (existed bool) {
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.RawExpire(key, ttl)
+}
+
+// Close stops dropping the expired keys. The store may still be used, but
+// the expired keys hold memory until read.
+func (ks *KVStore) Close() {
+	ks.stopOnce.Do(func() { close(ks.stop) })
+}
+
+func (ks *KVStore) sweepExpired() {
+	ticker := time.NewTicker(ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ks.stop:
+			return
+		}
+		for _, s := range ks.shards {
+			s.Lock()
+			now := time.Now().UnixNano()
+			for key, deadline := range s.expires {
+				if now >= deadline {
+					ks.events.append(key, s.data[key], "", true, true)
+					delete(s.data, key)
+					delete(s.expires, key)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
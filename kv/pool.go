@@ -0,0 +1,207 @@
+package kv
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("kv: pool closed")
+
+// PoolOptions are the limits of a Pool.
+type PoolOptions struct {
+	// MaxActive is the connections open at most, idle ones included. The
+	// callers wait for one to be put back beyond it. No limit if 0.
+	MaxActive int
+	// MaxIdle is the connections kept open for reuse.
+	MaxIdle int
+	// IdleTimeout closes the connections idle for longer, never if 0.
+	IdleTimeout time.Duration
+	// PingMethod checks a connection idle for over PingIdle before it is
+	// borrowed, e.g. "KVStoreService.RPCPing". Not checked if "".
+	PingMethod string
+	PingIdle   time.Duration
+}
+
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{MaxActive: 100, MaxIdle: 16, IdleTimeout: 5 * time.Minute,
+		PingIdle: time.Second}
+}
+
+// PoolStats are the connections of a Pool, and the counters of what
+// happened to them.
+type PoolStats struct {
+	Active int // open, idle ones included
+	Idle   int
+
+	Dials        uint64
+	DialErrors   uint64
+	Hits         uint64 // borrowed idle
+	Waits        uint64 // waited for MaxActive
+	Broken       uint64 // closed after an error
+	IdleClosed   uint64 // closed by IdleTimeout
+	PingFailures uint64
+}
+
+type idleConn struct {
+	client *rpc.Client
+	since  time.Time
+}
+
+// Pool keeps the RPC connections to a server for reuse. It is safe for
+// concurrent use. A connection broken by a call is closed, and a new one
+// is dialed by the next call.
+type Pool struct {
+	network string
+	addr    string
+	opts    PoolOptions
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []idleConn // the most recently used last
+	active int
+	closed bool
+	stats  PoolStats
+}
+
+func NewPool(network, addr string, opts PoolOptions) *Pool {
+	p := &Pool{network: network, addr: addr, opts: opts}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// get borrows an idle connection or dials a new one. reused tells whether
+// it had been idle.
+func (p *Pool) get() (client *rpc.Client, reused bool, err error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, ErrPoolClosed
+		}
+		p.closeIdleExpired()
+		if n := len(p.idle); n > 0 {
+			ic := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			if p.opts.PingMethod != "" && time.Since(ic.since) > p.opts.PingIdle && !p.ping(ic.client) {
+				ic.client.Close()
+				p.mu.Lock()
+				p.active--
+				p.stats.PingFailures++
+				p.cond.Signal()
+				continue
+			}
+			p.mu.Lock()
+			p.stats.Hits++
+			p.mu.Unlock()
+			return ic.client, true, nil
+		}
+		if p.opts.MaxActive <= 0 || p.active < p.opts.MaxActive {
+			break
+		}
+		p.stats.Waits++
+		p.cond.Wait()
+	}
+	p.active++
+	p.stats.Dials++
+	p.mu.Unlock()
+
+	client, err = rpc.Dial(p.network, p.addr)
+	if err != nil {
+		p.mu.Lock()
+		p.active--
+		p.stats.DialErrors++
+		p.cond.Signal()
+		p.mu.Unlock()
+		return nil, false, err
+	}
+	return client, false, nil
+}
+
+// closeIdleExpired closes the connections idle for over IdleTimeout. p.mu
+// must be held.
+func (p *Pool) closeIdleExpired() {
+	if p.opts.IdleTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-p.opts.IdleTimeout)
+	n := 0
+	for n < len(p.idle) && p.idle[n].since.Before(deadline) {
+		p.idle[n].client.Close()
+		n++
+	}
+	if n > 0 {
+		p.idle = append(p.idle[:0], p.idle[n:]...)
+		p.active -= n
+		p.stats.IdleClosed += uint64(n)
+		p.cond.Broadcast()
+	}
+}
+
+func (p *Pool) ping(client *rpc.Client) bool {
+	var reply Reply
+	return client.Call(p.opts.PingMethod, &PingArgs{}, &reply) == nil
+}
+
+// put gives back a borrowed connection, which is closed if it's broken or
+// more than MaxIdle would be idle.
+func (p *Pool) put(client *rpc.Client, broken bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if broken || p.closed || len(p.idle) >= p.opts.MaxIdle {
+		client.Close()
+		p.active--
+		if broken {
+			p.stats.Broken++
+		}
+	} else {
+		p.idle = append(p.idle, idleConn{client: client, since: time.Now()})
+	}
+	p.cond.Signal()
+}
+
+// Call calls the method on a connection of the pool. The error is an
+// rpc.ServerError if the method failed on the server, and any other error
+// if the connection failed. A call on an idle connection found shut down
+// is sent again on a new one, as it hadn't reached the server.
+func (p *Pool) Call(method string, args interface{}, reply interface{}) error {
+	for {
+		client, reused, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = client.Call(method, args, reply)
+		_, isServerErr := err.(rpc.ServerError)
+		p.put(client, err != nil && !isServerErr)
+		if err != rpc.ErrShutdown || !reused {
+			return err
+		}
+	}
+}
+
+// Stats returns the current connections and the counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Active = p.active
+	stats.Idle = len(p.idle)
+	return stats
+}
+
+// Close closes the idle connections, and the borrowed ones once put back.
+// The calls waiting for a connection fail with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, ic := range p.idle {
+		ic.client.Close()
+	}
+	p.active -= len(p.idle)
+	p.idle = nil
+	p.cond.Broadcast()
+	return nil
+}
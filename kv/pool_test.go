@@ -0,0 +1,134 @@
+package kv
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connServer serves a KVStore, and can drop the connections to it.
+type connServer struct {
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newConnServer(t *testing.T) *connServer {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("KVStoreService", NewKVStore())
+	s := &connServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *connServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func TestPool(t *testing.T) {
+	s := newConnServer(t)
+	defer s.l.Close()
+	opts := PoolOptions{MaxActive: 2, MaxIdle: 1, PingMethod: "KVStoreService.RPCPing"}
+	p := NewPool("tcp", s.l.Addr().String(), opts)
+	defer p.Close()
+
+	var reply Reply
+	for i := 0; i < 3; i++ {
+		if err := p.Call("KVStoreService.RPCPut", &PutArgs{Key: "k", Value: "v"}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := p.Stats(); stats.Dials != 1 || stats.Hits != 2 || stats.Idle != 1 {
+		t.Fatalf("stats %+v; expected 1 dial reused twice", stats)
+	}
+
+	// a server error leaves the connection in the pool
+	if err := p.Call("KVStoreService.RPCIncr", &IncrArgs{Key: "k", Delta: 1}, &reply); err == nil {
+		t.Fatal("incr of a non-numeric value succeeded")
+	}
+	if stats := p.Stats(); stats.Broken != 0 || stats.Idle != 1 {
+		t.Fatalf("stats %+v after a server error", stats)
+	}
+
+	// a broken connection is redialed
+	s.dropConns()
+	time.Sleep(50 * time.Millisecond)
+	if err := p.Call("KVStoreService.RPCGet", &GetArgs{Key: "k"}, &reply); err != nil {
+		t.Fatalf("call after the connection dropped: %v", err)
+	}
+	if reply.Value != "v" {
+		t.Fatalf("get = %+v", reply)
+	}
+	if stats := p.Stats(); stats.Dials != 2 || stats.Active != 1 {
+		t.Fatalf("stats %+v; expected a redial", stats)
+	}
+}
+
+func TestPoolMaxActive(t *testing.T) {
+	s := newConnServer(t)
+	defer s.l.Close()
+	p := NewPool("tcp", s.l.Addr().String(), PoolOptions{MaxActive: 2, MaxIdle: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply WatchReply
+			// the watch holds the connection for its timeout
+			if err := p.Call("KVStoreService.RPCWatch", &WatchArgs{Prefix: "x", Versions: []int64{0}, TimeoutMs: 5}, &reply); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := p.Stats(); stats.Dials > 2 || stats.Active > 2 || stats.Waits == 0 {
+		t.Fatalf("stats %+v; expected at most 2 connections", stats)
+	}
+
+	p.Close()
+	var reply Reply
+	if err := p.Call("KVStoreService.RPCGet", &GetArgs{Key: "k"}, &reply); err != ErrPoolClosed {
+		t.Fatalf("call on a closed pool = %v", err)
+	}
+	if stats := p.Stats(); stats.Active != 0 {
+		t.Fatalf("stats %+v; expected no connection left", stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := newConnServer(t)
+	defer s.l.Close()
+	p := NewPool("tcp", s.l.Addr().String(), PoolOptions{MaxIdle: 1, IdleTimeout: 10 * time.Millisecond})
+	defer p.Close()
+
+	var reply Reply
+	p.Call("KVStoreService.RPCGet", &GetArgs{Key: "k"}, &reply)
+	time.Sleep(20 * time.Millisecond)
+	p.Call("KVStoreService.RPCGet", &GetArgs{Key: "k"}, &reply)
+	if stats := p.Stats(); stats.IdleClosed != 1 || stats.Dials != 2 {
+		t.Fatalf("stats %+v; expected the idle connection closed", stats)
+	}
+}
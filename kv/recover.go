@@ -0,0 +1,64 @@
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+var panics uint64
+
+// Panics returns how many panics have been recovered from serving the
+// requests in this process, by all its stores and servers.
+func Panics() uint64 {
+	return atomic.LoadUint64(&panics)
+}
+
+// NewRequestID returns a random ID, which ties the error replied for a
+// request to its log.
+func NewRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Recovered logs the panic r of serving a request with the stack, and
+// counts it. It returns the ID of the request in the log.
+func Recovered(where string, r interface{}) (requestID string) {
+	requestID = NewRequestID()
+	atomic.AddUint64(&panics, 1)
+	log.Printf("Panic in %s, request %s: %v\n%s", where, requestID, r, debug.Stack())
+	return
+}
+
+// Recovered is the package Recovered counting the panic in the Panics of
+// the store too.
+func (ks *KVStore) Recovered(where string, r interface{}) (requestID string) {
+	atomic.AddUint64(&ks.rpc.panics, 1)
+	return Recovered(where, r)
+}
+
+// RecoverRPC turns a panic of an RPC method into its error, so that one
+// bad request can't bring the node down, and counts the call started at
+// start in the RPCStats and the metrics of the store. net/rpc has no
+// middleware, so every method defers it with its named error result:
+//
+//	defer ks.RecoverRPC("KVStore.RPCGet", time.Now(), &err)
+func (ks *KVStore) RecoverRPC(method string, start time.Time, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("internal error in %s, request %s", method, ks.Recovered(method, r))
+	}
+	ks.countRPC(method, time.Since(start), *err)
+}
+
+// RecoverRPC is KVStore.RecoverRPC for the RPC servers without a store,
+// e.g. the coordinator, which counts only the panics.
+func RecoverRPC(method string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("internal error in %s, request %s", method, Recovered(method, r))
+	}
+}
@@ -0,0 +1,436 @@
+package kv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RESPServer serves a KVStore in the Redis protocol (RESP), so that
+// redis-cli and the Redis clients can talk to it. It supports GET, SET
+// (with EX, PX and NX), INCRBY, DEL, EXPIRE, SCAN (with prefix* patterns),
+// INFO, PING, QUIT and MULTI/EXEC/DISCARD. A command, and the commands of
+// an EXEC, lock all their keys, so they run atomically.
+type RESPServer struct {
+	ks     *KVStore
+	l      net.Listener
+	closed int32
+}
+
+// ListenRESP serves ks in RESP on addr.
+func ListenRESP(ks *KVStore, network, addr string) (*RESPServer, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Start RESP service on %s\n", addr)
+	s := &RESPServer{ks: ks, l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if atomic.LoadInt32(&s.closed) == 0 {
+					log.Println("RESP accept error:", err)
+				}
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *RESPServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Close stops accepting connections.
+func (s *RESPServer) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.l.Close()
+}
+
+// The replies other than integers (int64), bulk strings (string), nil and
+// arrays ([]interface{}).
+type (
+	respStatus string
+	respError  string
+)
+
+var (
+	respOK          = respStatus("OK")
+	errRESPProtocol = errors.New("protocol error")
+)
+
+func respArgsError(cmd string) respError {
+	return respError("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			s.ks.Recovered("RESP "+conn.RemoteAddr().String(), r)
+		}
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var queued [][]string // by MULTI, nil if not in one
+	var dirty bool        // a command queued was wrong
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if err == errRESPProtocol {
+				writeRESP(w, respError("ERR Protocol error"))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		var reply interface{}
+		switch {
+		case cmd == "QUIT":
+			writeRESP(w, respOK)
+			w.Flush()
+			return
+		case cmd == "MULTI":
+			if queued != nil {
+				reply = respError("ERR MULTI calls can not be nested")
+			} else {
+				queued, dirty, reply = [][]string{}, false, respOK
+			}
+		case cmd == "DISCARD":
+			if queued == nil {
+				reply = respError("ERR DISCARD without MULTI")
+			} else {
+				queued, reply = nil, respOK
+			}
+		case cmd == "EXEC":
+			switch {
+			case queued == nil:
+				reply = respError("ERR EXEC without MULTI")
+			case dirty:
+				reply = respError("EXECABORT Transaction discarded because of previous errors.")
+			default:
+				reply = s.exec(conn.RemoteAddr().String(), queued)
+			}
+			queued = nil
+		case queued != nil:
+			if _, e := respKeys(cmd, args); e != nil {
+				reply, dirty = e, true
+			} else {
+				queued = append(queued, args)
+				reply = respStatus("QUEUED")
+			}
+		default:
+			reply = s.run(conn.RemoteAddr().String(), cmd, args)
+		}
+		writeRESP(w, reply)
+		// Flush once the commands pipelined are answered.
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// respKeys returns the keys of a command which may run in an EXEC, or the
+// error if it can't.
+func respKeys(cmd string, args []string) ([]string, interface{}) {
+	switch cmd {
+	case "GET":
+		if len(args) != 2 {
+			return nil, respArgsError(cmd)
+		}
+	case "SET":
+		if len(args) < 3 {
+			return nil, respArgsError(cmd)
+		}
+	case "INCRBY", "EXPIRE":
+		if len(args) != 3 {
+			return nil, respArgsError(cmd)
+		}
+	case "DEL":
+		if len(args) < 2 {
+			return nil, respArgsError(cmd)
+		}
+		return args[1:], nil
+	case "PING", "SCAN", "INFO", "COMMAND":
+		return nil, respError("ERR " + cmd + " is not supported in MULTI")
+	default:
+		return nil, respError("ERR unknown command '" + args[0] + "'")
+	}
+	return args[1:2], nil
+}
+
+// startOp times a command of the client at addr for the slowlog.
+func (s *RESPServer) startOp(cmd, addr string) *SlowOp {
+	op := s.ks.StartOp("RESP."+cmd, nil)
+	op.entry.Caller = addr
+	return op
+}
+
+// run runs a command of the client at addr out of MULTI.
+func (s *RESPServer) run(addr, cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			return args[1]
+		}
+		return respStatus("PONG")
+	case "SCAN":
+		op := s.startOp(cmd, addr)
+		defer op.Finish()
+		return s.scan(args, op)
+	case "INFO":
+		return s.info()
+	case "COMMAND":
+		// redis-cli asks for the docs of the commands at start.
+		return []interface{}{}
+	}
+	keys, e := respKeys(cmd, args)
+	if e != nil {
+		return e
+	}
+	op := s.startOp(cmd, addr)
+	defer op.Finish()
+	unlock := op.Lock(keys...)
+	defer unlock()
+	return s.runLocked(cmd, args)
+}
+
+// exec runs the commands of a MULTI, holding all their keys.
+func (s *RESPServer) exec(addr string, cmds [][]string) interface{} {
+	var keys []string
+	for _, args := range cmds {
+		k, _ := respKeys(strings.ToUpper(args[0]), args)
+		keys = append(keys, k...)
+	}
+	op := s.startOp("EXEC", addr)
+	defer op.Finish()
+	unlock := op.Lock(keys...)
+	defer unlock()
+	replies := make([]interface{}, len(cmds))
+	for i, args := range cmds {
+		replies[i] = s.runLocked(strings.ToUpper(args[0]), args)
+	}
+	return replies
+}
+
+// runLocked runs a command checked by respKeys, with its keys held.
+func (s *RESPServer) runLocked(cmd string, args []string) interface{} {
+	ks := s.ks
+	if cmd != "GET" && ks.ReadOnly() {
+		return respError("READONLY You can't write against a read only replica.")
+	}
+	switch cmd {
+	case "GET":
+		if value, existed := ks.RawGet(args[1]); existed {
+			return value
+		}
+		return nil
+	case "SET":
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); {
+			case opt == "NX":
+				nx = true
+			case (opt == "EX" || opt == "PX") && i+1 < len(args):
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					return respError("ERR invalid expire time in 'set' command")
+				}
+				unit := time.Second
+				if opt == "PX" {
+					unit = time.Millisecond
+				}
+				ttl = time.Duration(n) * unit
+				i++
+			default:
+				return respError("ERR syntax error")
+			}
+		}
+		if _, existed := ks.RawGet(args[1]); nx && existed {
+			return nil
+		}
+		ks.RawPut(args[1], args[2])
+		ks.RawExpire(args[1], ttl)
+		return respOK
+	case "INCRBY":
+		delta, err := strconv.Atoi(args[2])
+		if err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+		value, _, err := ks.rawIncr(args[1], delta)
+		if err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		return n
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if ks.RawDel(key) {
+				n++
+			}
+		}
+		return n
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+		var existed bool
+		if seconds <= 0 {
+			// Redis deletes the key, rather than persisting it.
+			existed = ks.RawDel(args[1])
+		} else {
+			existed = ks.RawExpire(args[1], time.Duration(seconds)*time.Second)
+		}
+		if existed {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return respError("ERR unknown command '" + args[0] + "'")
+}
+
+// scan pages through the keys in order, the cursor being the number of
+// keys replied before. Only patterns of a prefix followed by * match.
+func (s *RESPServer) scan(args []string, op *SlowOp) interface{} {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return respArgsError("SCAN")
+	}
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil || cursor < 0 {
+		return respError("ERR invalid cursor")
+	}
+	prefix, count := "", 10
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern := args[i+1]
+			prefix = strings.TrimSuffix(pattern, "*")
+			if strings.ContainsAny(prefix, "*?[\\") {
+				return respError("ERR only the patterns of a prefix followed by * are supported")
+			}
+			if prefix == pattern {
+				// An exact key.
+				op.AddKeys(pattern)
+				if _, existed := s.ks.Get(pattern); existed && cursor == 0 {
+					return []interface{}{"0", []interface{}{pattern}}
+				}
+				return []interface{}{"0", []interface{}{}}
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return respError("ERR syntax error")
+			}
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+	op.AddKeys(prefix + "*")
+	keys, _ := s.ks.Keys(prefix, 0)
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	if end >= len(keys) {
+		end = len(keys)
+	}
+	page := make([]interface{}, 0, end-cursor)
+	for _, key := range keys[cursor:end] {
+		page = append(page, key)
+	}
+	next := strconv.Itoa(end)
+	if end == len(keys) {
+		next = "0"
+	}
+	return []interface{}{next, page}
+}
+
+func (s *RESPServer) info() interface{} {
+	keys, bytes := s.ks.Usage()
+	return fmt.Sprintf("# Server\r\nredis_mode:standalone\r\nshards:%d\r\n\r\n"+
+		"# Memory\r\nused_memory_dataset:%d\r\n\r\n"+
+		"# Stats\r\npanics:%d\r\n\r\n# Keyspace\r\ndb0:keys=%d\r\n",
+		len(s.ks.shards), bytes, s.ks.Panics(), keys)
+}
+
+// readRESPCommand reads an array of bulk strings, or an inline command.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1024*1024 {
+		return nil, errRESPProtocol
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = readRESPLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return nil, errRESPProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case respStatus:
+		w.WriteString("+" + string(v) + "\r\n")
+	case respError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, e := range v {
+			writeRESP(w, e)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package kv
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient sends the commands inline, and reads the replies raw.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *respClient) do(cmd string, replyLines int) string {
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	var lines []string
+	for i := 0; i < replyLines; i++ {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: %v", cmd, err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+	}
+	return strings.Join(lines, " ")
+}
+
+func TestRESP(t *testing.T) {
+	ks := NewKVStore()
+	s, err := ListenRESP(ks, "tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	for _, tc := range []struct {
+		cmd   string
+		lines int
+		reply string
+	}{
+		{"PING", 1, "+PONG"},
+		{"GET a", 1, "$-1"},
+		{"SET a 1", 1, "+OK"},
+		{"SET a 2 NX", 1, "$-1"},
+		{"INCRBY a 41", 1, ":42"},
+		{"GET a", 2, "$2 42"},
+		{"SET b x", 1, "+OK"},
+		{"INCRBY b 1", 1, "-ERR value is not an integer or out of range"},
+		{"SET k1 v", 1, "+OK"},
+		{"SET k2 v EX 100", 1, "+OK"},
+		{"SCAN 0 MATCH k* COUNT 1", 6, "*2 $1 1 *1 $2 k1"},
+		{"SCAN 1 MATCH k*", 6, "*2 $1 0 *1 $2 k2"},
+		{"EXPIRE k2 0", 1, ":1"},
+		{"EXPIRE k2 10", 1, ":0"},
+		{"DEL a b c", 1, ":2"},
+		{"MULTI", 1, "+OK"},
+		{"SET x 1", 1, "+QUEUED"},
+		{"INCRBY x 2", 1, "+QUEUED"},
+		{"GET x", 1, "+QUEUED"},
+		{"EXEC", 5, "*3 +OK :3 $1 3"},
+		{"MULTI", 1, "+OK"},
+		{"SET x", 1, "-ERR wrong number of arguments for 'set' command"},
+		{"EXEC", 1, "-EXECABORT Transaction discarded because of previous errors."},
+		{"EXEC", 1, "-ERR EXEC without MULTI"},
+		{"FLUSHALL", 1, "-ERR unknown command 'FLUSHALL'"},
+	} {
+		if reply := c.do(tc.cmd, tc.lines); reply != tc.reply {
+			t.Fatalf("%s = %q; expected %q", tc.cmd, reply, tc.reply)
+		}
+	}
+
+	// A multi-bulk command, as the clients send.
+	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nhello\r\n"))
+	if line, _ := c.r.ReadString('\n'); line != "+OK\r\n" {
+		t.Fatalf("multi-bulk SET = %q", line)
+	}
+	if v, _ := ks.Get("key"); v != "hello" {
+		t.Fatalf("key = %q", v)
+	}
+	ks.PutTTL("t", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if reply := c.do("GET t", 1); reply != "$-1" {
+		t.Fatalf("GET of an expired key = %q", reply)
+	}
+
+	// The commands are logged like the RPCs.
+	ks.SetSlowlogThreshold(0)
+	c.do("SET s 1", 1)
+	if e := ks.Slowlog(1)[0]; e.Op != "RESP.SET" || len(e.Keys) != 1 || e.Keys[0] != "s" ||
+		!strings.HasPrefix(e.Caller, "127.0.0.1:") {
+		t.Fatalf("slowlog entry %+v", e)
+	}
+}
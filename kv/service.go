@@ -1,39 +1,47 @@
 package kv
 
 import (
-	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// KVStore splits the data into shards selected by the hash of the key,
+// and every shard has its own lock. The extended KV-Store could lock
+// a set of shards atomically by LockKeys.
 type KVStore struct {
-	Data map[string]string
-
-	// RwLock is the publi Read-Write Mutex, which can
-	// be used in the extended KV-Store.
-	RwLock sync.RWMutex
+	shards   []*shard
+	hash     KeyHashFunc
+	events   *eventLog // the recent changes, for the watchers
+	slowlog  *slowlog
+	rpc      *rpcStats
+	stop     chan struct{} // closed by Close to stop sweeping the expired keys
+	stopOnce sync.Once
 
 	Dead       int32 // for testing
 	unreliable int32 // for testing
-
-	// debug
-	costNs int64
+	readOnly   int32
 }
 
-// NewKVStore inits a tiny KV-Store.
+// NewKVStore inits a tiny KV-Store with DefaultShards shards.
 func NewKVStore() *KVStore {
-	ks := &KVStore{data: make(map[string]string)}
-	go func() {
-		for _ = range time.Tick(time.Second * 5) {
-			ns := atomic.LoadInt64(&ks.costNs)
-			fmt.Printf("KVStore cost %v ms\n", ns/time.Millisecond.Nanoseconds())
-		}
-	}()
+	return NewShardedKVStore(DefaultShards)
+}
+
+// NewShardedKVStore inits a tiny KV-Store with n shards.
+func NewShardedKVStore(n int) *KVStore {
+	if n < 1 {
+		n = 1
+	}
+	ks := &KVStore{shards: newShards(n), hash: DefaultKeyHashFunc,
+		events: newEventLog(WatchLogSize), slowlog: newSlowlog(), stop: make(chan struct{})}
+	ks.rpc = newRPCStats(ks)
+	go ks.sweepExpired()
 	return ks
 }
 
@@ -42,6 +50,8 @@ type KVStoreService struct {
 	l       net.Listener
 	network string
 	addr    string
+	resp    *RESPServer
+	admin   *AdminServer
 }
 
 // NewKVStoreService inits a tiny KV-Store service.
@@ -67,7 +77,7 @@ func (service *KVStoreService) Serve() {
 			if conn, err := l.Accept(); err == nil {
 				if !service.IsDead() {
 					// concurrent processing
-					go rpcs.ServeConn(conn)
+					go ServeConn(rpcs, conn)
 				} else if err == nil {
 					conn.Close()
 				}
@@ -80,96 +90,189 @@ func (service *KVStoreService) Serve() {
 	}()
 }
 
+// ServeRESP serves the store in the Redis protocol on addr too, see
+// RESPServer.
+func (service *KVStoreService) ServeRESP(addr string) error {
+	resp, err := ListenRESP(service.KVStore, service.network, addr)
+	if err != nil {
+		return err
+	}
+	service.resp = resp
+	return nil
+}
+
+// ServeAdmin serves the admin API of the store on addr, see AdminServer.
+func (service *KVStoreService) ServeAdmin(addr string, opts AdminOptions) error {
+	admin, err := ListenAdmin(service.KVStore, service.network, addr, opts)
+	if err != nil {
+		return err
+	}
+	service.admin = admin
+	return nil
+}
+
 func (ks *KVStoreService) IsDead() bool {
-	return atomic.LoadInt32(&ks.dead) != 0
+	return atomic.LoadInt32(&ks.Dead) != 0
 }
 
 // Clear the data and close the kvstore service.
 func (ks *KVStoreService) Kill() {
 	log.Println("Kill the kvstore")
-	atomic.StoreInt32(&ks.dead, 1)
-	ks.data = nil
+	atomic.StoreInt32(&ks.Dead, 1)
+	ks.Clear()
+	ks.Close()
+	if ks.resp != nil {
+		ks.resp.Close()
+	}
+	if ks.admin != nil {
+		ks.admin.Close()
+	}
 	if err := ks.l.Close(); err != nil {
 		log.Fatal("Kvsotre rPC server close error:", err)
 	}
 }
 
 func (ks *KVStore) Put(key, value string) (oldValue string, existed bool) {
-	now := time.Now()
-	defer func() {
-		atomic.AddInt64(&ks.costNs, time.Since(now).Nanoseconds())
-	}()
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.rawPut(key, value)
+}
 
-	ks.RwLock.Lock()
-	defer ks.RwLock.Unlock()
-	oldValue, existed = ks.data[key]
-	ks.data[key] = value
+// rawPut is Put with the key held by LockKeys.
+func (ks *KVStore) rawPut(key, value string) (oldValue string, existed bool) {
+	oldValue, existed = ks.RawGet(key)
+	ks.RawPut(key, value)
 	return
 }
 
 func (ks *KVStore) Get(key string) (value string, existed bool) {
-	now := time.Now()
-	defer func() {
-		atomic.AddInt64(&ks.costNs, time.Since(now).Nanoseconds())
-	}()
-
-	ks.RwLock.RLock()
-	defer ks.RwLock.RUnlock()
-
-	value, existed = ks.data[key]
-	return
+	s := ks.shardOf(key)
+	s.RLock()
+	defer s.RUnlock()
+	return s.get(key)
 }
 
 func (ks *KVStore) Incr(key string, delta int) (newVal string, existed bool, err error) {
-	now := time.Now()
-	defer func() {
-		atomic.AddInt64(&ks.costNs, time.Since(now).Nanoseconds())
-	}()
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.rawIncr(key, delta)
+}
 
-	ks.RwLock.Lock()
-	defer ks.RwLock.Unlock()
+// rawIncr is Incr with the key held by LockKeys.
+func (ks *KVStore) rawIncr(key string, delta int) (newVal string, existed bool, err error) {
 	var oldVal string
-	if oldVal, existed = ks.data[key]; existed {
+	if oldVal, existed = ks.RawGet(key); existed {
 		var iOldVal int
 		if iOldVal, err = strconv.Atoi(oldVal); err == nil {
 			newVal = strconv.Itoa(iOldVal + delta)
-			ks.data[key] = newVal
+			ks.RawPut(key, newVal)
 			return
 		}
 		return
 	}
 	newVal = strconv.Itoa(delta)
-	ks.data[key] = newVal
+	ks.RawPut(key, newVal)
 	return
 }
 
 func (ks *KVStore) Del(key string) (existed bool) {
-	now := time.Now()
-	defer func() {
-		atomic.AddInt64(&ks.costNs, time.Since(now).Nanoseconds())
-	}()
+	unlock := ks.LockKeys(key)
+	defer unlock()
+	return ks.RawDel(key)
+}
+
+// Scan returns all the k-v pairs whose key starts with prefix. Every
+// shard is scanned atomically, but not the store as a whole.
+func (ks *KVStore) Scan(prefix string) map[string]string {
+	return ks.scan(prefix, nil)
+}
 
-	ks.RwLock.Lock()
-	defer ks.RwLock.Unlock()
-	if _, existed = ks.data[key]; existed {
-		delete(ks.data, key)
+// scan is Scan counting the wait for the shards in op, if any.
+func (ks *KVStore) scan(prefix string, op *SlowOp) map[string]string {
+	data := make(map[string]string)
+	for _, s := range ks.shards {
+		since := time.Now()
+		s.RLock()
+		if op != nil {
+			op.entry.LockWait += time.Since(since)
+		}
+		now := time.Now().UnixNano()
+		for key, value := range s.data {
+			if strings.HasPrefix(key, prefix) && !s.expired(key, now) {
+				data[key] = value
+			}
+		}
+		s.RUnlock()
 	}
-	return
+	return data
+}
+
+// Ping tells that the service is up, for checking the pooled connections.
+// @Flag: true.
+func (ks *KVStore) RPCPing(args *PingArgs, reply *Reply) error {
+	reply.Flag = true
+	return nil
 }
 
 // Put k-v pair.
 // @existed: true if the key exists before, false otherwise.
 // @Value: old value.
-func (ks *KVStore) RPCPut(args *PutArgs, reply *Reply) error {
-	reply.Value, reply.Flag = ks.Put(args.Key, args.Value)
+// The key expires after TTLMs milliseconds if it's positive.
+func (ks *KVStore) RPCPut(args *PutArgs, reply *Reply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCPut", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCPut", args)
+	defer op.Finish()
+	unlock := op.Lock(args.Key)
+	defer unlock()
+	*reply = ks.rawPutArgs(args)
+	return nil
+}
+
+// Put k-v pair only if the key doesn't exist.
+// @Flag: true if the key exists before, false otherwise.
+// @Value: the existing value if the key exists.
+func (ks *KVStore) RPCPutNX(args *PutArgs, reply *Reply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCPutNX", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCPutNX", args)
+	defer op.Finish()
+	unlock := op.Lock(args.Key)
+	defer unlock()
+	reply.Value, reply.Flag = ks.rawPutNX(args.Key, args.Value, msToDuration(args.TTLMs))
+	return nil
+}
+
+// Set the key to expire after TTLMs milliseconds, or persist it if
+// TTLMs isn't positive.
+// @Flag: true if the key exists, false otherwise.
+func (ks *KVStore) RPCExpire(args *ExpireArgs, reply *Reply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCExpire", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCExpire", args)
+	defer op.Finish()
+	unlock := op.Lock(args.Key)
+	defer unlock()
+	reply.Flag = ks.RawExpire(args.Key, msToDuration(args.TTLMs))
 	return nil
 }
 
 // Return value of the specific key.
 // @Flag: true if the key exists, false otherwise.
 // @Value: self if the key exists, "" otherwise.
-func (ks *KVStore) RPCGet(args *GetArgs, reply *Reply) error {
-	reply.Value, reply.Flag = ks.Get(args.Key)
+func (ks *KVStore) RPCGet(args *GetArgs, reply *Reply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCGet", time.Now(), &err)
+	op := ks.StartOp("KVStore.RPCGet", args)
+	defer op.Finish()
+	unlock := op.RLock(args.Key)
+	defer unlock()
+	reply.Value, reply.Flag = ks.RawGet(args.Key)
 	return nil
 }
 
@@ -179,13 +282,40 @@ func (ks *KVStore) RPCGet(args *GetArgs, reply *Reply) error {
 // @Value: new value.
 // @err: non-nil if the value is numeric.
 func (ks *KVStore) RPCIncr(args *IncrArgs, reply *Reply) (err error) {
-	reply.Value, reply.Flag, err = ks.Incr(args.Key, args.Delta)
+	defer ks.RecoverRPC("KVStore.RPCIncr", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCIncr", args)
+	defer op.Finish()
+	unlock := op.Lock(args.Key)
+	defer unlock()
+	reply.Value, reply.Flag, err = ks.rawIncr(args.Key, args.Delta)
 	return err
 }
 
 // Del the value of the specific key.
 // @Flag: true if the key exists before, false otherwise.
 func (ks *KVStore) RPCDel(args *DelArgs, reply *Reply) (err error) {
-	reply.Flag = ks.Del(args.Key)
+	defer ks.RecoverRPC("KVStore.RPCDel", time.Now(), &err)
+	if err = ks.checkWritable(); err != nil {
+		return
+	}
+	op := ks.StartOp("KVStore.RPCDel", args)
+	defer op.Finish()
+	unlock := op.Lock(args.Key)
+	defer unlock()
+	reply.Flag = ks.RawDel(args.Key)
+	return nil
+}
+
+// Scan the k-v pairs with the specific key prefix.
+// @Data: the matched pairs.
+func (ks *KVStore) RPCScan(args *ScanArgs, reply *ScanReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCScan", time.Now(), &err)
+	op := ks.StartOp("KVStore.RPCScan", args)
+	defer op.Finish()
+	op.AddKeys(args.Prefix + "*")
+	reply.Data = ks.scan(args.Prefix, op)
 	return nil
 }
@@ -0,0 +1,171 @@
+package kv
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultShards is the number of shards of the store made by NewKVStore.
+const DefaultShards = 64
+
+// KeyHashFunc maps a key to the index in [0, n) of the shard (or the
+// node) holding it.
+type KeyHashFunc func(key string, n int) int
+
+// DefaultKeyHashFunc is the 32-bit FNV-1a hash of the key modulo n, taken
+// unsigned so that it's never negative where int has 32 bits.
+func DefaultKeyHashFunc(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// shard is an independently locked part of the KV-Store.
+type shard struct {
+	sync.RWMutex
+	data    map[string]string
+	expires map[string]int64 // deadlines in unix nanoseconds of the keys with a TTL
+}
+
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{data: make(map[string]string), expires: make(map[string]int64)}
+	}
+	return shards
+}
+
+// get reads a key which hasn't expired.
+func (s *shard) get(key string) (value string, existed bool) {
+	if value, existed = s.data[key]; existed && s.expired(key, 0) {
+		return "", false
+	}
+	return
+}
+
+// expired tells whether the key has expired at now, which is taken from
+// the clock if it is 0.
+func (s *shard) expired(key string, now int64) bool {
+	deadline, ok := s.expires[key]
+	if !ok {
+		return false
+	}
+	if now == 0 {
+		now = time.Now().UnixNano()
+	}
+	return now >= deadline
+}
+
+func (ks *KVStore) shardIndex(key string) int {
+	return ks.hash(key, len(ks.shards))
+}
+
+func (ks *KVStore) shardOf(key string) *shard {
+	return ks.shards[ks.shardIndex(key)]
+}
+
+// shardIndexes returns the distinct shards of the keys in ascending
+// order, which is the order they must be locked in.
+func (ks *KVStore) shardIndexes(keys []string) []int {
+	idxs := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		if idx := ks.shardIndex(key); !seen[idx] {
+			seen[idx] = true
+			idxs = append(idxs, idx)
+		}
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// LockKeys write-locks the shards of all the given keys and returns the
+// function releasing them. The shards are acquired in ascending order,
+// so callers locking overlapping key sets cannot deadlock. LockKeys is
+// not reentrant: while holding it, access the keys by RawGet, RawPut and
+// RawDel instead of Get, Put, Incr or Del.
+func (ks *KVStore) LockKeys(keys ...string) (unlock func()) {
+	idxs := ks.shardIndexes(keys)
+	for _, idx := range idxs {
+		ks.shards[idx].Lock()
+	}
+	return func() {
+		for i := len(idxs) - 1; i >= 0; i-- {
+			ks.shards[idxs[i]].Unlock()
+		}
+	}
+}
+
+// TryLockKeys is LockKeys giving up after timeout. If it gives up, the
+// shards are released as soon as they are acquired.
+func (ks *KVStore) TryLockKeys(timeout time.Duration, keys ...string) (unlock func(), ok bool) {
+	locked := make(chan func(), 1)
+	go func() {
+		locked <- ks.LockKeys(keys...)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case unlock = <-locked:
+		return unlock, true
+	case <-timer.C:
+		go func() {
+			(<-locked)()
+		}()
+		return nil, false
+	}
+}
+
+// RLockKeys is the read-only version of LockKeys. Only RawGet may be
+// used while holding it.
+func (ks *KVStore) RLockKeys(keys ...string) (unlock func()) {
+	idxs := ks.shardIndexes(keys)
+	for _, idx := range idxs {
+		ks.shards[idx].RLock()
+	}
+	return func() {
+		for i := len(idxs) - 1; i >= 0; i-- {
+			ks.shards[idxs[i]].RUnlock()
+		}
+	}
+}
+
+// RawGet reads the key. The caller must hold the key by LockKeys
+// or RLockKeys.
+func (ks *KVStore) RawGet(key string) (value string, existed bool) {
+	return ks.shardOf(key).get(key)
+}
+
+// RawPut sets the key and clears its TTL. The caller must hold the key
+// by LockKeys.
+func (ks *KVStore) RawPut(key, value string) {
+	s := ks.shardOf(key)
+	old, existed := s.get(key)
+	s.data[key] = value
+	delete(s.expires, key)
+	ks.events.append(key, old, value, existed, false)
+}
+
+// RawDel deletes the key. The caller must hold the key by LockKeys.
+func (ks *KVStore) RawDel(key string) (existed bool) {
+	s := ks.shardOf(key)
+	var old string
+	if old, existed = s.get(key); existed {
+		delete(s.data, key)
+		delete(s.expires, key)
+		ks.events.append(key, old, "", true, true)
+	}
+	return
+}
+
+// Clear drops all the data of the store.
+func (ks *KVStore) Clear() {
+	for _, s := range ks.shards {
+		s.Lock()
+		s.data = make(map[string]string)
+		s.expires = make(map[string]int64)
+		s.Unlock()
+	}
+}
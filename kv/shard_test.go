@@ -0,0 +1,182 @@
+package kv
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchItems    = 10000
+	benchCartSize = 3
+)
+
+func newBenchStore(shards int) *KVStore {
+	ks := NewShardedKVStore(shards)
+	for i := 0; i < benchItems; i++ {
+		ks.Put("stock:"+strconv.Itoa(i), "1000000000")
+	}
+	return ks
+}
+
+func randomCart(r *rand.Rand) []string {
+	keys := make([]string, benchCartSize)
+	for i := range keys {
+		keys[i] = "stock:" + strconv.Itoa(r.Intn(benchItems))
+	}
+	return keys
+}
+
+// checkout decreases the stock of every key by one if all of them
+// are in stock. The caller provides the mutual exclusion.
+func checkout(ks *KVStore, keys []string) bool {
+	for _, key := range keys {
+		if v, _ := ks.RawGet(key); v == "0" {
+			return false
+		}
+	}
+	for _, key := range keys {
+		v, _ := ks.RawGet(key)
+		n, _ := strconv.Atoi(v)
+		ks.RawPut(key, strconv.Itoa(n-1))
+	}
+	return true
+}
+
+func TestLockKeysOverlapping(t *testing.T) {
+	ks := newBenchStore(DefaultShards)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				// Reverse the key order of every other goroutine to
+				// provoke a deadlock if the stripes were not sorted.
+				keys := []string{"stock:1", "stock:2", "stock:" + strconv.Itoa(i+3)}
+				if g%2 == 1 {
+					keys[0], keys[2] = keys[2], keys[0]
+				}
+				unlock := ks.LockKeys(keys...)
+				checkout(ks, []string{"stock:1", "stock:2"})
+				unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if v, _ := ks.Get("stock:1"); v != strconv.Itoa(1000000000-8000) {
+		t.Fatalf("lost update on stock:1, got %v", v)
+	}
+}
+
+func TestShardedIncr(t *testing.T) {
+	ks := NewShardedKVStore(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1024; i++ {
+				ks.Incr("counter:"+strconv.Itoa(i%16), 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 16; i++ {
+		if v, existed := ks.Get("counter:" + strconv.Itoa(i)); !existed || v != "512" {
+			t.Fatalf("counter:%d = %v, %v; expected 512", i, v, existed)
+		}
+	}
+	if existed := ks.Del("counter:0"); !existed {
+		t.Fatalf("Del of an existing key returned false")
+	}
+	if _, existed := ks.Get("counter:0"); existed {
+		t.Fatalf("key still exists after Del")
+	}
+}
+
+func benchmarkCheckout(b *testing.B, shards int) {
+	ks := newBenchStore(shards)
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			keys := randomCart(r)
+			unlock := ks.LockKeys(keys...)
+			checkout(ks, keys)
+			unlock()
+		}
+	})
+}
+
+// BenchmarkCheckoutOneShard serializes every checkout behind one
+// store-wide lock, as ShoppingKVStore used to.
+func BenchmarkCheckoutOneShard(b *testing.B) { benchmarkCheckout(b, 1) }
+
+// BenchmarkCheckoutSharded locks only the shards of the cart items.
+func BenchmarkCheckoutSharded(b *testing.B) { benchmarkCheckout(b, DefaultShards) }
+
+func benchmarkGetPut(b *testing.B, shards int) {
+	ks := newBenchStore(shards)
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := "stock:" + strconv.Itoa(r.Intn(benchItems))
+			if r.Intn(4) == 0 {
+				ks.Put(key, "1")
+			} else {
+				ks.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkGetPutOneShard(b *testing.B) { benchmarkGetPut(b, 1) }
+
+func BenchmarkGetPutSharded(b *testing.B) { benchmarkGetPut(b, DefaultShards) }
+
+func TestExpire(t *testing.T) {
+	ks := NewShardedKVStore(4)
+	ks.PutTTL("short", "1", 50*time.Millisecond)
+	if _, existed := ks.PutNX("short", "2", 0); !existed {
+		t.Fatalf("PutNX overwrote an existing key")
+	}
+	ks.Put("long", "1")
+	ks.Expire("long", time.Hour)
+	ks.PutTTL("persisted", "1", 50*time.Millisecond)
+	ks.Put("persisted", "2")
+
+	time.Sleep(100 * time.Millisecond)
+	if _, existed := ks.Get("short"); existed {
+		t.Fatalf("expired key is visible")
+	}
+	if data := ks.Scan(""); len(data) != 2 || data["long"] != "1" || data["persisted"] != "2" {
+		t.Fatalf("wrong scan after expiration %v", data)
+	}
+	if _, existed := ks.PutNX("short", "3", 0); existed {
+		t.Fatalf("PutNX failed on an expired key")
+	}
+}
+
+func TestDefaultKeyHashFunc(t *testing.T) {
+	high := 0
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if h.Sum32() >= 1<<31 {
+			high++
+		}
+		for _, n := range []int{1, 3, DefaultShards} {
+			// Unchanged from the signed modulo where int has 64 bits.
+			if got := DefaultKeyHashFunc(key, n); got != int(int64(h.Sum32())%int64(n)) {
+				t.Fatalf("DefaultKeyHashFunc(%q, %d) = %d", key, n, got)
+			}
+		}
+	}
+	if high == 0 {
+		t.Fatal("no key hashed beyond the int32 range")
+	}
+}
@@ -0,0 +1,288 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultSlowlogThreshold is how long an operation takes to be logged,
+	// unless SetSlowlogThreshold changes it.
+	DefaultSlowlogThreshold = 10 * time.Millisecond
+	// SlowlogSize is the entries kept, the oldest dropped first.
+	SlowlogSize = 128
+	// slowlogMaxKeys are the keys kept by an entry, as the batches may
+	// have thousands.
+	slowlogMaxKeys = 32
+)
+
+// SlowEntry is an operation which took longer than the threshold.
+type SlowEntry struct {
+	ID       uint64    // increasing, to tell the entries seen
+	Time     time.Time // when it started
+	Op       string    // e.g. KVStore.RPCPut
+	Keys     []string  // a scan has its prefix followed by "*"
+	Duration time.Duration
+	// LockWait is the part of Duration spent waiting for the locks of
+	// the keys, the rest executing.
+	LockWait time.Duration
+	Caller   string // the address of the client, "" if unknown
+}
+
+// slowlog keeps the last SlowlogSize slow operations in a ring.
+type slowlog struct {
+	threshold int64 // nanoseconds, negative if off
+
+	mu      sync.Mutex
+	entries []SlowEntry
+	next    int // where the next entry goes once the ring is full
+	lastID  uint64
+}
+
+func newSlowlog() *slowlog {
+	return &slowlog{threshold: int64(DefaultSlowlogThreshold)}
+}
+
+func (l *slowlog) add(e SlowEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID++
+	e.ID = l.lastID
+	if len(l.entries) < SlowlogSize {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % SlowlogSize
+}
+
+// SetSlowlogThreshold logs the operations taking at least d, all of them
+// if it's 0, or none if it's negative.
+func (ks *KVStore) SetSlowlogThreshold(d time.Duration) {
+	atomic.StoreInt64(&ks.slowlog.threshold, int64(d))
+}
+
+func (ks *KVStore) SlowlogThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ks.slowlog.threshold))
+}
+
+// Slowlog returns the slow operations logged, the newest first, at most
+// limit of them if it's positive.
+func (ks *KVStore) Slowlog(limit int) []SlowEntry {
+	l := ks.slowlog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.entries)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	entries := make([]SlowEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return entries
+}
+
+// ResetSlowlog drops the slow operations logged.
+func (ks *KVStore) ResetSlowlog() {
+	l := ks.slowlog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries, l.next = nil, 0
+}
+
+type SlowlogArgs struct {
+	Limit int  // all the entries if it's not positive
+	Reset bool // drop the entries once returned
+}
+
+type SlowlogReply struct {
+	Entries     []SlowEntry // the newest first
+	ThresholdMs int64
+}
+
+// Return the slow operations logged.
+// @Entries: the newest first, at most Limit of them.
+func (ks *KVStore) RPCSlowlog(args *SlowlogArgs, reply *SlowlogReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCSlowlog", time.Now(), &err)
+	reply.Entries = ks.Slowlog(args.Limit)
+	reply.ThresholdMs = int64(ks.SlowlogThreshold() / time.Millisecond)
+	if args.Reset {
+		ks.ResetSlowlog()
+	}
+	return nil
+}
+
+// SlowOp times an operation for the slowlog, telling the time waiting for
+// the locks taken by it from the rest:
+//
+//	op := ks.StartOp("KVStore.RPCPut", args)
+//	defer op.Finish()
+//	unlock := op.Lock(args.Key)
+//	defer unlock()
+type SlowOp struct {
+	ks    *KVStore
+	start time.Time
+	entry SlowEntry
+}
+
+// StartOp starts timing the operation op serving args, the client of
+// which is known if they were received by ServeConn.
+func (ks *KVStore) StartOp(op string, args interface{}) *SlowOp {
+	return &SlowOp{ks: ks, start: time.Now(), entry: SlowEntry{Op: op, Caller: CallerOf(args)}}
+}
+
+// AddKeys records the keys accessed without locking them.
+func (o *SlowOp) AddKeys(keys ...string) {
+	o.entry.Keys = append(o.entry.Keys, keys...)
+}
+
+func (o *SlowOp) waited(since time.Time, keys []string) {
+	o.entry.LockWait += time.Since(since)
+	o.AddKeys(keys...)
+}
+
+// Lock is LockKeys counting the wait.
+func (o *SlowOp) Lock(keys ...string) (unlock func()) {
+	since := time.Now()
+	unlock = o.ks.LockKeys(keys...)
+	o.waited(since, keys)
+	return
+}
+
+// RLock is RLockKeys counting the wait.
+func (o *SlowOp) RLock(keys ...string) (unlock func()) {
+	since := time.Now()
+	unlock = o.ks.RLockKeys(keys...)
+	o.waited(since, keys)
+	return
+}
+
+// TryLock is TryLockKeys counting the wait.
+func (o *SlowOp) TryLock(timeout time.Duration, keys ...string) (unlock func(), ok bool) {
+	since := time.Now()
+	unlock, ok = o.ks.TryLockKeys(timeout, keys...)
+	o.waited(since, keys)
+	return
+}
+
+// Finish logs the operation if it took longer than the threshold.
+func (o *SlowOp) Finish() {
+	threshold := o.ks.SlowlogThreshold()
+	duration := time.Since(o.start)
+	if threshold < 0 || duration < threshold {
+		return
+	}
+	e := o.entry
+	e.Time, e.Duration = o.start, duration
+	if len(e.Keys) > slowlogMaxKeys {
+		more := len(e.Keys) - slowlogMaxKeys + 1
+		e.Keys = append(e.Keys[:slowlogMaxKeys-1:slowlogMaxKeys-1], "... ("+strconv.Itoa(more)+" more keys)")
+	}
+	o.ks.slowlog.add(e)
+}
+
+// callers maps the args of the RPCs being served to the addresses of
+// their clients, as net/rpc doesn't tell them to the methods.
+var callers sync.Map
+
+// CallerOf returns the address of the client which sent the args of the
+// RPC being served, "" if they weren't received by ServeConn.
+func CallerOf(args interface{}) string {
+	if args == nil {
+		return ""
+	}
+	if addr, ok := callers.Load(args); ok {
+		return addr.(string)
+	}
+	return ""
+}
+
+// ServeConn is server.ServeConn letting the methods learn the address of
+// the client by CallerOf.
+func ServeConn(server *rpc.Server, conn net.Conn) {
+	buf := bufio.NewWriter(conn)
+	server.ServeCodec(&callerCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf),
+		encBuf: buf, addr: conn.RemoteAddr().String(), args: make(map[uint64]interface{})})
+}
+
+// callerCodec is the gob codec of net/rpc recording the callers of the
+// requests until they are answered.
+type callerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	addr   string
+	closed bool
+	seq    uint64 // of the request read, as the body follows the header
+
+	mu   sync.Mutex
+	args map[uint64]interface{} // by the seq of the requests being served
+}
+
+func (c *callerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.seq = r.Seq
+	return nil
+}
+
+func (c *callerCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil || body == nil {
+		return err
+	}
+	callers.Store(body, c.addr)
+	c.mu.Lock()
+	c.args[c.seq] = body
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *callerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mu.Lock()
+	if args, ok := c.args[r.Seq]; ok {
+		callers.Delete(args)
+		delete(c.args, r.Seq)
+	}
+	c.mu.Unlock()
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *callerCodec) Close() error {
+	c.mu.Lock()
+	for seq, args := range c.args {
+		callers.Delete(args)
+		delete(c.args, seq)
+	}
+	c.mu.Unlock()
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,58 @@
+package kv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowlog(t *testing.T) {
+	srvAddr := "localhost:9094"
+	ts := NewKVStoreService("tcp", srvAddr)
+	ts.Serve()
+	defer ts.Kill()
+	client := NewClient(srvAddr)
+	defer client.Close()
+
+	ts.SetSlowlogThreshold(50 * time.Millisecond)
+	client.Put("fast", "1")
+	unlock := ts.LockKeys("slow")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+	client.Put("slow", "1")
+	ok, reply := client.Slowlog(0, false)
+	if !ok || len(reply.Entries) != 1 || reply.ThresholdMs != 50 {
+		t.Fatalf("Slowlog = %v %+v", ok, reply)
+	}
+	e := reply.Entries[0]
+	if e.Op != "KVStore.RPCPut" || len(e.Keys) != 1 || e.Keys[0] != "slow" ||
+		e.LockWait < 90*time.Millisecond || e.Duration < e.LockWait || !strings.HasPrefix(e.Caller, "127.0.0.1:") {
+		t.Fatalf("entry %+v", e)
+	}
+
+	ts.SetSlowlogThreshold(0)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = "k"
+	}
+	client.MGet(keys)
+	for i := 0; i < SlowlogSize; i++ {
+		client.Get("k")
+	}
+	ok, reply = client.Slowlog(2, true)
+	if !ok || len(reply.Entries) != 2 || reply.Entries[0].Op != "KVStore.RPCGet" ||
+		reply.Entries[0].ID != reply.Entries[1].ID+1 {
+		t.Fatalf("Slowlog = %v %+v", ok, reply)
+	}
+	if entries := ts.Slowlog(0); len(entries) != 0 {
+		t.Fatalf("reset left %+v", entries)
+	}
+
+	client.MGet(keys)
+	if e := ts.Slowlog(1)[0]; e.Op != "KVStore.RPCMGet" || len(e.Keys) != slowlogMaxKeys ||
+		e.Keys[slowlogMaxKeys-1] != "... (69 more keys)" {
+		t.Fatalf("entry %+v", e)
+	}
+}
@@ -0,0 +1,209 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rush-shopping/metrics"
+)
+
+var ErrReadOnly = errors.New("kv: read-only")
+
+// RPCStat counts the calls of an RPC method.
+type RPCStat struct {
+	Calls  uint64 `json:"calls"`
+	Errors uint64 `json:"errors"`
+}
+
+type rpcCounter struct {
+	calls, errors uint64
+}
+
+// rpcStats counts the RPCs served by a store and the panics recovered
+// from serving it, apart from the other stores of the process.
+type rpcStats struct {
+	counters sync.Map // method name to *rpcCounter
+	panics   uint64
+	duration *metrics.HistogramVec
+	metrics  *metrics.Registry
+}
+
+func newRPCStats(ks *KVStore) *rpcStats {
+	st := &rpcStats{metrics: metrics.NewRegistry()}
+	st.duration = st.metrics.NewHistogramVec("kv_rpc_duration_seconds",
+		"The latency of the RPCs served.", metrics.DefBuckets, "method")
+	read := func(count func(RPCStat) uint64) func() map[string]float64 {
+		return func() map[string]float64 {
+			values := make(map[string]float64)
+			for method, stat := range ks.RPCStats() {
+				values[method] = float64(count(stat))
+			}
+			return values
+		}
+	}
+	st.metrics.CounterVecFunc("kv_rpc_requests_total", "The RPCs served.", "method",
+		read(func(stat RPCStat) uint64 { return stat.Calls }))
+	st.metrics.CounterVecFunc("kv_rpc_errors_total", "The RPCs served which failed.", "method",
+		read(func(stat RPCStat) uint64 { return stat.Errors }))
+	st.metrics.CounterFunc("kv_store_panics_total", "The panics recovered from serving the store.",
+		func() float64 { return float64(ks.Panics()) })
+	return st
+}
+
+func init() {
+	metrics.Default.CounterFunc("kv_panics_recovered_total", "The panics recovered in the process.",
+		func() float64 { return float64(Panics()) })
+}
+
+// countRPC counts a call of the method served by the store.
+func (ks *KVStore) countRPC(method string, cost time.Duration, err error) {
+	ks.rpc.duration.Observe(cost.Seconds(), method)
+	c, ok := ks.rpc.counters.Load(method)
+	if !ok {
+		c, _ = ks.rpc.counters.LoadOrStore(method, new(rpcCounter))
+	}
+	atomic.AddUint64(&c.(*rpcCounter).calls, 1)
+	if err != nil {
+		atomic.AddUint64(&c.(*rpcCounter).errors, 1)
+	}
+}
+
+// RPCStats returns the counters of the RPC methods served by the store,
+// which are the methods deferring its RecoverRPC.
+func (ks *KVStore) RPCStats() map[string]RPCStat {
+	stats := make(map[string]RPCStat)
+	ks.rpc.counters.Range(func(method, c interface{}) bool {
+		stats[method.(string)] = RPCStat{Calls: atomic.LoadUint64(&c.(*rpcCounter).calls),
+			Errors: atomic.LoadUint64(&c.(*rpcCounter).errors)}
+		return true
+	})
+	return stats
+}
+
+// Panics returns how many panics have been recovered from serving the
+// RPCs, the RESP and the admin requests of the store.
+func (ks *KVStore) Panics() uint64 {
+	return atomic.LoadUint64(&ks.rpc.panics)
+}
+
+// RPCMetrics are kv_rpc_* and kv_store_panics_total of the store.
+func (ks *KVStore) RPCMetrics() *metrics.Registry {
+	return ks.rpc.metrics
+}
+
+// SetReadOnly makes the RPCs and the RESP commands writing fail with
+// ErrReadOnly, e.g. during maintenance. The store itself stays writable.
+func (ks *KVStore) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&ks.readOnly, v)
+}
+
+func (ks *KVStore) ReadOnly() bool {
+	return atomic.LoadInt32(&ks.readOnly) != 0
+}
+
+func (ks *KVStore) checkWritable() error {
+	if ks.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Usage returns the keys which haven't expired, and the bytes of them and
+// their values.
+func (ks *KVStore) Usage() (keys int, bytes int64) {
+	for _, s := range ks.shards {
+		s.RLock()
+		now := time.Now().UnixNano()
+		for key, value := range s.data {
+			if !s.expired(key, now) {
+				keys++
+				bytes += int64(len(key) + len(value))
+			}
+		}
+		s.RUnlock()
+	}
+	return
+}
+
+// TTL returns how long the key lives, 0 if it doesn't expire.
+func (ks *KVStore) TTL(key string) (ttl time.Duration, existed bool) {
+	s := ks.shardOf(key)
+	s.RLock()
+	defer s.RUnlock()
+	if _, existed = s.get(key); !existed {
+		return
+	}
+	if deadline, ok := s.expires[key]; ok {
+		ttl = time.Duration(deadline - time.Now().UnixNano())
+	}
+	return
+}
+
+// Keys returns the keys with prefix in order, at most limit of them if
+// it's positive.
+func (ks *KVStore) Keys(prefix string, limit int) (keys []string, truncated bool) {
+	data := ks.Scan(prefix)
+	keys = make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys, truncated = keys[:limit], true
+	}
+	return
+}
+
+// Snapshot is the data of a store at a time. Every shard is read
+// atomically, but not the store as a whole.
+type Snapshot struct {
+	Time    time.Time         `json:"time"`
+	Data    map[string]string `json:"data"`
+	Expires map[string]int64  `json:"expires"` // deadlines in unix milliseconds
+}
+
+// WriteSnapshot writes the snapshot of the store in JSON to path, which
+// is replaced only once the snapshot is complete.
+func (ks *KVStore) WriteSnapshot(path string) (keys int, err error) {
+	snap := Snapshot{Time: time.Now(), Data: make(map[string]string), Expires: make(map[string]int64)}
+	for _, s := range ks.shards {
+		s.RLock()
+		now := time.Now().UnixNano()
+		for key, value := range s.data {
+			if s.expired(key, now) {
+				continue
+			}
+			snap.Data[key] = value
+			if deadline, ok := s.expires[key]; ok {
+				snap.Expires[key] = deadline / int64(time.Millisecond)
+			}
+		}
+		s.RUnlock()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if err = json.NewEncoder(f).Encode(&snap); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	return len(snap.Data), err
+}
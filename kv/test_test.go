@@ -36,6 +36,25 @@ func TestBasic(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+func TestScan(t *testing.T) {
+	fmt.Printf("Test: Scan kvstore ...\n")
+	srvAddr := "localhost:9095"
+	ts := NewKVStoreService("tcp", srvAddr)
+	ts.Serve()
+	defer ts.Kill()
+
+	client := NewClient(srvAddr)
+
+	client.Put("key1", "1")
+	client.Put("key2", "2")
+	client.Put("other", "3")
+	ok, scanReply := client.Scan("key")
+	if !ok || len(scanReply.Data) != 2 || scanReply.Data["key2"] != "2" {
+		t.Fatalf("wrong scan reply %v", scanReply.Data)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestConcurrent(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 	fmt.Printf("Test: Concurrent kvstore R/W ...\n")
@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchLogSize is how many changes a store keeps for the watchers to
+// resume from.
+const WatchLogSize = 4096
+
+// Event is a change of a key. The version of the store increases by one
+// per change.
+type Event struct {
+	Version int64
+	Key     string
+	Old     string
+	New     string
+	Existed bool // whether the key existed before
+	Deleted bool
+}
+
+type WatchArgs struct {
+	Prefix string
+	// Versions to resume after, one per node of the store. If empty, the
+	// current versions are replied at once without any events.
+	Versions  []int64
+	TimeoutMs int64 // how long to wait for a change
+}
+
+type WatchReply struct {
+	Events   []Event
+	Versions []int64 // to resume after
+	// Truncated tells that some changes after Versions are gone from the
+	// log, so the watcher should reload the data.
+	Truncated bool
+}
+
+// eventLog is a ring of the last changes of a store.
+type eventLog struct {
+	mu      sync.Mutex
+	ring    []Event
+	version int64         // of the last change
+	waiters int           // waiting on changed
+	changed chan struct{} // closed by the next change if anyone waits
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{ring: make([]Event, size), changed: make(chan struct{})}
+}
+
+func (l *eventLog) append(key, old, new string, existed, deleted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.version++
+	l.ring[l.version%int64(len(l.ring))] = Event{Version: l.version, Key: key,
+		Old: old, New: new, Existed: existed, Deleted: deleted}
+	if l.waiters > 0 {
+		close(l.changed)
+		l.changed = make(chan struct{})
+		l.waiters = 0
+	}
+}
+
+func (l *eventLog) current() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version
+}
+
+// since must be called with mu held.
+func (l *eventLog) since(prefix string, after int64) (events []Event, truncated bool) {
+	if after > l.version {
+		// The store has restarted since.
+		return nil, true
+	}
+	if oldest := l.version - int64(len(l.ring)) + 1; after+1 < oldest {
+		truncated, after = true, oldest-1
+	}
+	for v := after + 1; v <= l.version; v++ {
+		if ev := l.ring[v%int64(len(l.ring))]; strings.HasPrefix(ev.Key, prefix) {
+			events = append(events, ev)
+		}
+	}
+	return
+}
+
+// WaitChanges returns the changes of the keys with prefix after the
+// version, waiting up to timeout for any. It returns the version to
+// resume after, and whether some changes are gone from the log.
+func (ks *KVStore) WaitChanges(prefix string, after int64, timeout time.Duration) (events []Event, version int64, truncated bool) {
+	l := ks.events
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		events, truncated = l.since(prefix, after)
+		version = l.version
+		if len(events) != 0 || truncated {
+			l.mu.Unlock()
+			return
+		}
+		// Skip the changes of other keys.
+		after = version
+		l.waiters++
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Watch the changes of the keys with the prefix.
+// @Versions: the version of the store to resume after.
+func (ks *KVStore) RPCWatch(args *WatchArgs, reply *WatchReply) (err error) {
+	defer ks.RecoverRPC("KVStore.RPCWatch", time.Now(), &err)
+	var version int64
+	if len(args.Versions) == 0 {
+		version = ks.events.current()
+	} else {
+		reply.Events, version, reply.Truncated = ks.WaitChanges(args.Prefix, args.Versions[0], msToDuration(args.TimeoutMs))
+	}
+	reply.Versions = []int64{version}
+	return nil
+}
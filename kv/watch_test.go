@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	ks := NewKVStore()
+	var reply WatchReply
+	ks.RPCWatch(&WatchArgs{Prefix: "stock:"}, &reply)
+	from := reply.Versions
+
+	ks.Put("stock:1", "5")
+	ks.Put("other", "x")
+	ks.Incr("stock:1", -1)
+	ks.Del("stock:1")
+	ks.RPCWatch(&WatchArgs{Prefix: "stock:", Versions: from}, &reply)
+	expected := []Event{
+		{Version: 1, Key: "stock:1", New: "5"},
+		{Version: 3, Key: "stock:1", Old: "5", New: "4", Existed: true},
+		{Version: 4, Key: "stock:1", Old: "4", Existed: true, Deleted: true},
+	}
+	if len(reply.Events) != len(expected) || reply.Truncated || reply.Versions[0] != 4 {
+		t.Fatalf("watch reply %v; expected %v", reply, expected)
+	}
+	for i, ev := range reply.Events {
+		if ev != expected[i] {
+			t.Fatalf("event %d is %v; expected %v", i, ev, expected[i])
+		}
+	}
+
+	// A watcher waits for the next change.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ks.Put("stock:2", "1")
+	}()
+	ks.RPCWatch(&WatchArgs{Prefix: "stock:", Versions: reply.Versions, TimeoutMs: 1000}, &reply)
+	if len(reply.Events) != 1 || reply.Events[0].Key != "stock:2" {
+		t.Fatalf("watch reply %v; expected the put of stock:2", reply)
+	}
+
+	for i := 0; i < WatchLogSize; i++ {
+		ks.Put("stock:"+strconv.Itoa(i), "0")
+	}
+	ks.RPCWatch(&WatchArgs{Prefix: "stock:", Versions: from}, &reply)
+	if !reply.Truncated || len(reply.Events) != WatchLogSize {
+		t.Fatalf("resuming from a version gone got %d events, truncated %v", len(reply.Events), reply.Truncated)
+	}
+}
@@ -0,0 +1,285 @@
+// Package metrics writes counters, gauges and histograms in the Prometheus
+// text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the upper bounds in seconds of the latency histograms.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics written together.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Default holds the metrics of the process, e.g. of the RPCs served.
+var Default = NewRegistry()
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats the labels, with extra ones like le appended.
+func labelPairs(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec keeps the values of a metric by its label values.
+type vec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string][]string // the label values by their key
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// sortedKeys returns the keys of the label values in order. v.mu must be
+// held.
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec counts events by labels.
+type CounterVec struct {
+	vec
+	counts map[string]uint64
+}
+
+// NewCounterVec registers a counter in Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: vec{name: name, help: help, labels: labels, values: make(map[string][]string)},
+		counts: make(map[string]uint64)}
+	r.register(name, c)
+	return c
+}
+
+// Inc counts one event with the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(n uint64, values ...string) {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = append([]string(nil), values...)
+	}
+	c.counts[key] += n
+}
+
+// Value returns the count with the label values.
+func (c *CounterVec) Value(values ...string) uint64 {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelPairs(c.labels, c.values[key]), c.counts[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations, e.g. latencies in seconds, in buckets
+// by labels.
+type HistogramVec struct {
+	vec
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+// NewHistogramVec registers a histogram in Default.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: vec{name: name, help: help, labels: labels, values: make(map[string][]string)},
+		buckets: buckets, histograms: make(map[string]*histogram)}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		h.values[key] = append([]string(nil), values...)
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.histograms[key] = hist
+	}
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range h.sortedKeys() {
+		hist, values := h.histograms[key], h.values[key]
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, values), hist.count)
+	}
+}
+
+// gaugeFunc reads its values when written, by the value of its label.
+type gaugeFunc struct {
+	name, help, label string
+	typ               string
+	read              func() map[string]float64
+}
+
+// GaugeFunc registers a gauge read by f when written.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(name, &gaugeFunc{name: name, help: help, typ: "gauge",
+		read: func() map[string]float64 { return map[string]float64{"": f()} }})
+}
+
+// GaugeVecFunc registers a gauge by label read by f when written.
+func (r *Registry) GaugeVecFunc(name, help, label string, f func() map[string]float64) {
+	r.register(name, &gaugeFunc{name: name, help: help, label: label, typ: "gauge", read: f})
+}
+
+// CounterFunc registers a counter read by f when written, e.g. of the
+// counts kept by another package.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(name, &gaugeFunc{name: name, help: help, typ: "counter",
+		read: func() map[string]float64 { return map[string]float64{"": f()} }})
+}
+
+// CounterVecFunc registers a counter by label read by f when written.
+func (r *Registry) CounterVecFunc(name, help, label string, f func() map[string]float64) {
+	r.register(name, &gaugeFunc{name: name, help: help, label: label, typ: "counter", read: f})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	values := g.read()
+	writeHeader(w, g.name, g.help, g.typ)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labels string
+		if g.label != "" {
+			labels = labelPairs([]string{g.label}, []string{key})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+// Write writes the metrics of the registries in the text format.
+func Write(w io.Writer, regs ...*Registry) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range regs {
+		r.mu.Lock()
+		metrics := append([]metric(nil), r.metrics...)
+		r.mu.Unlock()
+		for _, m := range metrics {
+			m.write(bw)
+		}
+	}
+	return bw.Flush()
+}
+
+// ContentType is the type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the metrics of the registries.
+func Handler(regs ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		Write(w, regs...)
+	})
+}
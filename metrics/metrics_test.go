@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "The requests.", "method")
+	c.Inc("GET")
+	c.Add(2, `a"b`)
+	h := r.NewHistogramVec("latency_seconds", "The latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	r.GaugeFunc("keys", "The keys.", func() float64 { return 7 })
+	r.GaugeVecFunc("pool_connections", "The connections.", "state",
+		func() map[string]float64 { return map[string]float64{"idle": 1, "active": 3} })
+
+	var buf bytes.Buffer
+	if err := Write(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total The requests.
+# TYPE requests_total counter
+requests_total{method="GET"} 1
+requests_total{method="a\"b"} 2
+# HELP latency_seconds The latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP keys The keys.
+# TYPE keys gauge
+keys 7
+# HELP pool_connections The connections.
+# TYPE pool_connections gauge
+pool_connections{state="active"} 3
+pool_connections{state="idle"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("wrote\n%s\nexpected\n%s", buf.String(), expected)
+	}
+	if c.Value("GET") != 1 {
+		t.Fatalf("GET counted %d", c.Value("GET"))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice didn't panic")
+		}
+	}()
+	r.GaugeFunc("keys", "", func() float64 { return 0 })
+}
@@ -0,0 +1,73 @@
+package shopping
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	// A node failing BreakerFailures calls in a row is failed fast for
+	// BreakerCooldown, then probed by a single call.
+	BreakerFailures = 5
+	BreakerCooldown = time.Second
+)
+
+// circuitBreaker fails the calls to a node fast while it is down. Once the
+// cooldown is over, one call is let through to probe the node: it closes
+// the circuit if it succeeds, or opens it again.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+	clock    Clock
+
+	mu        sync.Mutex
+	failed    int       // calls in a row
+	openUntil time.Time // zero while closed
+	probing   bool
+}
+
+func newCircuitBreaker(failures int, cooldown time.Duration, clock Clock) *circuitBreaker {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &circuitBreaker{failures: failures, cooldown: cooldown, clock: clock}
+}
+
+// allow tells whether a call may go to the node.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || b.clock.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a call allowed.
+func (b *circuitBreaker) done(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failed = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failed++
+	if b.failed >= b.failures || !b.openUntil.IsZero() {
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
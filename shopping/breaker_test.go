@@ -0,0 +1,68 @@
+package shopping
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	b := newCircuitBreaker(3, time.Second, clock)
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("call %d refused while closed", i)
+		}
+		b.done(false)
+	}
+	b.done(true)
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.done(false)
+	}
+	if !b.open() || b.allow() {
+		t.Fatal("circuit not open after 3 failures in a row")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("probe refused after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second call let through while probing")
+	}
+	b.done(false)
+	if b.allow() {
+		t.Fatal("circuit not open again after the probe failed")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("probe refused after the cooldown")
+	}
+	b.done(true)
+	if b.open() || !b.allow() {
+		t.Fatal("circuit not closed after the probe succeeded")
+	}
+}
+
+func TestRPCPeerBreaker(t *testing.T) {
+	// A participant down.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := newRPCPeer("tcp", addr)
+	for i := 0; i < BreakerFailures; i++ {
+		if err := p.call("ShoppingTxnKVStoreService.RPCGet", nil, new(int), time.Second); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("call %d = %v; expected the dial to fail", i, err)
+		}
+	}
+	if err := p.call("ShoppingTxnKVStoreService.RPCGet", nil, new(int), time.Second); err != ErrCircuitOpen {
+		t.Fatalf("call = %v; expected to fail fast", err)
+	}
+}
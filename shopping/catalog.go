@@ -0,0 +1,388 @@
+package shopping
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-system/http"
+	"rush-shopping/kv"
+)
+
+const (
+	// Every ShopServer polls the catalog version at CatalogPollInterval,
+	// and reloads the items changed since its last poll.
+	CatalogPollInterval = time.Second
+	// The change log of the catalog is kept for CatalogLogRetention. A
+	// shop lagging further reloads the whole catalog.
+	CatalogLogRetention = time.Hour
+)
+
+type ItemJson struct {
+	Price *int `json:"price"`
+	Stock *int `json:"stock"`
+	Delta *int `json:"delta"`
+
+	SaleStart int64 `json:"sale_start"`
+	SaleEnd   int64 `json:"sale_end"`
+	SalePrice *int  `json:"sale_price"`
+}
+
+// composeSaleValue encodes the sale window of an item, where an empty
+// price means the regular price.
+// 1500000000000|1500000600000|99
+func composeSaleValue(start, end int64, price *int) string {
+	value := strconv.FormatInt(start, 10) + "|" + strconv.FormatInt(end, 10) + "|"
+	if price != nil {
+		value += strconv.Itoa(*price)
+	}
+	return value
+}
+
+func parseSaleValue(value string) (start, end int64, price *int) {
+	info := strings.Split(value, "|")
+	if len(info) != 3 {
+		return
+	}
+	start, _ = strconv.ParseInt(info[0], 10, 64)
+	end, _ = strconv.ParseInt(info[1], 10, 64)
+	if p, err := strconv.Atoi(info[2]); err == nil {
+		price = &p
+	}
+	return
+}
+
+func onSale(start, end, now int64) bool {
+	return (start == 0 || now >= start) && (end == 0 || now < end)
+}
+
+// StockArgs sets the stock of the item, or adds Stock to it if Delta.
+type StockArgs struct {
+	ItemID int
+	Stock  int
+	Delta  bool
+}
+
+type StockReply struct {
+	Status    int
+	Stock     int
+	Restocked int // the units added to the stock
+}
+
+// stockTxn adjusts the stock of an item, which never goes negative.
+type stockTxn struct {
+	args  *StockArgs
+	reply *StockReply
+}
+
+func (t *stockTxn) keys() []string {
+	return []string{ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)}
+}
+
+func (t *stockTxn) run(v *txnView) {
+	stockKey := ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)
+	stock, _ := v.getInt(stockKey)
+	if t.args.Delta {
+		stock += t.args.Stock
+	} else {
+		stock = t.args.Stock
+	}
+	if stock < 0 {
+		t.reply.Status = OutOfStock
+		t.reply.Stock, _ = v.getInt(stockKey)
+		return
+	}
+	t.reply.Status = OK
+	t.reply.Stock = stock
+	if old, _ := v.getInt(stockKey); stock > old {
+		t.reply.Restocked = stock - old
+	}
+	v.put(stockKey, strconv.Itoa(stock))
+}
+
+// itemAvailable tells whether the item exists and isn't retired.
+func (ss *ShopServer) itemAvailable(itemID int) bool {
+	ss.ItemLock.RLock()
+	defer ss.ItemLock.RUnlock()
+	return itemID >= 1 && itemID <= ss.MaxItemID && !ss.ItemListCache[itemID].Retired
+}
+
+// itemOnSale tells whether the available item is in its sale window.
+func (ss *ShopServer) itemOnSale(itemID int) bool {
+	ss.ItemLock.RLock()
+	defer ss.ItemLock.RUnlock()
+	item := &ss.ItemListCache[itemID]
+	return onSale(item.SaleStart, item.SaleEnd, ss.nowMs())
+}
+
+// itemPrice returns the cached price of an available item, which is the
+// sale price if any.
+func (ss *ShopServer) itemPrice(itemID int) int {
+	ss.ItemLock.RLock()
+	defer ss.ItemLock.RUnlock()
+	if price := ss.ItemListCache[itemID].SalePrice; price != nil {
+		return *price
+	}
+	return ss.ItemListCache[itemID].Price
+}
+
+// rebuildItemsJSON must be called with ItemLock held.
+func (ss *ShopServer) rebuildItemsJSON() {
+	items := make([]Item, 0, len(ss.ItemListCache))
+	for _, item := range ss.ItemListCache[1:] {
+		if !item.Retired {
+			items = append(items, item)
+		}
+	}
+	ss.ItemsJSONCache, _ = json.Marshal(items)
+}
+
+// reloadItems reads the items from the KV-Store into the cache. The IDs
+// beyond items_size are ignored, and nil reloads all the items. The cache
+// is kept as it is if the KV-Store fails.
+func (ss *ShopServer) reloadItems(itemIDs []int) error {
+	reply, err := ss.ClientPool.Get(ItemsSizeKey)
+	if err != nil {
+		return err
+	}
+	itemsSize, _ := strconv.Atoi(reply.Value)
+	if itemIDs == nil {
+		for itemID := 1; itemID <= itemsSize; itemID++ {
+			itemIDs = append(itemIDs, itemID)
+		}
+	}
+	var ids []int
+	for _, itemID := range itemIDs {
+		if itemID >= 1 && itemID <= itemsSize {
+			ids = append(ids, itemID)
+		}
+	}
+	// The keys of an item are read together, LoadBatchSize keys a call.
+	const keysPerItem = 4
+	items := make([]Item, 0, len(ids))
+	for start := 0; start < len(ids); start += LoadBatchSize / keysPerItem {
+		end := start + LoadBatchSize/keysPerItem
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]string, 0, (end-start)*keysPerItem)
+		for _, itemID := range ids[start:end] {
+			itemIDStr := strconv.Itoa(itemID)
+			keys = append(keys, ItemsPriceKeyPrefix+itemIDStr, ItemsStockKeyPrefix+itemIDStr,
+				ItemsRetiredKeyPrefix+itemIDStr, ItemsSaleKeyPrefix+itemIDStr)
+		}
+		replies, err := ss.ClientPool.MGet(keys)
+		if err != nil {
+			return err
+		}
+		for i, itemID := range ids[start:end] {
+			r := replies.Replies[i*keysPerItem : (i+1)*keysPerItem]
+			price, stock, retired, sale := r[0], r[1], r[2], r[3]
+			item := Item{ID: itemID}
+			item.Price, _ = strconv.Atoi(price.Value)
+			item.Stock, _ = strconv.Atoi(stock.Value)
+			// An item whose creation failed has no price, and is never sold.
+			item.Retired = retired.Flag || !price.Flag
+			item.SaleStart, item.SaleEnd, item.SalePrice = parseSaleValue(sale.Value)
+			items = append(items, item)
+		}
+	}
+
+	ss.ItemLock.Lock()
+	defer ss.ItemLock.Unlock()
+	for len(ss.ItemListCache) <= itemsSize {
+		// Not sold until loaded.
+		ss.ItemListCache = append(ss.ItemListCache, Item{ID: len(ss.ItemListCache), Retired: true})
+	}
+	for _, item := range items {
+		ss.ItemListCache[item.ID] = item
+	}
+	if itemsSize > ss.MaxItemID {
+		ss.MaxItemID = itemsSize
+	}
+	ss.rebuildItemsJSON()
+	return nil
+}
+
+// syncCatalog reloads the items changed since the last sync.
+func (ss *ShopServer) syncCatalog() error {
+	ss.catalogMu.Lock()
+	defer ss.catalogMu.Unlock()
+	reply, err := ss.ClientPool.Get(CatalogVersionKey)
+	if err != nil {
+		return err
+	}
+	version, _ := strconv.Atoi(reply.Value)
+	if version <= ss.catalogVersion {
+		return nil
+	}
+	var itemIDs []int
+	for v := ss.catalogVersion + 1; v <= version; v++ {
+		if reply, err = ss.ClientPool.Get(CatalogLogKeyPrefix + strconv.Itoa(v)); err != nil {
+			return err
+		}
+		if !reply.Flag {
+			log.Printf("Catalog change %d is missing, reload all the items\n", v)
+			itemIDs = nil
+			break
+		}
+		itemID, _ := strconv.Atoi(reply.Value)
+		itemIDs = append(itemIDs, itemID)
+	}
+	if err = ss.reloadItems(itemIDs); err != nil {
+		return err
+	}
+	ss.catalogVersion = version
+	return nil
+}
+
+func (ss *ShopServer) pollCatalog() {
+	for _ = range time.Tick(CatalogPollInterval) {
+		if err := ss.syncCatalog(); err != nil {
+			log.Println("Sync catalog error:", err)
+		}
+	}
+}
+
+// catalogChanged publishes the change of the item to all the shops.
+func (ss *ShopServer) catalogChanged(itemID int) error {
+	reply, err := ss.ClientPool.Incr(CatalogVersionKey, 1)
+	if err != nil {
+		return err
+	}
+	if _, err = ss.ClientPool.PutTTL(CatalogLogKeyPrefix+reply.Value, strconv.Itoa(itemID), CatalogLogRetention); err != nil {
+		return err
+	}
+	return ss.syncCatalog()
+}
+
+func (ss *ShopServer) itemReply(itemID int) (int, []byte) {
+	ss.ItemLock.RLock()
+	body, _ := json.Marshal(ss.ItemListCache[itemID])
+	ss.ItemLock.RUnlock()
+	return http.StatusOK, body
+}
+
+// createItem allocates the next item ID by root.
+func (ss *ShopServer) createItem(resp *http.Response, req *http.Request) {
+	exist, _, body := ss.authorize(resp, req, true)
+	if !exist {
+		return
+	}
+	status, out := ss.doCreateItem(body)
+	writeReply(resp, status, out)
+}
+
+// doCreateItem writes the price and the stock of the new item in one
+// batch. The price comes last, so an item is never sold without its
+// stock, and a failed creation is retired.
+func (ss *ShopServer) doCreateItem(body []byte) (int, []byte) {
+	var item ItemJson
+	if err := json.Unmarshal(body, &item); err != nil {
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
+	}
+	if item.Price == nil || *item.Price < 0 || item.Stock == nil || *item.Stock < 0 {
+		return http.StatusBadRequest, INVALID_ITEM_MSG
+	}
+	reply, err := ss.ClientPool.Incr(ItemsSizeKey, 1)
+	if err != nil {
+		return unavailable(err)
+	}
+	itemIDStr := reply.Value
+	itemID, _ := strconv.Atoi(itemIDStr)
+	batch, err := ss.ClientPool.Batch([]kv.BatchOp{
+		{Op: kv.OpPut, Key: ItemsStockKeyPrefix + itemIDStr, Value: strconv.Itoa(*item.Stock)},
+		{Op: kv.OpPut, Key: ItemsPriceKeyPrefix + itemIDStr, Value: strconv.Itoa(*item.Price)}})
+	if err == nil {
+		for _, e := range batch.Errors {
+			if e != "" {
+				err = &KVError{Method: "RPCBatch", Err: errors.New(e)}
+				break
+			}
+		}
+	}
+	if err != nil {
+		ss.ClientPool.Put(ItemsRetiredKeyPrefix+itemIDStr, "1")
+		return unavailable(err)
+	}
+	if err = ss.catalogChanged(itemID); err != nil {
+		return unavailable(err)
+	}
+	return ss.itemReply(itemID)
+}
+
+// manageItem serves /admin/items/:id/price, /admin/items/:id/stock,
+// /admin/items/:id/sale and /admin/items/:id/retire by root. A sale
+// without a window or price clears it.
+func (ss *ShopServer) manageItem(resp *http.Response, req *http.Request) {
+	exist, _, body := ss.authorize(resp, req, true)
+	if !exist {
+		return
+	}
+	status, out := ss.doManageItem(req.URL.Path, body)
+	writeReply(resp, status, out)
+}
+
+func (ss *ShopServer) doManageItem(path string, body []byte) (int, []byte) {
+	paths := strings.Split(path, "/")
+	if len(paths) != 5 {
+		return http.StatusNotFound, ITEM_NOT_FOUND_MSG
+	}
+	itemID, err := strconv.Atoi(paths[3])
+	if err != nil || !ss.itemAvailable(itemID) {
+		return http.StatusNotFound, ITEM_NOT_FOUND_MSG
+	}
+	var item ItemJson
+	if err := json.Unmarshal(body, &item); err != nil {
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
+	}
+	itemIDStr := paths[3]
+	switch paths[4] {
+	case "price":
+		if item.Price == nil || *item.Price < 0 {
+			return http.StatusBadRequest, INVALID_ITEM_MSG
+		}
+		_, err = ss.ClientPool.Put(ItemsPriceKeyPrefix+itemIDStr, strconv.Itoa(*item.Price))
+	case "stock":
+		args := &StockArgs{ItemID: itemID}
+		if item.Stock != nil {
+			args.Stock = *item.Stock
+		} else if item.Delta != nil {
+			args.Stock, args.Delta = *item.Delta, true
+		} else {
+			return http.StatusBadRequest, INVALID_ITEM_MSG
+		}
+		reply, err := ss.ClientPool.AdjustStock(args)
+		if err != nil {
+			return unavailable(err)
+		}
+		if reply.Status != OK {
+			return http.StatusForbidden, ITEM_OUT_OF_STOCK_MSG
+		}
+		ss.notifyWaitlist(itemID, reply.Restocked)
+	case "sale":
+		if item.SaleStart < 0 || item.SaleEnd < 0 || item.SaleEnd != 0 && item.SaleEnd <= item.SaleStart ||
+			item.SalePrice != nil && *item.SalePrice < 0 {
+			return http.StatusBadRequest, INVALID_ITEM_MSG
+		}
+		if item.SaleStart == 0 && item.SaleEnd == 0 && item.SalePrice == nil {
+			_, err = ss.ClientPool.Del(ItemsSaleKeyPrefix + itemIDStr)
+		} else {
+			_, err = ss.ClientPool.Put(ItemsSaleKeyPrefix+itemIDStr, composeSaleValue(item.SaleStart, item.SaleEnd, item.SalePrice))
+		}
+	case "retire":
+		_, err = ss.ClientPool.Put(ItemsRetiredKeyPrefix+itemIDStr, "1")
+	default:
+		return http.StatusNotFound, ITEM_NOT_FOUND_MSG
+	}
+	if err == nil {
+		err = ss.catalogChanged(itemID)
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+	return ss.itemReply(itemID)
+}
@@ -0,0 +1,133 @@
+package shopping
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestSaleWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	salePrice := 5
+	ss := &ShopServer{Options: ShopOptions{Clock: clock}, MaxItemID: 1,
+		ItemListCache: []Item{{}, {ID: 1, Price: 10, SaleStart: 200000, SaleEnd: 300000, SalePrice: &salePrice}}}
+	if ss.itemOnSale(1) {
+		t.Fatal("item is on sale before the window")
+	}
+	clock.now = time.Unix(200, 0)
+	if !ss.itemOnSale(1) || ss.itemPrice(1) != 5 {
+		t.Fatalf("item isn't on sale for 5 in the window")
+	}
+
+	sks := NewShoppingKVStore()
+	sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	sks.Put(ItemsStockKeyPrefix+"1", "10")
+	sks.Put(ItemsSaleKeyPrefix+"1", composeSaleValue(200000, 300000, &salePrice))
+	var reply SubmitOrderReply
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "1", CartValue: "1.1:1", Now: 300000}, &reply)
+	if reply.Status != ItemNotOnSale {
+		t.Fatalf("order after the window returned %v", reply)
+	}
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "1", CartValue: "1.1:1", Now: 200000}, &reply)
+	if reply != (SubmitOrderReply{Status: OK, Total: 5}) {
+		t.Fatalf("SubmitOrder = %v; expected the sale price 5", reply)
+	}
+}
+
+func TestCatalogAdmin(t *testing.T) {
+	f := newFlakyKV()
+	f.sks.Put(ItemsSizeKey, "0")
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions(), ItemListCache: []Item{{}}}
+	other := &ShopServer{ClientPool: f, Options: DefaultShopOptions(), ItemListCache: []Item{{}}}
+
+	if status, out := ss.doCreateItem([]byte(`{"price":10,"stock":5}`)); status != http.StatusOK ||
+		string(out) != `{"id":1,"price":10,"stock":5}` {
+		t.Fatalf("doCreateItem = %v, %s", status, out)
+	}
+	if status, _ := ss.doCreateItem([]byte(`{"price":10}`)); status != http.StatusBadRequest {
+		t.Fatalf("doCreateItem without stock = %v", status)
+	}
+	// The item whose price and stock failed is never sold.
+	f.setFailing("RPCBatch", true)
+	if status, _ := ss.doCreateItem([]byte(`{"price":1,"stock":1}`)); status != http.StatusServiceUnavailable {
+		t.Fatalf("doCreateItem with the KV-Store failing = %v", status)
+	}
+	f.setFailing("RPCBatch", false)
+	if retired, _ := f.sks.Get(ItemsRetiredKeyPrefix + "2"); retired != "1" {
+		t.Fatal("the item failed isn't retired")
+	}
+
+	if status, _ := ss.doManageItem("/admin/items/1/price", []byte(`{"price":12}`)); status != http.StatusOK {
+		t.Fatalf("set the price = %v", status)
+	}
+	if status, _ := ss.doManageItem("/admin/items/1/stock", []byte(`{"delta":-6}`)); status != http.StatusForbidden {
+		t.Fatalf("take more than the stock = %v", status)
+	}
+	if status, _ := ss.doManageItem("/admin/items/2/price", []byte(`{"price":12}`)); status != http.StatusNotFound {
+		t.Fatalf("set the price of the item failed = %v", status)
+	}
+	if status, out := ss.doManageItem("/admin/items/1/stock", []byte(`{"delta":-1}`)); status != http.StatusOK ||
+		string(out) != `{"id":1,"price":12,"stock":4}` {
+		t.Fatalf("take a unit = %v, %s", status, out)
+	}
+
+	// The other shop reloads the changes.
+	if err := other.syncCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	if !other.itemAvailable(1) || other.itemAvailable(2) || other.itemPrice(1) != 12 {
+		t.Fatalf("synced catalog %+v", other.ItemListCache)
+	}
+	if status, _ := ss.doManageItem("/admin/items/1/retire", nil); status != http.StatusBadRequest {
+		t.Fatalf("retire without a body = %v", status)
+	}
+	ss.doManageItem("/admin/items/1/retire", []byte(`{}`))
+	// The change log expired, so the whole catalog is reloaded.
+	f.sks.Del(CatalogLogKeyPrefix + "4")
+	if err := other.syncCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	if other.itemAvailable(1) {
+		t.Fatal("the retired item is available")
+	}
+}
+
+func TestLoadKeepsCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	userCsv, itemCsv := filepath.Join(dir, "users.csv"), filepath.Join(dir, "items.csv")
+	ioutil.WriteFile(userCsv, []byte("0,root,root,0\n1,u,p,100\n"), 0644)
+	ioutil.WriteFile(itemCsv, []byte("1,10,5\n2,20,6\n"), 0644)
+	f := newFlakyKV()
+	(&ShopServer{ClientPool: f, Options: DefaultShopOptions()}).loadUsersAndItems(userCsv, itemCsv)
+
+	// The catalog changed by the admin and the balances survive a restart.
+	f.sks.Put(BalanceKeyPrefix+"1", "40")
+	f.sks.Put(ItemsRetiredKeyPrefix+"1", "1")
+	f.sks.Put(ItemsStockKeyPrefix+"2", "1")
+	f.sks.Put(ItemsSizeKey, "3")
+	f.sks.Put(ItemsPriceKeyPrefix+"3", "30")
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions()}
+	ss.loadUsersAndItems(userCsv, itemCsv)
+	if ss.MaxItemID != 3 || !ss.ItemListCache[1].Retired || ss.ItemListCache[2].Stock != 1 ||
+		ss.ItemListCache[3].Price != 30 {
+		t.Fatalf("items %+v after a restart", ss.ItemListCache)
+	}
+	balance, _ := f.sks.Get(BalanceKeyPrefix + "1")
+	opening, _ := f.sks.Get(OpeningBalanceKeyPrefix + "1")
+	if balance != "40" || opening != "100" {
+		t.Fatalf("balance %v, opening %v after a restart; expected 40, 100", balance, opening)
+	}
+}
@@ -1,9 +1,7 @@
 package shopping
 
 import(
-	"bytes"
 	"strconv"
-	"strings"
 )
 
 type LoginJson struct {
@@ -12,9 +10,15 @@ type LoginJson struct {
 }
 
 type Item struct {
-	ID    int `json:"id"`
-	Price int `json:"price"`
-	Stock int `json:"stock"`
+	ID      int  `json:"id"`
+	Price   int  `json:"price"`
+	Stock   int  `json:"stock"`
+	Retired bool `json:"-"`
+	// The sale window in unix milliseconds, where 0 leaves it open, and
+	// the price charged in it if any.
+	SaleStart int64 `json:"sale_start,omitempty"`
+	SaleEnd   int64 `json:"sale_end,omitempty"`
+	SalePrice *int  `json:"sale_price,omitempty"`
 }
 
 type Order struct {
@@ -23,6 +27,10 @@ type Order struct {
 	Items   []ItemCount `json:"items"`
 	Total   int         `json:"total"`
 	HasPaid bool        `json:"paid"`
+	// The total before the discount of the coupon.
+	Subtotal int    `json:"subtotal,omitempty"`
+	Discount int    `json:"discount,omitempty"`
+	Coupon   string `json:"coupon,omitempty"`
 }
 
 type ItemCount struct {
@@ -36,15 +44,46 @@ type UserIDAndPass struct {
 }
 
 type SubmitOrderArgs struct {
-	CartIDStr string
-	UserToken string
-	CartValue string
+	CartIDStr   string
+	UserToken   string
+	CartValue   string
+	PricePolicy PricePolicy
+	Coupon      string // optional
+	Now         int64  // unix milliseconds, to check the coupon
+}
+
+type SubmitOrderReply struct {
+	Status   int
+	Total    int
+	Discount int
+	// PriceDiff is the total charged minus the total of the prices
+	// captured in the cart.
+	PriceDiff int
+}
+
+type CancelOrderArgs struct {
+	UserToken  string
+	OrderValue string // as read before the cancellation
 }
 
 type PayOrderArgs struct {
 	OrderIDStr string
 	UserToken  string
-	Delta      int
+}
+
+// CreditArgs credits Amount from outside the shop to a balance, once per
+// Kind and RequestRef.
+type CreditArgs struct {
+	UserToken   string
+	Amount      int
+	Kind        string
+	RequestRef  string
+	ExternalRef string
+}
+
+type CreditReply struct {
+	Status  int
+	Balance int
 }
 
 type AccessTokenJson struct{
@@ -52,7 +91,8 @@ type AccessTokenJson struct{
 }
 
 type CartIDJson struct {
-	IDStr string `json:"cart_id"`
+	IDStr  string `json:"cart_id"`
+	Coupon string `json:"coupon"`
 }
 
 type OrderIDJson struct {
@@ -72,84 +112,6 @@ func token2UserID(token string) int {
 }
 
 func getCartKey(cartIDStr, token string) (cartKey string) {
-	cartKey = "cart:" + cartIDStr + ":" + token
-	return
-}
-
-// cartValue shouldn't be "". Otherwise return 0, blank map.
-// 2.1:3;2:4
-// 0
-func parseCartValue(cartValue string) (num int, detail map[int]int) {
-	detail = make(map[int]int)
-	if cartValue == "" {
-		return 0, detail
-	}
-	vs := strings.Split(cartValue, ".")
-	num, _ = strconv.Atoi(vs[0])
-	cnt := 0
-	if len(vs) == 2 {
-		itemStrs := strings.Split(vs[1], ";")
-		for _, itemStr := range itemStrs {
-			info := strings.Split(itemStr, ":")
-			if len(info) != 2 {
-				panic("cartValue format error")
-			}
-			itemID, _ := strconv.Atoi(info[0])
-			itemCnt, _ := strconv.Atoi(info[1])
-			cnt += itemCnt
-			detail[itemID] = itemCnt
-		}
-	} else if len(vs) > 2 {
-		panic("cartValue format error")
-	}
-
-	if num != cnt {
-		panic("total value error")
-	}
-	return
-}
-
-func composeCartValue(num int, cartDetail map[int]int) (cartDetailStr string) {
-	cnt := 0
-	var buffer bytes.Buffer
-	buffer.WriteString(strconv.Itoa(num) + ".")
-	for itemID, itemCnt := range cartDetail {
-		cnt += itemCnt
-		buffer.WriteString(strconv.Itoa(itemID))
-		buffer.WriteString(":")
-		buffer.WriteString(strconv.Itoa(itemCnt))
-		buffer.WriteString(";")
-	}
-	buffer.Truncate(buffer.Len() - 1)
-	if num != cnt {
-		panic("total value error")
-	}
-	return buffer.String()
-}
-
-func composeOrderValue(hasPaid bool, price, num int, detail map[int]int) string {
-	var info [3]string
-	if hasPaid {
-		info[0] = OrderPaidFlag
-	} else {
-		info[0] = OrderUnpaidFlag
-	}
-	info[1] = strconv.Itoa(price)
-	info[2] = composeCartValue(num, detail)
-	return strings.Join(info[:], "|")
-}
-func parseOrderValue(value string) (hasPaid bool, price, num int, detail map[int]int) {
-	info := strings.Split(value, "|")
-	if info[0] == OrderPaidFlag {
-		hasPaid = true
-	} else {
-		hasPaid = false
-	}
-
-	if len(info) != 3 {
-		panic(value)
-	}
-	price, _ = strconv.Atoi(info[1])
-	num, detail = parseCartValue(info[2])
+	cartKey = CartKeyPrefix + cartIDStr + ":" + token
 	return
 }
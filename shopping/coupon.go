@@ -0,0 +1,133 @@
+package shopping
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"distributed-system/http"
+)
+
+// Coupon is a promotion defined by root. It takes either PercentOff
+// percent or AmountOff off the order total, and the limits of 0 mean
+// unlimited.
+type Coupon struct {
+	Code         string `json:"code"`
+	PercentOff   int    `json:"percent_off,omitempty"`
+	AmountOff    int    `json:"amount_off,omitempty"`
+	MinSpend     int    `json:"min_spend,omitempty"`
+	PerUserLimit int    `json:"per_user_limit,omitempty"`
+	GlobalLimit  int    `json:"global_limit,omitempty"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"` // unix milliseconds
+}
+
+func validCouponCode(code string) bool {
+	if code == "" || len(code) > 64 {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Coupon) valid() bool {
+	if !validCouponCode(c.Code) || c.MinSpend < 0 || c.PerUserLimit < 0 ||
+		c.GlobalLimit < 0 || c.ExpiresAt < 0 {
+		return false
+	}
+	if c.PercentOff != 0 {
+		return c.AmountOff == 0 && c.PercentOff > 0 && c.PercentOff <= 100
+	}
+	return c.AmountOff > 0
+}
+
+// discount of the subtotal, which never exceeds the subtotal.
+func (c *Coupon) discount(subtotal int) int {
+	if c.PercentOff != 0 {
+		return subtotal * c.PercentOff / 100
+	}
+	if c.AmountOff > subtotal {
+		return subtotal
+	}
+	return c.AmountOff
+}
+
+func couponUsedKey(code string) string {
+	return CouponUsedKeyPrefix + code
+}
+
+func couponUserUsedKey(code, token string) string {
+	return CouponUsedKeyPrefix + code + ":" + token
+}
+
+// redeemCoupon applies the coupon to the subtotal of the order in the txn
+// and counts the redemption. The order is left to be written by the
+// caller, which must abort on a non-OK status.
+func redeemCoupon(v *txnView, code, token string, subtotal int, now int64) (discount, status int) {
+	value, existed := v.get(CouponKeyPrefix + code)
+	if !existed {
+		return 0, CouponNotFound
+	}
+	var c Coupon
+	if err := json.Unmarshal([]byte(value), &c); err != nil {
+		return 0, CouponNotFound
+	}
+	if c.ExpiresAt != 0 && now >= c.ExpiresAt {
+		return 0, CouponExpired
+	}
+	if subtotal < c.MinSpend {
+		return 0, CouponMinSpend
+	}
+	used, _ := v.getInt(couponUsedKey(code))
+	userUsed, _ := v.getInt(couponUserUsedKey(code, token))
+	if c.GlobalLimit != 0 && used >= c.GlobalLimit ||
+		c.PerUserLimit != 0 && userUsed >= c.PerUserLimit {
+		return 0, CouponExhausted
+	}
+	v.put(couponUsedKey(code), strconv.Itoa(used+1))
+	v.put(couponUserUsedKey(code, token), strconv.Itoa(userUsed+1))
+	return c.discount(subtotal), OK
+}
+
+// couponStatusMsg maps the status of a coupon to the HTTP reply, or 0 if
+// the status isn't about coupons.
+func couponStatusMsg(status int) (int, []byte) {
+	switch status {
+	case CouponNotFound:
+		return http.StatusNotFound, COUPON_NOT_FOUND_MSG
+	case CouponExpired:
+		return http.StatusForbidden, COUPON_EXPIRED_MSG
+	case CouponMinSpend:
+		return http.StatusForbidden, COUPON_MIN_SPEND_MSG
+	case CouponExhausted:
+		return http.StatusForbidden, COUPON_EXHAUSTED_MSG
+	}
+	return 0, nil
+}
+
+// saveCoupon creates or replaces a coupon by root. The redemptions
+// counted so far are kept.
+func (ss *ShopServer) saveCoupon(resp *http.Response, req *http.Request) {
+	exist, _, body := ss.authorize(resp, req, true)
+	if !exist {
+		return
+	}
+	var c Coupon
+	if err := json.Unmarshal(body, &c); err != nil {
+		writeReply(resp, http.StatusBadRequest, MALFORMED_JSON_MSG)
+		return
+	}
+	if !c.valid() {
+		writeReply(resp, http.StatusBadRequest, INVALID_COUPON_MSG)
+		return
+	}
+	value, _ := json.Marshal(&c)
+	if _, err := ss.ClientPool.Put(CouponKeyPrefix+c.Code, string(value)); err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(value)
+}
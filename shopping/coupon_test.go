@@ -0,0 +1,47 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestCouponRedemption(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put(ItemsPriceKeyPrefix+"1", "40")
+	sks.Put(ItemsStockKeyPrefix+"1", "10")
+	sks.Put(CouponKeyPrefix+"HALF", `{"code":"HALF","percent_off":50,"min_spend":50,"global_limit":1,"expires_at":1000}`)
+
+	// Only the v1 orders record the coupon.
+	cart := newCart(ValueSchemaV1)
+	cart.Num, cart.Detail[1] = 2, 2
+	twoItems := cart.encode()
+	var reply SubmitOrderReply
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "1", CartValue: "1.1:1", Coupon: "HALF", Now: 1}, &reply)
+	if reply.Status != CouponMinSpend {
+		t.Fatalf("order below the minimum spend returned %v", reply)
+	}
+	if _, existed := sks.Get(OrderKeyPrefix + "1"); existed {
+		t.Fatal("failed order is written")
+	}
+
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "1", CartValue: twoItems, Coupon: "HALF", Now: 1}, &reply)
+	if reply != (SubmitOrderReply{Status: OK, Total: 40, Discount: 40}) {
+		t.Fatalf("SubmitOrder = %v; expected total 40 with discount 40", reply)
+	}
+	value, _ := sks.Get(OrderKeyPrefix + "1")
+	if order, err := decodeOrder(value); err != nil || order.Coupon != "HALF" || order.Discount != 40 {
+		t.Fatalf("order %q doesn't record the coupon", value)
+	}
+
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "2", CartValue: twoItems, Coupon: "HALF", Now: 1}, &reply)
+	if reply.Status != CouponExhausted {
+		t.Fatalf("redeeming beyond the global limit returned %v", reply)
+	}
+	sks.Put(CouponKeyPrefix+"HALF", `{"code":"HALF","percent_off":50,"expires_at":1000}`)
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "2", CartValue: twoItems, Coupon: "HALF", Now: 1000}, &reply)
+	if reply.Status != CouponExpired {
+		t.Fatalf("redeeming an expired coupon returned %v", reply)
+	}
+	if stock, _ := sks.Get(ItemsStockKeyPrefix + "1"); stock != "8" {
+		t.Fatalf("stock %v; expected 8", stock)
+	}
+}
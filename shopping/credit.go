@@ -0,0 +1,193 @@
+package shopping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-system/http"
+)
+
+// PaymentProvider charges the users for topping up their balances, e.g.
+// through a card gateway. Charge must be idempotent on requestID: charging
+// a request again returns the first charge instead of charging twice.
+type PaymentProvider interface {
+	Charge(userID, amount int, requestID string) (chargeID string, err error)
+}
+
+var ErrPaymentDeclined = errors.New("payment declined")
+
+type fakeCharge struct {
+	id     string
+	userID int
+	amount int
+}
+
+// FakePaymentProvider accepts every charge unless Decline is set. It is
+// meant for tests and local runs.
+type FakePaymentProvider struct {
+	mu      sync.Mutex
+	Decline bool
+	charges map[string]fakeCharge
+}
+
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{charges: make(map[string]fakeCharge)}
+}
+
+func (p *FakePaymentProvider) Charge(userID, amount int, requestID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.charges[requestID]; ok {
+		if c.userID != userID || c.amount != amount {
+			return "", ErrPaymentDeclined
+		}
+		return c.id, nil
+	}
+	if p.Decline {
+		return "", ErrPaymentDeclined
+	}
+	c := fakeCharge{id: "fake-" + strconv.Itoa(len(p.charges)+1), userID: userID, amount: amount}
+	p.charges[requestID] = c
+	return c.id, nil
+}
+
+// Charges returns the number of distinct charges made.
+func (p *FakePaymentProvider) Charges() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.charges)
+}
+
+// creditTxn moves money from outside the shop into a balance. The ledger
+// entry of the request doubles as its idempotency record.
+type creditTxn struct {
+	args  *CreditArgs
+	reply *CreditReply
+}
+
+func (t *creditTxn) entryKey() string {
+	return LedgerKeyPrefix + ledgerEntryID(t.args.Kind, t.args.RequestRef)
+}
+
+func (t *creditTxn) keys() []string {
+	return append([]string{BalanceKeyPrefix + t.args.UserToken},
+		ledgerKeys(ledgerEntryID(t.args.Kind, t.args.RequestRef), t.args.UserToken)...)
+}
+
+func (t *creditTxn) run(v *txnView) {
+	balanceKey := BalanceKeyPrefix + t.args.UserToken
+	t.reply.Status = OK
+	if value, existed := v.get(t.entryKey()); existed {
+		if entry, err := parseLedgerEntry(value); err != nil ||
+			entry.Credit != t.args.UserToken || entry.Amount != t.args.Amount {
+			t.reply.Status = RequestConflict
+		}
+		t.reply.Balance, _ = v.getInt(balanceKey)
+		return
+	}
+	balance, _ := v.getInt(balanceKey)
+	t.reply.Balance = balance + t.args.Amount
+	v.put(balanceKey, strconv.Itoa(t.reply.Balance))
+	putLedgerEntry(v, &LedgerEntry{ID: ledgerEntryID(t.args.Kind, t.args.RequestRef),
+		Debit: ExternalAccount, Credit: t.args.UserToken, Amount: t.args.Amount,
+		ExternalRef: t.args.ExternalRef, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+}
+
+type CreditJson struct {
+	UserID    int    `json:"user_id"`
+	Amount    int    `json:"amount"`
+	RequestID string `json:"request_id"`
+}
+
+func creditReply(token, requestID string, reply CreditReply) (int, []byte) {
+	if reply.Status == RequestConflict {
+		return http.StatusConflict, REQUEST_CONFLICT_MSG
+	}
+	body, _ := json.Marshal(struct {
+		UserID    int    `json:"user_id"`
+		Balance   int    `json:"balance"`
+		RequestID string `json:"request_id"`
+	}{token2UserID(token), reply.Balance, requestID})
+	return http.StatusOK, body
+}
+
+// adminCredit credits any user by root, e.g. for a refund or a bonus.
+func (ss *ShopServer) adminCredit(resp *http.Response, req *http.Request) {
+	exist, _, body := ss.authorize(resp, req, true)
+	if !exist {
+		return
+	}
+	var credit CreditJson
+	if err := json.Unmarshal(body, &credit); err != nil {
+		writeReply(resp, http.StatusBadRequest, MALFORMED_JSON_MSG)
+		return
+	}
+	if credit.Amount <= 0 || credit.RequestID == "" {
+		writeReply(resp, http.StatusBadRequest, INVALID_CREDIT_MSG)
+		return
+	}
+	if credit.UserID < RootUserID || credit.UserID > ss.MaxUserID {
+		writeReply(resp, http.StatusNotFound, USER_NOT_FOUND_MSG)
+		return
+	}
+	token := userID2Token(credit.UserID)
+	reply, err := ss.ClientPool.Credit(token, credit.Amount, LedgerCredit, credit.RequestID, "")
+	if err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
+	status, out := creditReply(token, credit.RequestID, reply)
+	writeReply(resp, status, out)
+}
+
+// topUp charges the user through the PaymentProvider and credits the
+// balance. Retrying a request ID charges and credits only once.
+func (ss *ShopServer) topUp(resp *http.Response, req *http.Request) {
+	exist, token, body := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	status, out := ss.doTopUp(token, body)
+	writeReply(resp, status, out)
+}
+
+func (ss *ShopServer) doTopUp(token string, body []byte) (int, []byte) {
+	if ss.PaymentProvider == nil {
+		return http.StatusServiceUnavailable, TOPUP_UNAVAILABLE_MSG
+	}
+	var credit CreditJson
+	if err := json.Unmarshal(body, &credit); err != nil {
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
+	}
+	if credit.Amount <= 0 || credit.RequestID == "" {
+		return http.StatusBadRequest, INVALID_CREDIT_MSG
+	}
+	// The request IDs of the users are independent.
+	requestRef := token + ":" + credit.RequestID
+	chargeID, err := ss.PaymentProvider.Charge(token2UserID(token), credit.Amount, requestRef)
+	if err != nil {
+		return http.StatusPaymentRequired, PAYMENT_FAILED_MSG
+	}
+	reply, err := ss.ClientPool.Credit(token, credit.Amount, LedgerTopUp, requestRef, chargeID)
+	if err != nil {
+		return unavailable(err)
+	}
+	return creditReply(token, credit.RequestID, reply)
+}
+
+// NewPaymentProvider returns the provider named in the configuration:
+// "fake" accepts every charge, for local runs, and "" is none, which
+// refuses the top-ups.
+func NewPaymentProvider(name string) (PaymentProvider, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "fake":
+		return NewFakePaymentProvider(), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", name)
+}
@@ -0,0 +1,77 @@
+package shopping
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreditIdempotent(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put(BalanceKeyPrefix+"1", "100")
+
+	args := &CreditArgs{UserToken: "1", Amount: 50, Kind: LedgerCredit, RequestRef: "r1"}
+	for i := 0; i < 2; i++ {
+		var reply CreditReply
+		sks.Credit(args, &reply)
+		if reply != (CreditReply{Status: OK, Balance: 150}) {
+			t.Fatalf("credit #%d reply %v; expected OK with balance 150", i, reply)
+		}
+	}
+
+	var reply CreditReply
+	sks.Credit(&CreditArgs{UserToken: "1", Amount: 70, Kind: LedgerCredit, RequestRef: "r1"}, &reply)
+	if reply.Status != RequestConflict {
+		t.Fatalf("reusing the request ID for another amount returned %v", reply)
+	}
+	if balance, _ := sks.Get(BalanceKeyPrefix + "1"); balance != "150" {
+		t.Fatalf("balance %v; expected 150", balance)
+	}
+	value, _ := sks.Get(LedgerKeyPrefix + ledgerEntryID(LedgerCredit, "r1"))
+	if entry, err := parseLedgerEntry(value); err != nil || entry.Debit != ExternalAccount || entry.Amount != 50 {
+		t.Fatalf("wrong ledger entry %q", value)
+	}
+}
+
+func TestFakePaymentProvider(t *testing.T) {
+	p := NewFakePaymentProvider()
+	id1, err := p.Charge(1, 10, "1:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2, _ := p.Charge(1, 10, "1:a"); id2 != id1 || p.Charges() != 1 {
+		t.Fatalf("retried charge is not idempotent: %v %v, %d charges", id1, id2, p.Charges())
+	}
+	p.Decline = true
+	if _, err = p.Charge(1, 10, "1:b"); err != ErrPaymentDeclined {
+		t.Fatalf("declined charge returned %v", err)
+	}
+}
+
+func TestTopUp(t *testing.T) {
+	f := newFlakyKV()
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions(), MaxUserID: 2}
+	f.sks.Put(BalanceKeyPrefix+"1", "100")
+	body := []byte(`{"amount":30,"request_id":"a"}`)
+
+	if status, _ := ss.doTopUp("1", body); status != http.StatusServiceUnavailable {
+		t.Fatalf("top-up without a provider = %v", status)
+	}
+	p := NewFakePaymentProvider()
+	ss.PaymentProvider = p
+	for i := 0; i < 2; i++ {
+		if status, out := ss.doTopUp("1", body); status != http.StatusOK ||
+			string(out) != `{"user_id":1,"balance":130,"request_id":"a"}` {
+			t.Fatalf("top-up #%d = %v, %s", i, status, out)
+		}
+	}
+	if balance, _ := f.sks.Get(BalanceKeyPrefix + "1"); balance != "130" || p.Charges() != 1 {
+		t.Fatalf("balance %v after %d charges; expected 130 after 1", balance, p.Charges())
+	}
+	p.Decline = true
+	if status, _ := ss.doTopUp("1", []byte(`{"amount":30,"request_id":"b"}`)); status != http.StatusPaymentRequired {
+		t.Fatalf("declined top-up = %v", status)
+	}
+	if balance, _ := f.sks.Get(BalanceKeyPrefix + "1"); balance != "130" {
+		t.Fatalf("declined top-up credited the balance to %v", balance)
+	}
+}
@@ -0,0 +1,286 @@
+package shopping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValueSchema is the encoding of the cart and order values. A versioned
+// value starts with its schema byte, followed by JSON. The legacy values
+// are the plain strings written before the schemas, which start with a
+// digit or an order flag, so they never clash with a schema byte.
+type ValueSchema byte
+
+const (
+	ValueSchemaLegacy ValueSchema = 0
+	ValueSchemaV1     ValueSchema = 1
+)
+
+// ParseValueSchema parses "legacy" or "v1". "" is ValueSchemaLegacy, which
+// the shops of every version read.
+func ParseValueSchema(s string) (ValueSchema, error) {
+	switch s {
+	case "v1":
+		return ValueSchemaV1, nil
+	case "", "legacy":
+		return ValueSchemaLegacy, nil
+	}
+	return 0, fmt.Errorf("unknown value schema %q", s)
+}
+
+var errMalformedValue = errors.New("malformed value")
+
+// cartRecord is a decoded cart value.
+type cartRecord struct {
+	// Schema is the one the cart was read in, and is written back in, so
+	// that the shops not yet upgraded keep reading it.
+	Schema ValueSchema
+	Num    int         // the total count of the items
+	Detail map[int]int // the count by item ID
+	Prices map[int]int // the unit prices captured when the items were added
+}
+
+func newCart(schema ValueSchema) *cartRecord {
+	return &cartRecord{Schema: schema, Detail: make(map[int]int), Prices: make(map[int]int)}
+}
+
+// orderRecord is a decoded order value. The lines are the ones of the cart,
+// with the unit prices charged.
+type orderRecord struct {
+	cartRecord
+	Paid     bool
+	Total    int // charged, after the discount
+	Coupon   string
+	Discount int
+}
+
+type lineV1 struct {
+	ItemID int  `json:"id"`
+	Count  int  `json:"count"`
+	Price  *int `json:"price,omitempty"`
+}
+
+type cartV1 struct {
+	Lines []lineV1 `json:"lines"`
+}
+
+type orderV1 struct {
+	Paid     bool     `json:"paid"`
+	Total    int      `json:"total"`
+	Lines    []lineV1 `json:"lines"`
+	Coupon   string   `json:"coupon,omitempty"`
+	Discount int      `json:"discount,omitempty"`
+}
+
+// lines lists the items of the cart ordered by ID, so that the same cart
+// always encodes to the same value.
+func (c *cartRecord) lines() []lineV1 {
+	lines := make([]lineV1, 0, len(c.Detail))
+	for itemID, itemCnt := range c.Detail {
+		line := lineV1{ItemID: itemID, Count: itemCnt}
+		if price, ok := c.Prices[itemID]; ok {
+			line.Price = &price
+		}
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].ItemID < lines[j].ItemID })
+	return lines
+}
+
+func (c *cartRecord) setLines(lines []lineV1) error {
+	for _, line := range lines {
+		if _, dup := c.Detail[line.ItemID]; dup {
+			return errMalformedValue
+		}
+		c.Detail[line.ItemID] = line.Count
+		c.Num += line.Count
+		if line.Price != nil {
+			c.Prices[line.ItemID] = *line.Price
+		}
+	}
+	return nil
+}
+
+func encodeV1(schema ValueSchema, v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(schema) + string(data)
+}
+
+// schemaOf tells the schema of a value. The schema bytes are control
+// characters, which no legacy value starts with.
+func schemaOf(value string) ValueSchema {
+	if value == "" || value[0] >= ' ' {
+		return ValueSchemaLegacy
+	}
+	return ValueSchema(value[0])
+}
+
+// encode writes the cart in its schema.
+func (c *cartRecord) encode() string {
+	if c.Schema == ValueSchemaLegacy {
+		return c.encodeLegacy()
+	}
+	return encodeV1(c.Schema, cartV1{Lines: c.lines()})
+}
+
+// decodeCart reads a cart in any schema. A new cart is "0" in the legacy
+// schema.
+func decodeCart(value string) (*cartRecord, error) {
+	switch schema := schemaOf(value); schema {
+	case ValueSchemaLegacy:
+		return decodeLegacyCart(value)
+	case ValueSchemaV1:
+	default:
+		return nil, fmt.Errorf("cart: unknown schema %d", schema)
+	}
+	data := value[1:]
+	var v cartV1
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return nil, fmt.Errorf("cart: %v", err)
+	}
+	c := newCart(ValueSchemaV1)
+	if err := c.setLines(v.Lines); err != nil {
+		return nil, fmt.Errorf("cart: %v", err)
+	}
+	return c, nil
+}
+
+// encode writes the order in the schema of its cart.
+func (o *orderRecord) encode() string {
+	if o.Schema == ValueSchemaLegacy {
+		return o.encodeLegacy()
+	}
+	return encodeV1(o.Schema, orderV1{Paid: o.Paid, Total: o.Total, Lines: o.lines(),
+		Coupon: o.Coupon, Discount: o.Discount})
+}
+
+// decodeOrder reads an order in any schema.
+func decodeOrder(value string) (*orderRecord, error) {
+	switch schema := schemaOf(value); schema {
+	case ValueSchemaLegacy:
+		return decodeLegacyOrder(value)
+	case ValueSchemaV1:
+	default:
+		return nil, fmt.Errorf("order: unknown schema %d", schema)
+	}
+	data := value[1:]
+	var v orderV1
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return nil, fmt.Errorf("order: %v", err)
+	}
+	o := &orderRecord{cartRecord: *newCart(ValueSchemaV1), Paid: v.Paid, Total: v.Total,
+		Coupon: v.Coupon, Discount: v.Discount}
+	if err := o.setLines(v.Lines); err != nil {
+		return nil, fmt.Errorf("order: %v", err)
+	}
+	return o, nil
+}
+
+// encodeLegacy writes the total count and the items, byte for byte as the
+// shops before ValueSchema do, so the prices captured are dropped.
+// 3.1:2;2:1
+// 0
+func (c *cartRecord) encodeLegacy() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(strconv.Itoa(c.Num))
+	for i, line := range c.lines() {
+		if i == 0 {
+			buffer.WriteString(".")
+		} else {
+			buffer.WriteString(";")
+		}
+		buffer.WriteString(strconv.Itoa(line.ItemID))
+		buffer.WriteString(":")
+		buffer.WriteString(strconv.Itoa(line.Count))
+	}
+	return buffer.String()
+}
+
+func decodeLegacyCart(value string) (*cartRecord, error) {
+	c := newCart(ValueSchemaLegacy)
+	if value == "" {
+		return c, nil
+	}
+	vs := strings.Split(value, ".")
+	if len(vs) > 2 {
+		return nil, fmt.Errorf("cart %q: %v", value, errMalformedValue)
+	}
+	num, err := strconv.Atoi(vs[0])
+	if err != nil {
+		return nil, fmt.Errorf("cart %q: %v", value, errMalformedValue)
+	}
+	if len(vs) == 2 {
+		var lines []lineV1
+		for _, itemStr := range strings.Split(vs[1], ";") {
+			line, err := parseLegacyLine(itemStr)
+			if err != nil {
+				return nil, fmt.Errorf("cart %q: %v", value, err)
+			}
+			lines = append(lines, line)
+		}
+		if err := c.setLines(lines); err != nil {
+			return nil, fmt.Errorf("cart %q: %v", value, err)
+		}
+	}
+	if num != c.Num {
+		return nil, fmt.Errorf("cart %q: total count %d of %d", value, num, c.Num)
+	}
+	return c, nil
+}
+
+// parseLegacyLine parses an item of a legacy cart.
+// 1:2
+func parseLegacyLine(s string) (line lineV1, err error) {
+	info := strings.Split(s, ":")
+	if len(info) != 2 {
+		return line, errMalformedValue
+	}
+	if line.ItemID, err = strconv.Atoi(info[0]); err != nil {
+		return line, errMalformedValue
+	}
+	if line.Count, err = strconv.Atoi(info[1]); err != nil {
+		return line, errMalformedValue
+	}
+	return line, nil
+}
+
+// encodeLegacy writes the paid flag, the total and the cart, as the shops
+// before ValueSchema do, so the coupon applied is dropped.
+// W|90|2.1:1;2:1
+func (o *orderRecord) encodeLegacy() string {
+	info := []string{OrderUnpaidFlag, strconv.Itoa(o.Total), o.cartRecord.encodeLegacy()}
+	if o.Paid {
+		info[0] = OrderPaidFlag
+	}
+	return strings.Join(info, "|")
+}
+
+func decodeLegacyOrder(value string) (*orderRecord, error) {
+	info := strings.Split(value, "|")
+	if len(info) != 3 {
+		return nil, fmt.Errorf("order %q: %v", value, errMalformedValue)
+	}
+	o := &orderRecord{}
+	switch info[0] {
+	case OrderPaidFlag:
+		o.Paid = true
+	case OrderUnpaidFlag:
+	default:
+		return nil, fmt.Errorf("order %q: %v", value, errMalformedValue)
+	}
+	var err error
+	if o.Total, err = strconv.Atoi(info[1]); err != nil {
+		return nil, fmt.Errorf("order %q: %v", value, errMalformedValue)
+	}
+	cart, err := decodeLegacyCart(info[2])
+	if err != nil {
+		return nil, err
+	}
+	o.cartRecord = *cart
+	return o, nil
+}
@@ -0,0 +1,113 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestDecodeLegacyValues(t *testing.T) {
+	cart, err := decodeCart("3.1:2;2:1")
+	if err != nil || cart.Schema != ValueSchemaLegacy || cart.Num != 3 ||
+		cart.Detail[1] != 2 || cart.Detail[2] != 1 {
+		t.Fatalf("decodeCart = %+v, %v", cart, err)
+	}
+	// The shops before ValueSchema can't read the prices.
+	cart.Prices[1] = 9
+	if value := cart.encode(); value != "3.1:2;2:1" {
+		t.Fatalf("legacy cart encoded as %q", value)
+	}
+	if cart, err = decodeCart("0"); err != nil || cart.Num != 0 || cart.encode() != "0" {
+		t.Fatalf("empty cart = %+v, %v", cart, err)
+	}
+
+	order, err := decodeOrder("P|90|2.1:1;2:1")
+	if err != nil || !order.Paid || order.Total != 90 || order.Num != 2 {
+		t.Fatalf("decodeOrder = %+v, %v", order, err)
+	}
+	// Nor the coupons.
+	order.Coupon, order.Discount = "SAVE10", 10
+	if value := order.encode(); value != "P|90|2.1:1;2:1" {
+		t.Fatalf("legacy order encoded as %q", value)
+	}
+}
+
+func TestEncodeV1(t *testing.T) {
+	cart := newCart(ValueSchemaV1)
+	cart.Num, cart.Detail[2], cart.Detail[1], cart.Prices[1] = 3, 2, 1, 5
+	value := cart.encode()
+	if value != "\x01"+`{"lines":[{"id":1,"count":1,"price":5},{"id":2,"count":2}]}` {
+		t.Fatalf("cart encoded as %q", value)
+	}
+	if decoded, err := decodeCart(value); err != nil || decoded.encode() != value || decoded.Num != 3 {
+		t.Fatalf("decodeCart(%q) = %+v, %v", value, decoded, err)
+	}
+
+	order := &orderRecord{cartRecord: *cart, Total: 9, Coupon: "X", Discount: 1}
+	value = order.encode()
+	decoded, err := decodeOrder(value)
+	if err != nil || decoded.Paid || decoded.Total != 9 || decoded.Coupon != "X" || decoded.Discount != 1 ||
+		decoded.Num != 3 || decoded.encode() != value {
+		t.Fatalf("decodeOrder(%q) = %+v, %v", value, decoded, err)
+	}
+}
+
+func TestDecodeMalformedValues(t *testing.T) {
+	for _, value := range []string{"2.1:1", "1.1", "x.1:1", "1.1:1@2", "2.1:1;1:1",
+		"\x01{", "\x01" + `{"lines":[{"id":1,"count":1},{"id":1,"count":1}]}`, "\x07{}"} {
+		if cart, err := decodeCart(value); err == nil {
+			t.Errorf("decodeCart(%q) = %+v; expected an error", value, cart)
+		}
+	}
+	for _, value := range []string{"", "W|1", "X|1|1.1:1", "W|x|1.1:1", "W|1|1.1:1|SAVE", "\x01[]"} {
+		if order, err := decodeOrder(value); err == nil {
+			t.Errorf("decodeOrder(%q) = %+v; expected an error", value, order)
+		}
+	}
+}
+
+func TestOrderKeepsCartSchema(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	sks.Put(ItemsStockKeyPrefix+"1", "10")
+	sks.Put(BalanceKeyPrefix+"2", "100")
+
+	cart := newCart(ValueSchemaV1)
+	cart.Num, cart.Detail[1] = 2, 2
+	var reply SubmitOrderReply
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "2", CartValue: cart.encode()}, &reply)
+	if reply.Status != OK || reply.Total != 20 {
+		t.Fatalf("SubmitOrder = %v; expected OK with total 20", reply)
+	}
+	var status int
+	sks.PayOrder(&PayOrderArgs{OrderIDStr: "2", UserToken: "2"}, &status)
+	value, _ := sks.Get(OrderKeyPrefix + "2")
+	if order, err := decodeOrder(value); err != nil || order.Schema != ValueSchemaV1 || !order.Paid {
+		t.Fatalf("order %q = %+v, %v; expected paid in v1", value, order, err)
+	}
+
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "3", CartValue: "1.9:"}, &reply)
+	if reply.Status != MalformedValue {
+		t.Fatalf("SubmitOrder of a malformed cart = %v", reply)
+	}
+}
+
+func TestMigrateValue(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put(OrderKeyPrefix+"1", "W|90|2.1:1;2:1")
+	sks.Put(CartKeyPrefix+"1:1", "0.")
+
+	var status int
+	sks.MigrateValue(&MigrateArgs{Key: OrderKeyPrefix + "1", Value: "W|0|0"}, &status)
+	if status != RequestConflict {
+		t.Fatalf("migrating a changed order returned %v", status)
+	}
+	sks.MigrateValue(&MigrateArgs{Key: OrderKeyPrefix + "1", Value: "W|90|2.1:1;2:1"}, &status)
+	value, _ := sks.Get(OrderKeyPrefix + "1")
+	if order, err := decodeOrder(value); status != OK || err != nil || order.Schema != ValueSchemaV1 ||
+		order.Total != 90 || order.Detail[2] != 1 {
+		t.Fatalf("migrated order %q = %+v, %v", value, order, err)
+	}
+	sks.MigrateValue(&MigrateArgs{Key: CartKeyPrefix + "1:1", Value: "0."}, &status)
+	if value, _ = sks.Get(CartKeyPrefix + "1:1"); status != MalformedValue || value != "0." {
+		t.Fatalf("migrating a malformed cart returned %v, and left %q", status, value)
+	}
+}
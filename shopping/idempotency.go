@@ -0,0 +1,220 @@
+package shopping
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-system/http"
+)
+
+// A client may send an idempotency key with POST /orders and POST /pay, by
+// the header or the body. The outcome of the first request with the key
+// is recorded, and the retries get the same response without running
+// the request again. A request of another body with the key is refused
+// with 422.
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyRetention is how long the outcomes are kept.
+	IdempotencyRetention = 24 * time.Hour
+	// The record of a request in progress expires after
+	// IdempotencyPendingTTL, in case the shop dies before the outcome.
+	IdempotencyPendingTTL = 30 * time.Second
+	// A retry waits for at most IdempotencyWait for the outcome of the
+	// request in progress.
+	IdempotencyWait = 2 * time.Second
+
+	idempotencyPoll    = 50 * time.Millisecond
+	idempotencyPending = "pending"
+	idempotencyUnknown = "unknown"
+
+	statusUnprocessableEntity = 422
+)
+
+type IdempotencyKeyJson struct {
+	Key string `json:"idempotency_key"`
+}
+
+func idempotencyRecordKey(token, endpoint, key string) string {
+	return IdempotencyKeyPrefix + token + ":" + endpoint + ":" + key
+}
+
+// requestHash tells the requests of an idempotency key apart.
+func requestHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:16])
+}
+
+// A record is "h:<hash>|<status>|<body>", or "pending:<hash>" while the
+// request is in progress, or "unknown:<hash>" if the KV-Store failed the
+// request, which may have run anyway.
+func composeIdempotencyRecord(hash string, status int, body []byte) string {
+	return "h:" + hash + "|" + strconv.Itoa(status) + "|" + string(body)
+}
+
+func composePendingRecord(hash string) string {
+	return idempotencyPending + ":" + hash
+}
+
+func composeUnknownRecord(hash string) string {
+	return idempotencyUnknown + ":" + hash
+}
+
+func parseIdempotencyRecord(value string) (hash string, status int, body []byte, ok bool) {
+	if !strings.HasPrefix(value, "h:") {
+		return "", 0, nil, false
+	}
+	i := strings.IndexByte(value, '|')
+	if i < 0 {
+		return "", 0, nil, false
+	}
+	hash, value = value[2:i], value[i+1:]
+	if i = strings.IndexByte(value, '|'); i < 0 {
+		return "", 0, nil, false
+	}
+	var err error
+	if status, err = strconv.Atoi(value[:i]); err != nil {
+		return "", 0, nil, false
+	}
+	return hash, status, []byte(value[i+1:]), true
+}
+
+// pendingHash returns the hash of a request in progress, if value is one.
+func pendingHash(value string) (hash string, pending bool) {
+	return markedHash(value, idempotencyPending)
+}
+
+// unknownHash returns the hash of a request failed by the KV-Store, if
+// value is one.
+func unknownHash(value string) (hash string, unknown bool) {
+	return markedHash(value, idempotencyUnknown)
+}
+
+func markedHash(value, mark string) (string, bool) {
+	if strings.HasPrefix(value, mark+":") {
+		return value[len(mark)+1:], true
+	}
+	return "", false
+}
+
+func idempotencyKey(req *http.Request, body []byte) string {
+	if key := req.Header.Get(IdempotencyKeyHeader); key != "" {
+		return key
+	}
+	var keyJson IdempotencyKeyJson
+	json.Unmarshal(body, &keyJson)
+	return keyJson.Key
+}
+
+// idempotent runs handle once per idempotency key of the user on the
+// endpoint, and answers the retries with its recorded outcome.
+func (ss *ShopServer) idempotent(resp *http.Response, req *http.Request, token string, body []byte,
+	endpoint string, handle func() (int, []byte)) {
+	status, out := ss.doIdempotent(token, idempotencyKey(req, body), body, endpoint, handle)
+	writeReply(resp, status, out)
+}
+
+func (ss *ShopServer) doIdempotent(token, key string, body []byte, endpoint string,
+	handle func() (int, []byte)) (int, []byte) {
+	if key == "" {
+		return handle()
+	}
+
+	hash := requestHash(body)
+	recordKey := idempotencyRecordKey(token, endpoint, key)
+	reply, err := ss.ClientPool.PutNX(recordKey, composePendingRecord(hash), IdempotencyPendingTTL)
+	if err != nil {
+		return unavailable(err)
+	}
+	if reply.Flag {
+		value := reply.Value
+		for deadline := time.Now().Add(IdempotencyWait); time.Now().Before(deadline); {
+			if h, pending := pendingHash(value); !pending {
+				break
+			} else if h != hash {
+				return statusUnprocessableEntity, IDEMPOTENCY_KEY_REUSED_MSG
+			}
+			time.Sleep(idempotencyPoll)
+			if reply, err = ss.ClientPool.Get(recordKey); err == nil {
+				value = reply.Value
+			}
+		}
+		if h, unknown := unknownHash(value); unknown {
+			if h != hash {
+				return statusUnprocessableEntity, IDEMPOTENCY_KEY_REUSED_MSG
+			}
+			// The KV-Store may have committed the request it failed, so
+			// look whether it has run before running it again.
+			status, out, err := ss.requestOutcome(token, endpoint)
+			if err != nil {
+				return unavailable(err)
+			}
+			if status != 0 {
+				ss.ClientPool.PutTTL(recordKey, composeIdempotencyRecord(hash, status, out), IdempotencyRetention)
+				return status, out
+			}
+			if _, err = ss.ClientPool.PutTTL(recordKey, composePendingRecord(hash), IdempotencyPendingTTL); err != nil {
+				return unavailable(err)
+			}
+		} else if h, status, out, ok := parseIdempotencyRecord(value); !ok {
+			return http.StatusConflict, IDEMPOTENCY_IN_PROGRESS_MSG
+		} else if h != hash {
+			return statusUnprocessableEntity, IDEMPOTENCY_KEY_REUSED_MSG
+		} else {
+			return status, out
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// Let the retries run the request again.
+			ss.ClientPool.Del(recordKey)
+			panic(r)
+		}
+	}()
+	status, out := handle()
+	if status == http.StatusServiceUnavailable {
+		// The request may have run, which the retries look up.
+		ss.ClientPool.PutTTL(recordKey, composeUnknownRecord(hash), IdempotencyRetention)
+	} else if bytes.Equal(out, INVALID_ACCESS_TOKEN_MSG) {
+		// The user may log in, so let the retries run it again.
+		ss.ClientPool.Del(recordKey)
+	} else {
+		ss.ClientPool.PutTTL(recordKey, composeIdempotencyRecord(hash, status, out), IdempotencyRetention)
+	}
+	return status, out
+}
+
+// requestOutcome tells the outcome of the request of the user on the
+// endpoint by the state of the order, or 0 if the request hasn't run. A
+// user has one order, so it is the one the request placed, paid or
+// cancelled.
+func (ss *ShopServer) requestOutcome(token, endpoint string) (int, []byte, error) {
+	reply, err := ss.ClientPool.Get(OrderKeyPrefix + token)
+	if err != nil {
+		return 0, nil, err
+	}
+	ok := []byte("{\"order_id\": \"" + token + "\"}")
+	switch endpoint {
+	case SUBMIT_OR_QUERY_ORDER:
+		if reply.Flag {
+			return http.StatusOK, ok, nil
+		}
+	case PAY_ORDER:
+		if !reply.Flag {
+			break
+		}
+		if order, err := decodeOrder(reply.Value); err == nil && order.Paid {
+			return http.StatusOK, ok, nil
+		}
+	case CANCEL_ORDER:
+		if !reply.Flag {
+			return http.StatusOK, ok, nil
+		}
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,67 @@
+package shopping
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestIdempotent(t *testing.T) {
+	f := newFlakyKV()
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions()}
+	body := []byte(`{"cart_id":"1","idempotency_key":"k"}`)
+	runs := 0
+	handle := func() (int, []byte) {
+		runs++
+		return http.StatusOK, []byte(`{"id":"1"}`)
+	}
+
+	// The retry is answered with the recorded outcome.
+	for i := 0; i < 2; i++ {
+		status, out := ss.doIdempotent("1", "k", body, "orders", handle)
+		if status != http.StatusOK || string(out) != `{"id":"1"}` {
+			t.Fatalf("doIdempotent #%d = %v, %s", i, status, out)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("the request ran %d times", runs)
+	}
+
+	// The key of another request is refused.
+	other := []byte(`{"cart_id":"2","idempotency_key":"k"}`)
+	status, out := ss.doIdempotent("1", "k", other, "orders", handle)
+	if status != statusUnprocessableEntity || !bytes.Equal(out, IDEMPOTENCY_KEY_REUSED_MSG) || runs != 1 {
+		t.Fatalf("doIdempotent of another body = %v, %s, ran %d times", status, out, runs)
+	}
+	// Even while the first is in progress.
+	f.sks.Put(idempotencyRecordKey("1", "pay", "k"), composePendingRecord(requestHash(body)))
+	status, out = ss.doIdempotent("1", "k", other, "pay", handle)
+	if status != statusUnprocessableEntity || runs != 1 {
+		t.Fatalf("doIdempotent of another body in progress = %v, %s", status, out)
+	}
+
+	// The retry of a request in progress waits for it, then gives up.
+	status, out = ss.doIdempotent("1", "k", body, "pay", handle)
+	if status != http.StatusConflict || !bytes.Equal(out, IDEMPOTENCY_IN_PROGRESS_MSG) || runs != 1 {
+		t.Fatalf("doIdempotent in progress = %v, %s", status, out)
+	}
+
+	// The request failed by the KV-Store is run again if it hasn't run.
+	failed := func() (int, []byte) { runs++; return unavailable(nil) }
+	ss.doIdempotent("1", "u", body, SUBMIT_OR_QUERY_ORDER, failed)
+	ss.doIdempotent("1", "u", body, SUBMIT_OR_QUERY_ORDER, handle)
+	if runs != 3 {
+		t.Fatal("the request failed by the KV-Store wasn't run again")
+	}
+	// But not if it has placed the order anyway.
+	ss.doIdempotent("1", "v", body, SUBMIT_OR_QUERY_ORDER, failed)
+	f.sks.Put(OrderKeyPrefix+"1", "order")
+	status, out = ss.doIdempotent("1", "v", body, SUBMIT_OR_QUERY_ORDER, handle)
+	if status != http.StatusOK || string(out) != `{"order_id": "1"}` || runs != 4 {
+		t.Fatalf("doIdempotent of an order placed = %v, %s, ran %d times", status, out, runs)
+	}
+	// Nor once recorded.
+	if status, _ = ss.doIdempotent("1", "v", body, SUBMIT_OR_QUERY_ORDER, handle); status != http.StatusOK || runs != 4 {
+		t.Fatalf("doIdempotent of an order placed again = %v, ran %d times", status, runs)
+	}
+}
@@ -0,0 +1,297 @@
+package shopping
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rush-shopping/kv"
+)
+
+// flakyKV is a KV-Store in process, which fails every call while down,
+// and the calls of the failing methods.
+type flakyKV struct {
+	sks     *ShoppingKVStore
+	down    int32
+	failing sync.Map // RPC method names
+}
+
+func newFlakyKV() *flakyKV {
+	return &flakyKV{sks: NewShoppingKVStore()}
+}
+
+func (f *flakyKV) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&f.down, 1)
+	} else {
+		atomic.StoreInt32(&f.down, 0)
+	}
+}
+
+// setFailing fails the calls of the RPC method, e.g. RPCBatch.
+func (f *flakyKV) setFailing(method string, failing bool) {
+	if failing {
+		f.failing.Store(method, true)
+	} else {
+		f.failing.Delete(method)
+	}
+}
+
+func (f *flakyKV) check(method string, call func() error) error {
+	if _, failing := f.failing.Load(method); failing || atomic.LoadInt32(&f.down) != 0 {
+		return &KVError{Method: method}
+	}
+	return call()
+}
+
+func (f *flakyKV) Put(key, value string) (reply kv.Reply, err error) {
+	return reply, f.check("RPCPut", func() error { return f.sks.RPCPut(&kv.PutArgs{Key: key, Value: value}, &reply) })
+}
+
+func (f *flakyKV) PutTTL(key, value string, ttl time.Duration) (reply kv.Reply, err error) {
+	args := &kv.PutArgs{Key: key, Value: value, TTLMs: int64(ttl / time.Millisecond)}
+	return reply, f.check("RPCPut", func() error { return f.sks.RPCPut(args, &reply) })
+}
+
+func (f *flakyKV) PutNX(key, value string, ttl time.Duration) (reply kv.Reply, err error) {
+	args := &kv.PutArgs{Key: key, Value: value, TTLMs: int64(ttl / time.Millisecond)}
+	return reply, f.check("RPCPutNX", func() error { return f.sks.RPCPutNX(args, &reply) })
+}
+
+func (f *flakyKV) Get(key string) (reply kv.Reply, err error) {
+	return reply, f.check("RPCGet", func() error { return f.sks.RPCGet(&kv.GetArgs{Key: key}, &reply) })
+}
+
+func (f *flakyKV) Incr(key string, delta int) (reply kv.Reply, err error) {
+	return reply, f.check("RPCIncr", func() error { return f.sks.RPCIncr(&kv.IncrArgs{Key: key, Delta: delta}, &reply) })
+}
+
+func (f *flakyKV) Del(key string) (reply kv.Reply, err error) {
+	return reply, f.check("RPCDel", func() error { return f.sks.RPCDel(&kv.DelArgs{Key: key}, &reply) })
+}
+
+func (f *flakyKV) Scan(prefix string) (reply kv.ScanReply, err error) {
+	return reply, f.check("RPCScan", func() error { return f.sks.RPCScan(&kv.ScanArgs{Prefix: prefix}, &reply) })
+}
+
+func (f *flakyKV) MGet(keys []string) (reply kv.MGetReply, err error) {
+	return reply, f.check("RPCMGet", func() error { return f.sks.RPCMGet(&kv.MGetArgs{Keys: keys}, &reply) })
+}
+
+func (f *flakyKV) MPut(pairs []kv.PutArgs) (reply kv.MPutReply, err error) {
+	return reply, f.check("RPCMPut", func() error { return f.sks.RPCMPut(&kv.MPutArgs{Pairs: pairs}, &reply) })
+}
+
+func (f *flakyKV) Batch(ops []kv.BatchOp) (reply kv.BatchReply, err error) {
+	return reply, f.check("RPCBatch", func() error { return f.sks.RPCBatch(&kv.BatchArgs{Ops: ops}, &reply) })
+}
+
+func (f *flakyKV) WatchKeys(prefix string, versions []int64, timeout time.Duration) (reply kv.WatchReply, err error) {
+	args := &kv.WatchArgs{Prefix: prefix, Versions: versions, TimeoutMs: int64(timeout / time.Millisecond)}
+	return reply, f.check("RPCWatch", func() error { return f.sks.RPCWatch(args, &reply) })
+}
+
+func (f *flakyKV) SubmitOrder(args *SubmitOrderArgs) (reply SubmitOrderReply, err error) {
+	return reply, f.check("SubmitOrder", func() error { return f.sks.SubmitOrder(args, &reply) })
+}
+
+func (f *flakyKV) PayOrder(orderIDStr, userToken string) (reply int, err error) {
+	args := &PayOrderArgs{OrderIDStr: orderIDStr, UserToken: userToken}
+	return reply, f.check("PayOrder", func() error { return f.sks.PayOrder(args, &reply) })
+}
+
+func (f *flakyKV) Credit(userToken string, amount int, kind, requestRef, externalRef string) (reply CreditReply, err error) {
+	args := &CreditArgs{UserToken: userToken, Amount: amount, Kind: kind, RequestRef: requestRef, ExternalRef: externalRef}
+	return reply, f.check("Credit", func() error { return f.sks.Credit(args, &reply) })
+}
+
+func (f *flakyKV) CancelOrder(userToken, orderValue string) (reply int, err error) {
+	args := &CancelOrderArgs{UserToken: userToken, OrderValue: orderValue}
+	return reply, f.check("CancelOrder", func() error { return f.sks.CancelOrder(args, &reply) })
+}
+
+func (f *flakyKV) Watch(args *WatchArgs) (reply WatchReply, err error) {
+	return reply, f.check("Watch", func() error { return f.sks.Watch(args, &reply) })
+}
+
+func (f *flakyKV) PopWaitlist(args *PopWaitlistArgs) (reply PopWaitlistReply, err error) {
+	return reply, f.check("PopWaitlist", func() error { return f.sks.PopWaitlist(args, &reply) })
+}
+
+func (f *flakyKV) ReleaseReservation(args *ReleaseArgs) (reply int, err error) {
+	return reply, f.check("ReleaseReservation", func() error { return f.sks.ReleaseReservation(args, &reply) })
+}
+
+func (f *flakyKV) TakeToken(args *RateLimitArgs) (reply RateLimitReply, err error) {
+	return reply, f.check("TakeToken", func() error { return f.sks.TakeToken(args, &reply) })
+}
+
+func (f *flakyKV) AdjustStock(args *StockArgs) (reply StockReply, err error) {
+	return reply, f.check("AdjustStock", func() error { return f.sks.AdjustStock(args, &reply) })
+}
+
+func (f *flakyKV) WaitingRoom(args *WaitingRoomArgs) (reply WaitingRoomReply, err error) {
+	return reply, f.check("WaitingRoom", func() error { return f.sks.WaitingRoom(args, &reply) })
+}
+
+func (f *flakyKV) MigrateValue(args *MigrateArgs) (reply int, err error) {
+	return reply, f.check("MigrateValue", func() error { return f.sks.MigrateValue(args, &reply) })
+}
+
+func TestKVUnavailable(t *testing.T) {
+	f := newFlakyKV()
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions(), MaxUserID: 2,
+		UserMap: map[string]UserIDAndPass{"u": {1, "p"}}}
+	ss.ItemListCache = []Item{{ID: 0}, {ID: 1, Price: 10, Stock: 5}}
+	ss.MaxItemID = 1
+	f.sks.Put(CartIDMaxKey, "1")
+	f.sks.Put(getCartKey("1", "1"), "1.1:1")
+	f.sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	f.sks.Put(ItemsStockKeyPrefix+"1", "5")
+	f.sks.Put(BalanceKeyPrefix+"1", "100")
+	body := []byte(`{"cart_id":"1"}`)
+
+	f.setDown(true)
+	if status, msg := ss.doLogin([]byte(`{"username":"u","password":"p"}`)); status != http.StatusServiceUnavailable ||
+		string(msg) != string(SERVICE_UNAVAILABLE_MSG) {
+		t.Fatalf("doLogin with the KV-Store down = %v, %s", status, msg)
+	}
+	if status, _ := ss.doCreateCart("1"); status != http.StatusServiceUnavailable {
+		t.Fatalf("doCreateCart with the KV-Store down = %v", status)
+	}
+	if reply, _ := f.sks.Get(CartIDMaxKey); reply != "1" {
+		t.Fatalf("doCreateCart with the KV-Store down took the cart ID %v", reply)
+	}
+	if status, msg := ss.doSubmitOrder("1", body); status != http.StatusServiceUnavailable ||
+		string(msg) != string(SERVICE_UNAVAILABLE_MSG) {
+		t.Fatalf("doSubmitOrder with the KV-Store down = %v, %s", status, msg)
+	}
+	if status, _ := ss.doPayOrder("1", []byte(`{"order_id":"1"}`)); status != http.StatusServiceUnavailable {
+		t.Fatalf("doPayOrder with the KV-Store down = %v", status)
+	}
+	if err := ss.syncCatalog(); err == nil {
+		t.Fatal("syncCatalog with the KV-Store down returned no error")
+	}
+	if ss.ItemListCache[1].Price != 10 {
+		t.Fatalf("failed sync changed the cache to %+v", ss.ItemListCache[1])
+	}
+
+	f.setDown(false)
+	if status, msg := ss.doSubmitOrder("1", body); status != http.StatusUnauthorized ||
+		string(msg) != string(INVALID_ACCESS_TOKEN_MSG) {
+		t.Fatalf("doSubmitOrder before login = %v, %s", status, msg)
+	}
+	if status, msg := ss.doLogin([]byte(`{"username":"u","password":"p"}`)); status != http.StatusOK {
+		t.Fatalf("doLogin = %v, %s", status, msg)
+	}
+	if status, msg := ss.doCreateCart("1"); status != http.StatusOK || string(msg) != `{"cart_id": "2"}` {
+		t.Fatalf("doCreateCart = %v, %s", status, msg)
+	}
+	if status, msg := ss.doSubmitOrder("1", body); status != http.StatusOK {
+		t.Fatalf("doSubmitOrder = %v, %s", status, msg)
+	}
+	f.setDown(true)
+	if status, _ := ss.doCancelOrder("1", []byte(`{"order_id":"1"}`)); status != http.StatusServiceUnavailable {
+		t.Fatalf("doCancelOrder with the KV-Store down = %v", status)
+	}
+	f.setDown(false)
+	if status, _ := ss.doPayOrder("1", []byte(`{"order_id":"1"}`)); status != http.StatusOK {
+		t.Fatalf("doPayOrder = %v", status)
+	}
+	if balance, _ := f.sks.Get(BalanceKeyPrefix + "1"); balance != "90" {
+		t.Fatalf("balance %v; expected 90", balance)
+	}
+}
+
+// slowKV serves the RPCs of a KV-Store, sleeping delays[i] before the
+// i-th call if any.
+type slowKV struct {
+	mu     sync.Mutex
+	delays []time.Duration
+	calls  int
+}
+
+func (s *slowKV) delay() {
+	s.mu.Lock()
+	var d time.Duration
+	if s.calls < len(s.delays) {
+		d = s.delays[s.calls]
+	}
+	s.calls++
+	s.mu.Unlock()
+	time.Sleep(d)
+}
+
+func (s *slowKV) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *slowKV) RPCPing(args *kv.PingArgs, reply *kv.Reply) error {
+	reply.Flag = true
+	return nil
+}
+
+func (s *slowKV) RPCGet(args *kv.GetArgs, reply *kv.Reply) error {
+	s.delay()
+	reply.Flag, reply.Value = true, "v"
+	return nil
+}
+
+func (s *slowKV) RPCPut(args *kv.PutArgs, reply *kv.Reply) error {
+	s.delay()
+	return nil
+}
+
+func serveSlowKV(t *testing.T, delays ...time.Duration) (*slowKV, *clientspool, func()) {
+	s := &slowKV{delays: delays}
+	server := rpc.NewServer()
+	server.RegisterName("ShoppingKVStoreService", s)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	cp := NewClientpoolsWithTimeout("tcp", l.Addr().String(), 4, 50*time.Millisecond)
+	return s, cp, func() {
+		cp.pool.Close()
+		l.Close()
+	}
+}
+
+func TestKVTimeoutAndRetry(t *testing.T) {
+	// A read timed out is tried again.
+	s, cp, stop := serveSlowKV(t, 200*time.Millisecond)
+	if reply, err := cp.Get("k"); err != nil || reply.Value != "v" || s.count() != 2 {
+		t.Fatalf("Get = %+v, %v after %d calls; expected v after 2", reply, err, s.count())
+	}
+	stop()
+
+	// It gives up after KVRetries.
+	s, cp, stop = serveSlowKV(t, 200*time.Millisecond, 200*time.Millisecond, 200*time.Millisecond)
+	_, err := cp.Get("k")
+	if kvErr, ok := err.(*KVError); !ok || kvErr.Err != ErrRPCTimeout || s.count() != KVRetries+1 {
+		t.Fatalf("Get = %v after %d calls; expected a timeout after %d", err, s.count(), KVRetries+1)
+	}
+	stop()
+
+	// A write timed out isn't, as it may still land.
+	s, cp, stop = serveSlowKV(t, 200*time.Millisecond)
+	defer stop()
+	start := time.Now()
+	if _, err := cp.Put("k", "v"); err == nil || err.(*KVError).Err != ErrRPCTimeout {
+		t.Fatalf("Put = %v; expected a timeout", err)
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Fatalf("Put took %v, over its timeout", time.Since(start))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if s.count() != 1 {
+		t.Fatalf("Put called %d times; expected once", s.count())
+	}
+}
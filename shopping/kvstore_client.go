@@ -1,48 +1,274 @@
 package shopping
 
 import(
-	"distributed-system/util"
-	//"net/rpc"
+	"net/rpc"
+	"reflect"
 	"rush-shopping/kv"
+	"time"
 )
 
+// kvClient is what the shop calls on the KV-Store. Every call returns a
+// *KVError if the KV-Store can't be reached. Tests stand in for it.
+type kvClient interface{
+	Put(key,value string) (kv.Reply,error)
+	PutTTL(key,value string,ttl time.Duration) (kv.Reply,error)
+	PutNX(key,value string,ttl time.Duration) (kv.Reply,error)
+	Get(key string) (kv.Reply,error)
+	Incr(key string,delta int) (kv.Reply,error)
+	Del(key string) (kv.Reply,error)
+	Scan(prefix string) (kv.ScanReply,error)
+	MGet(keys []string) (kv.MGetReply,error)
+	MPut(pairs []kv.PutArgs) (kv.MPutReply,error)
+	Batch(ops []kv.BatchOp) (kv.BatchReply,error)
+	WatchKeys(prefix string,versions []int64,timeout time.Duration) (kv.WatchReply,error)
+	SubmitOrder(args *SubmitOrderArgs) (SubmitOrderReply,error)
+	PayOrder(OrderIDStr,UserToken string) (int,error)
+	Credit(UserToken string,Amount int,Kind,RequestRef,ExternalRef string) (CreditReply,error)
+	CancelOrder(UserToken,OrderValue string) (int,error)
+	Watch(args *WatchArgs) (WatchReply,error)
+	PopWaitlist(args *PopWaitlistArgs) (PopWaitlistReply,error)
+	ReleaseReservation(args *ReleaseArgs) (int,error)
+	TakeToken(args *RateLimitArgs) (RateLimitReply,error)
+	AdjustStock(args *StockArgs) (StockReply,error)
+	WaitingRoom(args *WaitingRoomArgs) (WaitingRoomReply,error)
+	MigrateValue(args *MigrateArgs) (int,error)
+}
+
 type clientspool struct{
-	pool *util.ResourcePool
+	pool *kv.Pool
+	timeout time.Duration
+	breaker *circuitBreaker
 }
 
+const(
+	// A transaction waits for the locks up to the timeout in the prepare
+	// round, and then commits, so its call is given longer.
+	txnTimeoutFactor = 3
+	// The reads are tried again KVRetries times, after KVRetryBackoff
+	// doubled every time. The writes aren't, as the attempt timed out may
+	// still land after a newer write.
+	KVRetries = 2
+	KVRetryBackoff = 20*time.Millisecond
+)
+
 func NewClientpools(network,addr string, size int) *clientspool{
-	pool := util.NewResourcePool(func() util.Resource {
-		return util.DialServer(network, addr)
-	}, size)
-	return &clientspool{pool: pool}
+	return NewClientpoolsWithTimeout(network,addr,size,0)
+}
+
+// NewClientpoolsWithTimeout is NewClientpools with every call bounded by
+// timeout, DefaultTxnTimeoutMS if it isn't positive.
+func NewClientpoolsWithTimeout(network,addr string, size int, timeout time.Duration) *clientspool{
+	opts:=kv.DefaultPoolOptions()
+	opts.MaxActive,opts.MaxIdle=size,size
+	opts.PingMethod="ShoppingKVStoreService.RPCPing"
+	pool:=kv.NewPool(network,addr,opts)
+	if timeout<=0 {
+		timeout=DefaultTxnTimeoutMS*time.Millisecond
+	}
+	return &clientspool{pool: pool, timeout: timeout,
+		breaker: newCircuitBreaker(BreakerFailures,BreakerCooldown,SystemClock)}
+}
+
+// KVError is a failed call to the KV-Store, e.g. when it is unreachable.
+// Err is ErrRPCTimeout, ErrCircuitOpen, an rpc.ServerError or another
+// failure.
+type KVError struct{
+	Method string
+	Err error
+}
+
+func (e *KVError) Error() string{
+	if e.Err==nil {
+		return "kvstore: "+e.Method+" failed"
+	}
+	return "kvstore: "+e.Method+": "+e.Err.Error()
+}
+
+// callOnce calls the method, waiting for at most timeout. The call is left
+// running after the timeout, but into a reply of its own, so reply is only
+// written on success.
+func (cp *clientspool) callOnce(method string,args,reply interface{},timeout time.Duration) error{
+	if !cp.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	out:=reflect.New(reflect.TypeOf(reply).Elem())
+	done:=make(chan error,1)
+	go func(){
+		done<-cp.pool.Call(method,args,out.Interface())
+	}()
+	timer:=time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select{
+	case err=<-done:
+	case <-timer.C:
+		err=ErrRPCTimeout
+	}
+	// the node is up if the method failed on it, e.g. as the coordinator
+	// failed fast the call to a participant down
+	_,isServerErr:=err.(rpc.ServerError)
+	cp.breaker.done(err==nil || isServerErr)
+	if err==nil {
+		reflect.ValueOf(reply).Elem().Set(out.Elem())
+	}
+	return err
+}
+
+func (cp *clientspool) call(method string,args,reply interface{}) error{
+	return cp.callTimeout(method,args,reply,cp.timeout)
+}
+
+func (cp *clientspool) callTimeout(method string,args,reply interface{},timeout time.Duration) error{
+	if err:=cp.callOnce(method,args,reply,timeout);err!=nil{
+		return &KVError{Method:method,Err:err}
+	}
+	return nil
+}
+
+// callRead is call tried again with backoff while it fails, for the reads,
+// which are safe to run twice. It gives up at once while the circuit of
+// the node is open, or if the method failed on the node.
+func (cp *clientspool) callRead(method string,args,reply interface{}) error{
+	backoff:=KVRetryBackoff
+	for i:=0;;i++{
+		err:=cp.callOnce(method,args,reply,cp.timeout)
+		if err==nil {
+			return nil
+		}
+		_,isServerErr:=err.(rpc.ServerError)
+		if i==KVRetries || err==ErrCircuitOpen || isServerErr {
+			return &KVError{Method:method,Err:err}
+		}
+		time.Sleep(backoff)
+		backoff*=2
+	}
 }
 
-func (cp *clientspool) Put(key,value string) (ok bool, reply kv.Reply){
+func (cp *clientspool) Put(key,value string) (reply kv.Reply, err error){
 	args:=&kv.PutArgs{Key: key, Value: value}
-	ok=util.RPCPoolCall(cp.pool,"ShoppingKVStoreService.RPCPut",args,&reply)
+	err=cp.call("ShoppingKVStoreService.RPCPut",args,&reply)
 	return
 }
 
-func (cp *clientspool) Get(key string) (ok bool, reply kv.Reply){
+func (cp *clientspool) PutTTL(key,value string,ttl time.Duration) (reply kv.Reply, err error){
+	args:=&kv.PutArgs{Key: key, Value: value, TTLMs: int64(ttl/time.Millisecond)}
+	err=cp.call("ShoppingKVStoreService.RPCPut",args,&reply)
+	return
+}
+
+func (cp *clientspool) PutNX(key,value string,ttl time.Duration) (reply kv.Reply, err error){
+	args:=&kv.PutArgs{Key: key, Value: value, TTLMs: int64(ttl/time.Millisecond)}
+	err=cp.call("ShoppingKVStoreService.RPCPutNX",args,&reply)
+	return
+}
+
+func (cp *clientspool) Get(key string) (reply kv.Reply, err error){
 	args:= &kv.GetArgs{Key: key}
-	ok=util.RPCPoolCall(cp.pool,"ShoppingKVStoreService.RPCGet",args,&reply)
+	err=cp.callRead("ShoppingKVStoreService.RPCGet",args,&reply)
 	return
 }
 
-func (cp *clientspool) Incr(key string,delta int) (ok bool, reply kv.Reply){
+func (cp *clientspool) Incr(key string,delta int) (reply kv.Reply, err error){
 	args:= &kv.IncrArgs{Key: key, Delta: delta}
-	ok=util.RPCPoolCall(cp.pool,"ShoppingKVStoreService.RPCIncr",args,&reply)
+	err=cp.call("ShoppingKVStoreService.RPCIncr",args,&reply)
+	return
+}
+
+func (cp *clientspool) Del(key string) (reply kv.Reply, err error){
+	args:= &kv.DelArgs{Key: key}
+	err=cp.call("ShoppingKVStoreService.RPCDel",args,&reply)
+	return
+}
+
+func (cp *clientspool) Scan(prefix string) (reply kv.ScanReply, err error){
+	args:= &kv.ScanArgs{Prefix: prefix}
+	err=cp.callRead("ShoppingKVStoreService.RPCScan",args,&reply)
+	return
+}
+
+func (cp *clientspool) MGet(keys []string) (reply kv.MGetReply, err error){
+	args:= &kv.MGetArgs{Keys: keys}
+	err=cp.callRead("ShoppingKVStoreService.RPCMGet",args,&reply)
+	return
+}
+
+func (cp *clientspool) MPut(pairs []kv.PutArgs) (reply kv.MPutReply, err error){
+	args:= &kv.MPutArgs{Pairs: pairs}
+	err=cp.call("ShoppingKVStoreService.RPCMPut",args,&reply)
+	return
+}
+
+// Batch runs the operations in one round trip, see kv.KVStore.RPCBatch.
+// It isn't retried, as the operations may not be idempotent.
+func (cp *clientspool) Batch(ops []kv.BatchOp) (reply kv.BatchReply, err error){
+	args:= &kv.BatchArgs{Ops: ops}
+	err=cp.call("ShoppingKVStoreService.RPCBatch",args,&reply)
+	return
+}
+
+// WatchKeys waits up to timeout for the changes of the keys with prefix
+// after versions. Empty versions return the current ones to start from.
+func (cp *clientspool) WatchKeys(prefix string,versions []int64,timeout time.Duration) (reply kv.WatchReply, err error){
+	args:= &kv.WatchArgs{Prefix: prefix, Versions: versions, TimeoutMs: int64(timeout/time.Millisecond)}
+	err=cp.callTimeout("ShoppingKVStoreService.RPCWatch",args,&reply,timeout+cp.timeout)
+	return
+}
+
+func (cp *clientspool) SubmitOrder(args *SubmitOrderArgs)(reply SubmitOrderReply, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.SubmitOrder",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) PayOrder(OrderIDStr,UserToken string)(reply int, err error){
+	args:=&PayOrderArgs{OrderIDStr:OrderIDStr,UserToken:UserToken}
+	err=cp.callTimeout("ShoppingKVStoreService.PayOrder",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+
+func (cp *clientspool) Credit(UserToken string,Amount int,Kind,RequestRef,ExternalRef string)(reply CreditReply, err error){
+	args:=&CreditArgs{UserToken:UserToken,Amount:Amount,Kind:Kind,RequestRef:RequestRef,ExternalRef:ExternalRef}
+	err=cp.callTimeout("ShoppingKVStoreService.Credit",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) CancelOrder(UserToken,OrderValue string)(reply int, err error){
+	args:=&CancelOrderArgs{UserToken:UserToken,OrderValue:OrderValue}
+	err=cp.callTimeout("ShoppingKVStoreService.CancelOrder",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) Watch(args *WatchArgs)(reply WatchReply, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.Watch",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) PopWaitlist(args *PopWaitlistArgs)(reply PopWaitlistReply, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.PopWaitlist",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) ReleaseReservation(args *ReleaseArgs)(reply int, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.ReleaseReservation",args,&reply,txnTimeoutFactor*cp.timeout)
+	return
+}
+
+func (cp *clientspool) TakeToken(args *RateLimitArgs)(reply RateLimitReply, err error){
+	err=cp.call("ShoppingKVStoreService.TakeToken",args,&reply)
+	return
+}
+
+func (cp *clientspool) AdjustStock(args *StockArgs)(reply StockReply, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.AdjustStock",args,&reply,txnTimeoutFactor*cp.timeout)
 	return
 }
 
-func (cp *clientspool) SubmitOrder(CartIDStr,UserToken,CartValue string)(ok bool, reply int){
-	args:= &SubmitOrderArgs{CartIDStr:CartIDStr,UserToken:UserToken,CartValue:CartValue}
-	ok=util.RPCPoolCall(cp.pool,"ShoppingKVStoreService.SubmitOrder",args,&reply)
+func (cp *clientspool) WaitingRoom(args *WaitingRoomArgs)(reply WaitingRoomReply, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.WaitingRoom",args,&reply,txnTimeoutFactor*cp.timeout)
 	return
 }
 
-func (cp *clientspool) PayOrder(OrderIDStr,UserToken string,Delta int)(ok bool, reply int){
-	args:=&PayOrderArgs{OrderIDStr:OrderIDStr,UserToken:UserToken,Delta:Delta}
-	ok=util.RPCPoolCall(cp.pool,"ShoppingKVStoreService.PayOrder",args,&reply)
+func (cp *clientspool) MigrateValue(args *MigrateArgs)(reply int, err error){
+	err=cp.callTimeout("ShoppingKVStoreService.MigrateValue",args,&reply,txnTimeoutFactor*cp.timeout)
 	return
 }
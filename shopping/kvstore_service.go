@@ -2,18 +2,18 @@ package shopping
 
 import(
 	"rush-shopping/kv"
-	"sync"
-	"strconv"
 	"net/rpc"
 	"log"
 	"net"
 	"sync/atomic"
+	"time"
 	//"fmt"
 )
 
+// ShoppingKVStore locks only the keys touched by an order or a
+// payment, so checkouts of disjoint items run in parallel.
 type ShoppingKVStore struct{
 	*kv.KVStore
-	RwLock sync.RWMutex
 }
 
 func NewShoppingKVStore() *ShoppingKVStore {
@@ -47,7 +47,7 @@ func (service *ShoppingKVStoreService) Serve(){
 			if conn, err := l.Accept(); err == nil {
 				if !service.IsDead() {
 					// concurrent processing
-					go rpcs.ServeConn(conn)
+					go kv.ServeConn(rpcs, conn)
 				} else if err == nil {
 					conn.Close()
 				}
@@ -67,80 +67,107 @@ func (ks *ShoppingKVStoreService) IsDead() bool {
 func (ks *ShoppingKVStoreService) Kill() {
 	log.Println("Kill the kvstore")
 	atomic.StoreInt32(&ks.Dead, 1)
-	ks.Data = nil
+	ks.Clear()
+	ks.Close()
 	if err := ks.l.Close(); err != nil {
 		log.Fatal("Kvsotre rPC server close error:", err)
 	}
 }
  
-func (sks *ShoppingKVStore) SubmitOrder(args *SubmitOrderArgs, reply *int) error{
-	//cartKey := getCartKey(args.CartIDStr, args.UserToken)
-	orderKey := OrderKeyPrefix + args.UserToken
-	num, cartDetail := parseCartValue(args.CartValue)
-	*reply= OK
-	sks.RwLock.Lock()
-	defer sks.RwLock.Unlock()
-	for itemID, itemCnt := range cartDetail {
-		itemsStockKey := ItemsStockKeyPrefix + strconv.Itoa(itemID)
-		if Value, existed := sks.Data[itemsStockKey]; existed {
-			iValue, _ := strconv.Atoi(Value)
-			if iValue < itemCnt{
-				*reply=OutOfStock 
-				return nil
-			}
+// runTxn locks the keys of the transaction, runs it and applies its
+// writes before releasing the keys. It is logged as op if slow.
+func (sks *ShoppingKVStore) runTxn(op string,args interface{},txn shoppingTxn) error{
+	if sks.ReadOnly(){
+		return kv.ErrReadOnly
+	}
+	sop:=sks.StartOp("ShoppingKVStore."+op,args)
+	defer sop.Finish()
+	keys:=txn.keys()
+	unlock:=sop.Lock(keys...)
+	defer unlock()
+	values:=make(map[string]string,len(keys))
+	for _,key:=range keys{
+		if value,existed:=sks.RawGet(key);existed{
+			values[key]=value
 		}
 	}
-	if _,existed:=sks.Data[orderKey];existed{
-		*reply=OrderOutOfLimit
-		return nil
+	v:=newTxnView(values)
+	if err:=runSafely(txn,v);err!=nil{
+		return err
 	}
-	price:=0
-	for itemID, itemCnt := range cartDetail {
-		itemsStockKey := ItemsStockKeyPrefix + strconv.Itoa(itemID)
-		itemsPriceKey:=ItemsPriceKeyPrefix+strconv.Itoa(itemID)
-		if Value, existed := sks.Data[itemsStockKey]; existed {
-			iValue, _ := strconv.Atoi(Value)
-			newValue:=strconv.Itoa(iValue-itemCnt)
-			sks.Data[itemsStockKey]=newValue
+	for key,value:=range v.writes{
+		sks.RawPut(key,value)
+		if ttl,ok:=v.ttls[key];ok{
+			sks.RawExpire(key,ttl)
 		}
-		itemprice,_:=sks.Data[itemsPriceKey]
-		iprice,_:=strconv.Atoi(itemprice)
-		price+=itemCnt*iprice
 	}
-	sks.Data[orderKey]=composeOrderValue(false, price, num, cartDetail)
+	for key:=range v.dels{
+		sks.RawDel(key)
+	}
 	return nil
 }
 
-func (sks *ShoppingKVStore) PayOrder(args *PayOrderArgs, reply *int) error{
-	balanceKey := BalanceKeyPrefix + args.UserToken
-	rootBalanceKey := BalanceKeyPrefix + RootUserToken
-	orderKey := OrderKeyPrefix + args.OrderIDStr
-	*reply=OK
-	sks.RwLock.Lock()
-	defer sks.RwLock.Unlock()
-	orderValue:=sks.Data[orderKey]
-	hasPaid, price, num, detail := parseOrderValue(orderValue)
-	if hasPaid {
-		*reply= OrderPaid
+func (sks *ShoppingKVStore) SubmitOrder(args *SubmitOrderArgs, reply *SubmitOrderReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.SubmitOrder",time.Now(),&err)
+	txn,err:=newOrderTxn(args,reply)
+	if err!=nil{
+		reply.Status=MalformedValue
 		return nil
 	}
+	return sks.runTxn("SubmitOrder",args,txn)
+}
 
-	if value,existed:=sks.Data[balanceKey];existed{
-		iValue,_:=strconv.Atoi(value)
-		if iValue<args.Delta{
-			*reply=BalanceInsufficient
-			return nil
-		}else{
-			newValue:=strconv.Itoa(iValue-args.Delta)
-			sks.Data[balanceKey]=newValue
-		}
-	}
-	if value,existed:=sks.Data[rootBalanceKey];existed{
-		iValue,_:=strconv.Atoi(value)
-		newValue:=strconv.Itoa(iValue+args.Delta)
-		sks.Data[rootBalanceKey]=newValue
+func (sks *ShoppingKVStore) PayOrder(args *PayOrderArgs, reply *int) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.PayOrder",time.Now(),&err)
+	return sks.runTxn("PayOrder",args,&payTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) Credit(args *CreditArgs, reply *CreditReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.Credit",time.Now(),&err)
+	return sks.runTxn("Credit",args,&creditTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) CancelOrder(args *CancelOrderArgs, reply *int) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.CancelOrder",time.Now(),&err)
+	txn,err:=newCancelTxn(args,reply)
+	if err!=nil{
+		*reply=MalformedValue
+		return nil
 	}
-	newOrderValue := composeOrderValue(true, price, num, detail)
-	sks.Data[orderKey]=newOrderValue
-	return nil
+	return sks.runTxn("CancelOrder",args,txn)
+}
+
+func (sks *ShoppingKVStore) Watch(args *WatchArgs, reply *WatchReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.Watch",time.Now(),&err)
+	return sks.runTxn("Watch",args,&watchTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) PopWaitlist(args *PopWaitlistArgs, reply *PopWaitlistReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.PopWaitlist",time.Now(),&err)
+	return sks.runTxn("PopWaitlist",args,&popWaitlistTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) ReleaseReservation(args *ReleaseArgs, reply *int) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.ReleaseReservation",time.Now(),&err)
+	return sks.runTxn("ReleaseReservation",args,&releaseTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) TakeToken(args *RateLimitArgs, reply *RateLimitReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.TakeToken",time.Now(),&err)
+	return sks.runTxn("TakeToken",args,&rateTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) AdjustStock(args *StockArgs, reply *StockReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.AdjustStock",time.Now(),&err)
+	return sks.runTxn("AdjustStock",args,&stockTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) WaitingRoom(args *WaitingRoomArgs, reply *WaitingRoomReply) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.WaitingRoom",time.Now(),&err)
+	return sks.runTxn("WaitingRoom",args,&roomTxn{args:args,reply:reply})
+}
+
+func (sks *ShoppingKVStore) MigrateValue(args *MigrateArgs, reply *int) (err error){
+	defer sks.RecoverRPC("ShoppingKVStore.MigrateValue",time.Now(),&err)
+	return sks.runTxn("MigrateValue",args,&migrateTxn{args:args,reply:reply})
 }
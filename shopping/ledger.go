@@ -0,0 +1,247 @@
+package shopping
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"distributed-system/http"
+)
+
+// ExternalAccount is the ledger account of the money coming from outside
+// of the shop. The other accounts are the user tokens.
+const ExternalAccount = "external"
+
+// Kinds of the ledger entries, which are the first part of their IDs.
+const (
+	LedgerPayment = "pay"
+	LedgerCredit  = "credit" // by root
+	LedgerTopUp   = "topup"  // by the user through the PaymentProvider
+)
+
+// LedgerEntry records a movement of money from the Debit account to the
+// Credit account. It is written atomically with the balance changes.
+type LedgerEntry struct {
+	ID      string `json:"id"`
+	Debit   string `json:"debit"`
+	Credit  string `json:"credit"`
+	Amount  int    `json:"amount"`
+	OrderID string `json:"order_id,omitempty"`
+	// ExternalRef is the reference of the money outside of the shop,
+	// e.g. the charge ID of a top-up.
+	ExternalRef string `json:"external_ref,omitempty"`
+	Timestamp   int64  `json:"timestamp"` // unix milliseconds
+}
+
+type LedgerMismatch struct {
+	Account  string `json:"account"`
+	Expected int    `json:"expected"`
+	Actual   int    `json:"actual"`
+}
+
+type LedgerQueryJson struct {
+	UserID *int `json:"user_id"`
+}
+
+// ledgerEntryID is unique per kind and reference, which makes replaying
+// a movement write the same entry.
+func ledgerEntryID(kind, ref string) string {
+	return kind + ":" + ref
+}
+
+// ledgerAccountKey holds the copy of the entry listed by the ledger of the
+// account, which is read without scanning the others.
+func ledgerAccountKey(account, id string) string {
+	return LedgerAccountKeyPrefix + account + ":" + id
+}
+
+// ledgerKeys are the keys written by putLedgerEntry of the entry between
+// the accounts.
+func ledgerKeys(id string, accounts ...string) []string {
+	keys := []string{LedgerKeyPrefix + id}
+	for _, account := range accounts {
+		keys = append(keys, ledgerAccountKey(account, id))
+	}
+	return keys
+}
+
+// putLedgerEntry writes the entry, and its copies for the ledgers of its
+// accounts in the shop.
+func putLedgerEntry(v *txnView, entry *LedgerEntry) {
+	value := composeLedgerEntry(entry)
+	v.put(LedgerKeyPrefix+entry.ID, value)
+	for _, account := range []string{entry.Debit, entry.Credit} {
+		if account != ExternalAccount {
+			v.put(ledgerAccountKey(account, entry.ID), value)
+		}
+	}
+}
+
+func composeLedgerEntry(entry *LedgerEntry) string {
+	value, _ := json.Marshal(entry)
+	return string(value)
+}
+
+func parseLedgerEntry(value string) (entry LedgerEntry, err error) {
+	err = json.Unmarshal([]byte(value), &entry)
+	return
+}
+
+// verifyLedger replays the entries over the opening balances and returns
+// the accounts whose balance is not the replayed one.
+func verifyLedger(opening, balances map[string]int, entries []LedgerEntry) []LedgerMismatch {
+	expected := make(map[string]int, len(opening))
+	for account, balance := range opening {
+		expected[account] = balance
+	}
+	for _, entry := range entries {
+		if entry.Debit != ExternalAccount {
+			expected[entry.Debit] -= entry.Amount
+		}
+		if entry.Credit != ExternalAccount {
+			expected[entry.Credit] += entry.Amount
+		}
+	}
+	mismatches := []LedgerMismatch{}
+	for account, balance := range expected {
+		if balances[account] != balance {
+			mismatches = append(mismatches, LedgerMismatch{account, balance, balances[account]})
+		}
+	}
+	for account, balance := range balances {
+		if _, ok := expected[account]; !ok {
+			mismatches = append(mismatches, LedgerMismatch{account, 0, balance})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Account < mismatches[j].Account })
+	return mismatches
+}
+
+// loadLedger returns the entries of the account, or all the entries if
+// account is "", in the order of time.
+func (ss *ShopServer) loadLedger(account string) ([]LedgerEntry, error) {
+	prefix := LedgerKeyPrefix
+	if account != "" {
+		prefix = ledgerAccountKey(account, "")
+	}
+	reply, err := ss.ClientPool.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LedgerEntry, 0, len(reply.Data))
+	for _, value := range reply.Data {
+		entry, err := parseLedgerEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp < entries[j].Timestamp
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (ss *ShopServer) loadBalances(prefix string) (map[string]int, error) {
+	reply, err := ss.ClientPool.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]int, len(reply.Data))
+	for key, value := range reply.Data {
+		balances[key[len(prefix):]], _ = strconv.Atoi(value)
+	}
+	return balances, nil
+}
+
+// writeLedgerError replies 503 if the KV-Store failed, or 500 if the
+// ledger is unreadable.
+func writeLedgerError(resp *http.Response, err error) {
+	if _, ok := err.(*KVError); ok {
+		writeUnavailable(resp, err)
+		return
+	}
+	writeReply(resp, http.StatusInternalServerError, LEDGER_UNAVAILABLE_MSG)
+}
+
+func (ss *ShopServer) queryBalance(resp *http.Response, req *http.Request) {
+	exist, token, _ := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	reply, err := ss.ClientPool.Get(BalanceKeyPrefix + token)
+	if err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
+	balance, _ := strconv.Atoi(reply.Value)
+	resp.WriteStatus(http.StatusOK)
+	resp.Write([]byte("{\"user_id\":" + token + ",\"balance\":" + strconv.Itoa(balance) + "}"))
+}
+
+func (ss *ShopServer) queryLedger(resp *http.Response, req *http.Request) {
+	exist, token, _ := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	ss.writeLedger(resp, token)
+}
+
+func (ss *ShopServer) queryAllLedger(resp *http.Response, req *http.Request) {
+	exist, _, body := ss.authorize(resp, req, true)
+	if !exist {
+		return
+	}
+	var query LedgerQueryJson
+	if err := json.Unmarshal(body, &query); err != nil {
+		writeReply(resp, http.StatusBadRequest, MALFORMED_JSON_MSG)
+		return
+	}
+	account := ""
+	if query.UserID != nil {
+		account = userID2Token(*query.UserID)
+	}
+	ss.writeLedger(resp, account)
+}
+
+func (ss *ShopServer) writeLedger(resp *http.Response, account string) {
+	entries, err := ss.loadLedger(account)
+	if err != nil {
+		writeLedgerError(resp, err)
+		return
+	}
+	body, _ := json.Marshal(entries)
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(body)
+}
+
+// verifyLedger checks the current balances against the ledger. The data
+// is not read in one snapshot, so run it while no payment is going on.
+func (ss *ShopServer) verifyLedger(resp *http.Response, req *http.Request) {
+	if exist, _, _ := ss.authorize(resp, req, true); !exist {
+		return
+	}
+	entries, err := ss.loadLedger("")
+	var opening, balances map[string]int
+	if err == nil {
+		opening, err = ss.loadBalances(OpeningBalanceKeyPrefix)
+	}
+	if err == nil {
+		balances, err = ss.loadBalances(BalanceKeyPrefix)
+	}
+	if err != nil {
+		writeLedgerError(resp, err)
+		return
+	}
+	mismatches := verifyLedger(opening, balances, entries)
+	body, _ := json.Marshal(struct {
+		Consistent bool             `json:"consistent"`
+		Entries    int              `json:"entries"`
+		Mismatches []LedgerMismatch `json:"mismatches"`
+	}{len(mismatches) == 0, len(entries), mismatches})
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(body)
+}
@@ -0,0 +1,23 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestVerifyLedger(t *testing.T) {
+	opening := map[string]int{"0": 0, "1": 100, "2": 50}
+	entries := []LedgerEntry{
+		{ID: "pay:1", Debit: "1", Credit: "0", Amount: 30, OrderID: "1"},
+		{ID: "pay:2", Debit: "2", Credit: "0", Amount: 50, OrderID: "2"},
+	}
+	balances := map[string]int{"0": 80, "1": 70, "2": 0}
+	if mismatches := verifyLedger(opening, balances, entries); len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+
+	balances["1"] = 75
+	mismatches := verifyLedger(opening, balances, entries)
+	if len(mismatches) != 1 || mismatches[0] != (LedgerMismatch{"1", 70, 75}) {
+		t.Fatalf("wrong mismatches %v", mismatches)
+	}
+}
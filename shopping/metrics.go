@@ -0,0 +1,108 @@
+package shopping
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"distributed-system/http"
+	"rush-shopping/metrics"
+)
+
+// METRICS serves the metrics of the shop in the Prometheus text format.
+const METRICS = "/metrics"
+
+var (
+	httpRequests = metrics.NewCounterVec("shop_http_requests_total",
+		"The requests served by endpoint pattern and method.", "endpoint", "method")
+	httpDuration = metrics.NewHistogramVec("shop_http_request_duration_seconds",
+		"The latency of the requests by endpoint pattern.", metrics.DefBuckets, "endpoint")
+	errorReplies = metrics.NewCounterVec("shop_errors_total",
+		"The error replies by code, e.g. ITEM_OUT_OF_STOCK.", "code")
+	ordersCreated   = metrics.NewCounterVec("shop_orders_created_total", "The orders submitted.")
+	ordersPaid      = metrics.NewCounterVec("shop_orders_paid_total", "The orders paid.")
+	ordersCancelled = metrics.NewCounterVec("shop_orders_cancelled_total", "The orders cancelled.")
+)
+
+// observeRequest counts a request of the endpoint served since start.
+func observeRequest(pattern string, req *http.Request, start time.Time) {
+	httpRequests.Inc(pattern, req.Method)
+	httpDuration.Observe(time.Since(start).Seconds(), pattern)
+}
+
+// countError counts the code of an error reply, the body of which is
+// {"code": ..., "message": ...}.
+func countError(body []byte) {
+	var reply struct {
+		Code string `json:"code"`
+	}
+	if json.Unmarshal(body, &reply) != nil || reply.Code == "" {
+		reply.Code = "UNKNOWN"
+	}
+	errorReplies.Inc(reply.Code)
+}
+
+// writeReply writes the reply, and counts its code if it is an error.
+func writeReply(resp *http.Response, status int, body []byte) {
+	if status >= http.StatusBadRequest {
+		countError(body)
+	}
+	resp.WriteStatus(status)
+	resp.Write(body)
+}
+
+// newShopMetrics registers the gauges of the shop, which are its own
+// unlike the counters of the process.
+func (ss *ShopServer) newShopMetrics() *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.GaugeFunc("shop_users", "The normal users loaded.", func() float64 {
+		return float64(ss.MaxUserID)
+	})
+	r.GaugeFunc("shop_items", "The items in the catalog.", func() float64 {
+		ss.ItemLock.RLock()
+		defer ss.ItemLock.RUnlock()
+		return float64(ss.MaxItemID)
+	})
+	cp, ok := ss.ClientPool.(*clientspool)
+	if !ok {
+		return r
+	}
+	r.GaugeVecFunc("shop_kv_pool_connections", "The connections to the KV-Store by state.", "state",
+		func() map[string]float64 {
+			stats := cp.pool.Stats()
+			return map[string]float64{"active": float64(stats.Active), "idle": float64(stats.Idle)}
+		})
+	r.CounterFunc("shop_kv_pool_dials_total", "The connections dialed to the KV-Store.", func() float64 {
+		return float64(cp.pool.Stats().Dials)
+	})
+	r.CounterFunc("shop_kv_pool_waits_total", "The calls which waited for a connection.", func() float64 {
+		return float64(cp.pool.Stats().Waits)
+	})
+	r.GaugeFunc("shop_kv_circuit_open", "1 if the circuit to the KV-Store is open.", func() float64 {
+		if cp.breaker.open() {
+			return 1
+		}
+		return 0
+	})
+	return r
+}
+
+// adminSecretOf returns the admin secret sent with the request.
+func adminSecretOf(req *http.Request) string {
+	if secret := req.Header.Get("X-Admin-Secret"); secret != "" {
+		return secret
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+func (ss *ShopServer) serveMetrics(resp *http.Response, req *http.Request) {
+	// No secret set closes METRICS, as it does the admin API.
+	if ss.Options.AdminSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(adminSecretOf(req)), []byte(ss.Options.AdminSecret)) != 1 {
+		writeReply(resp, http.StatusUnauthorized, INVALID_ADMIN_SECRET_MSG)
+		return
+	}
+	resp.WriteStatus(http.StatusOK)
+	metrics.Write(resp, metrics.Default, ss.metrics)
+}
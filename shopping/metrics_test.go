@@ -0,0 +1,42 @@
+package shopping
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"rush-shopping/metrics"
+)
+
+func TestShopMetrics(t *testing.T) {
+	f := newFlakyKV()
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions(), MaxUserID: 2}
+	ss.ItemListCache = []Item{{ID: 0}, {ID: 1, Price: 10, Stock: 5}}
+	ss.MaxItemID = 1
+	f.sks.Put(CartIDMaxKey, "1")
+	f.sks.Put(getCartKey("1", "1"), "1.1:1")
+	f.sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	f.sks.Put(ItemsStockKeyPrefix+"1", "5")
+	f.sks.Put(BalanceKeyPrefix+"1", "5")
+	f.sks.Put(TokenKeyPrefix+"1", "1")
+
+	created, paid := ordersCreated.Value(), ordersPaid.Value()
+	if status, msg := ss.doSubmitOrder("1", []byte(`{"cart_id":"1"}`)); status != http.StatusOK {
+		t.Fatalf("doSubmitOrder = %v, %s", status, msg)
+	}
+	status, msg := ss.doPayOrder("1", []byte(`{"order_id":"1"}`))
+	if status != http.StatusForbidden {
+		t.Fatalf("doPayOrder = %v, %s", status, msg)
+	}
+	// The error replies are counted by writeReply, see tests/test_metrics.py.
+	if ordersCreated.Value() != created+1 || ordersPaid.Value() != paid {
+		t.Fatalf("orders created %d, paid %d", ordersCreated.Value()-created, ordersPaid.Value()-paid)
+	}
+
+	var buf bytes.Buffer
+	metrics.Write(&buf, ss.newShopMetrics())
+	if !strings.Contains(buf.String(), "\nshop_items 1\n") {
+		t.Fatalf("no shop_items in\n%s", buf.String())
+	}
+}
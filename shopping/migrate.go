@@ -0,0 +1,118 @@
+package shopping
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"distributed-system/http"
+)
+
+// MigrateArgs rewrites the cart or order at Key in ValueSchemaV1, if it is
+// still Value as read before.
+type MigrateArgs struct {
+	Key   string
+	Value string
+}
+
+type migrateTxn struct {
+	args  *MigrateArgs
+	reply *int
+}
+
+func (t *migrateTxn) keys() []string {
+	return []string{t.args.Key}
+}
+
+func (t *migrateTxn) run(v *txnView) {
+	if value, existed := v.get(t.args.Key); !existed || value != t.args.Value {
+		*t.reply = RequestConflict
+		return
+	}
+	migrated, err := migrateValue(t.args.Key, t.args.Value)
+	if err != nil {
+		*t.reply = MalformedValue
+		return
+	}
+	*t.reply = OK
+	if migrated != t.args.Value {
+		v.put(t.args.Key, migrated)
+	}
+}
+
+// migrateValue encodes the cart or order value at key in ValueSchemaV1.
+func migrateValue(key, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(key, CartKeyPrefix):
+		cart, err := decodeCart(value)
+		if err != nil {
+			return "", err
+		}
+		cart.Schema = ValueSchemaV1
+		return cart.encode(), nil
+	case strings.HasPrefix(key, OrderKeyPrefix):
+		order, err := decodeOrder(value)
+		if err != nil {
+			return "", err
+		}
+		order.Schema = ValueSchemaV1
+		return order.encode(), nil
+	}
+	return "", errors.New("not a cart or order: " + key)
+}
+
+// MigrateReport counts the values seen by a migration.
+type MigrateReport struct {
+	Migrated  int      `json:"migrated"`
+	Current   int      `json:"current"`   // already in ValueSchemaV1
+	Conflicts int      `json:"conflicts"` // changed meanwhile, to migrate again
+	Malformed []string `json:"malformed,omitempty"`
+}
+
+// migrateValues rewrites the legacy carts and orders in ValueSchemaV1.
+// Run it once no shop writes the legacy values, as the shops before
+// ValueSchema can't read the others.
+func (ss *ShopServer) migrateValues() (report MigrateReport, err error) {
+	for _, prefix := range []string{CartKeyPrefix, OrderKeyPrefix} {
+		reply, err := ss.ClientPool.Scan(prefix)
+		if err != nil {
+			return report, err
+		}
+		for key, value := range reply.Data {
+			if schemaOf(value) == ValueSchemaV1 {
+				report.Current++
+				continue
+			}
+			status, err := ss.ClientPool.MigrateValue(&MigrateArgs{Key: key, Value: value})
+			switch {
+			case err != nil:
+				return report, err
+			case status == OK:
+				report.Migrated++
+			case status == MalformedValue:
+				log.Printf("Migrate %s error: malformed value %q\n", key, value)
+				report.Malformed = append(report.Malformed, key)
+			default:
+				report.Conflicts++
+			}
+		}
+	}
+	return report, nil
+}
+
+// migrate serves POST /admin/migrate, which rewrites the legacy carts and
+// orders in ValueSchemaV1.
+func (ss *ShopServer) migrate(resp *http.Response, req *http.Request) {
+	if exist, _, _ := ss.authorize(resp, req, true); !exist {
+		return
+	}
+	report, err := ss.migrateValues()
+	if err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
+	body, _ := json.Marshal(report)
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(body)
+}
@@ -0,0 +1,93 @@
+package shopping
+
+import (
+	"fmt"
+	"time"
+)
+
+// PricePolicy decides the unit prices charged by an order, when the price
+// of an item changes between adding it to the cart and the checkout.
+type PricePolicy int
+
+const (
+	// PriceAtCheckout charges the prices at the checkout, and reports
+	// the difference to the prices when the items were added.
+	PriceAtCheckout PricePolicy = iota
+	// PriceAtCart charges the prices captured when the items were added.
+	PriceAtCart
+)
+
+// ParsePricePolicy parses "checkout" or "cart". "" is PriceAtCheckout.
+func ParsePricePolicy(s string) (PricePolicy, error) {
+	switch s {
+	case "", "checkout":
+		return PriceAtCheckout, nil
+	case "cart":
+		return PriceAtCart, nil
+	}
+	return 0, fmt.Errorf("unknown price policy %q", s)
+}
+
+// Clock tells the time of the shop, e.g. to check the sale windows. Tests
+// may stub it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+// ShopOptions are the tunables of a ShopServer.
+type ShopOptions struct {
+	PricePolicy PricePolicy
+	Clock       Clock
+	// AdmitRate is the checkouts admitted per second by the waiting room,
+	// which is off if it isn't positive. The room is kept in the KV-Store
+	// and shared by the shops, so give them all the same rate.
+	AdmitRate    int
+	AdmissionTTL time.Duration
+	// RateLimits by the patterns of the endpoints, e.g. CREATE_CART.
+	RateLimits map[string]EndpointLimit
+	// Notifier tells the waitlisted users of restocks, which are kept on
+	// the waitlists if it is nil. A unit is reserved for each user notified
+	// for ReservationTTL if it is positive.
+	Notifier       RestockNotifier
+	ReservationTTL time.Duration
+	// StreamAddr serves STREAM_STOCK if it isn't "".
+	StreamAddr string
+	// ValueSchema encodes the new carts, and the orders of them. Keep it
+	// ValueSchemaLegacy, the default, while any shop of an older version
+	// is running, and switch to ValueSchemaV1 once none is. The legacy
+	// values can't hold the prices captured or the coupons: PriceAtCart
+	// charges the current prices, and a cancelled order keeps its coupon
+	// used.
+	ValueSchema ValueSchema
+	// KVTimeout bounds a call to the KV-Store, DefaultTxnTimeoutMS if
+	// it isn't positive. The transactions are given txnTimeoutFactor times
+	// longer, as they wait for the locks.
+	KVTimeout time.Duration
+	// PaymentProvider charges the top-ups, which are refused if it is nil.
+	PaymentProvider PaymentProvider
+	// AdminSecret guards METRICS, as it does the admin API of the
+	// KV-Stores, by the X-Admin-Secret or Authorization: Bearer header.
+	// METRICS is refused if it is empty.
+	AdminSecret string
+}
+
+func DefaultShopOptions() ShopOptions {
+	return ShopOptions{PricePolicy: PriceAtCheckout, Clock: SystemClock,
+		AdmissionTTL: DefaultAdmissionTTL, ValueSchema: ValueSchemaLegacy}
+}
+
+// nowMs returns the unix milliseconds by the clock of the shop.
+func (ss *ShopServer) nowMs() int64 {
+	clock := ss.Options.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	return clock.Now().UnixNano() / int64(time.Millisecond)
+}
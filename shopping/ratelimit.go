@@ -0,0 +1,143 @@
+package shopping
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-system/http"
+)
+
+// RateLimit is a token bucket refilled at Rate tokens per second up to
+// Burst tokens. A zero Rate doesn't limit.
+type RateLimit struct {
+	Rate  int
+	Burst int
+}
+
+// EndpointLimit limits the requests to an endpoint per access token and
+// per client IP.
+type EndpointLimit struct {
+	PerToken RateLimit
+	PerIP    RateLimit
+}
+
+// RateLimitArgs takes a token from the bucket at Key. The buckets live in
+// the KV-Store, so that all the shops share the limits.
+type RateLimitArgs struct {
+	Key   string
+	Rate  int
+	Burst int
+	Now   int64 // unix milliseconds
+}
+
+type RateLimitReply struct {
+	Allowed      bool
+	RetryAfterMs int64
+}
+
+// rateTxn refills the bucket for the time passed and takes a token. The
+// bucket is kept in milli-tokens with the time of the last refill.
+// 2500|1500000000000
+type rateTxn struct {
+	args  *RateLimitArgs
+	reply *RateLimitReply
+}
+
+func (t *rateTxn) keys() []string {
+	return []string{t.args.Key}
+}
+
+func (t *rateTxn) run(v *txnView) {
+	if t.args.Rate <= 0 {
+		// Like RateLimit, a bucket which never refills doesn't limit.
+		t.reply.Allowed = true
+		return
+	}
+	full := int64(t.args.Burst) * 1000
+	tokens, last := full, t.args.Now
+	if value, existed := v.get(t.args.Key); existed {
+		info := strings.Split(value, "|")
+		if len(info) == 2 {
+			tokens, _ = strconv.ParseInt(info[0], 10, 64)
+			last, _ = strconv.ParseInt(info[1], 10, 64)
+		}
+	}
+	if elapsed := t.args.Now - last; elapsed > 0 {
+		tokens += elapsed * int64(t.args.Rate)
+		last = t.args.Now
+	}
+	if tokens > full {
+		tokens = full
+	}
+	if tokens >= 1000 {
+		tokens -= 1000
+		t.reply.Allowed = true
+	} else {
+		t.reply.RetryAfterMs = (1000 - tokens + int64(t.args.Rate) - 1) / int64(t.args.Rate)
+	}
+	// An idle bucket is full again, so it's dropped by then.
+	ttl := time.Duration(full/int64(t.args.Rate))*time.Millisecond + time.Second
+	v.putTTL(t.args.Key, strconv.FormatInt(tokens, 10)+"|"+strconv.FormatInt(last, 10), ttl)
+}
+
+// endpointLimit finds the limit of the endpoint serving path, matched
+// like the handlers: exactly, or by the longest pattern ending with "/".
+func (ss *ShopServer) endpointLimit(path string) (pattern string, limit EndpointLimit, ok bool) {
+	if limit, ok = ss.Options.RateLimits[path]; ok {
+		return path, limit, true
+	}
+	for p, l := range ss.Options.RateLimits {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(pattern) {
+			pattern, limit, ok = p, l, true
+		}
+	}
+	return
+}
+
+// takeToken replies 429 if the bucket of id for the endpoint is empty, or
+// 503 if the KV-Store holding it can't be reached.
+func (ss *ShopServer) takeToken(resp *http.Response, pattern, id string, limit RateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	args := &RateLimitArgs{Key: RateLimitKeyPrefix + pattern + ":" + id,
+		Rate: limit.Rate, Burst: burst, Now: ss.nowMs()}
+	reply, err := ss.ClientPool.TakeToken(args)
+	if err != nil {
+		writeUnavailable(resp, err)
+		return false
+	}
+	if !reply.Allowed {
+		writeReply(resp, http.StatusTooManyRequests, TOO_MANY_REQUESTS_MSG)
+		return false
+	}
+	return true
+}
+
+// limitIP tells whether the request is within the limit of its client IP.
+func (ss *ShopServer) limitIP(resp *http.Response, req *http.Request) bool {
+	pattern, limit, ok := ss.endpointLimit(req.URL.Path)
+	if !ok {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return ss.takeToken(resp, pattern, "ip:"+ip, limit.PerIP)
+}
+
+// limitToken tells whether the request is within the limit of the user.
+func (ss *ShopServer) limitToken(resp *http.Response, req *http.Request, token string) bool {
+	pattern, limit, ok := ss.endpointLimit(req.URL.Path)
+	if !ok {
+		return true
+	}
+	return ss.takeToken(resp, pattern, "token:"+token, limit.PerToken)
+}
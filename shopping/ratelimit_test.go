@@ -0,0 +1,36 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestTakeToken(t *testing.T) {
+	sks := NewShoppingKVStore()
+	take := func(now int64) RateLimitReply {
+		var reply RateLimitReply
+		sks.TakeToken(&RateLimitArgs{Key: RateLimitKeyPrefix + "k", Rate: 2, Burst: 2, Now: now}, &reply)
+		return reply
+	}
+	for i := 0; i < 2; i++ {
+		if reply := take(1000); !reply.Allowed {
+			t.Fatalf("request %d within the burst isn't allowed", i)
+		}
+	}
+	if reply := take(1000); reply.Allowed || reply.RetryAfterMs != 500 {
+		t.Fatalf("request beyond the burst got %v; expected to retry after 500ms", reply)
+	}
+	if reply := take(1250); reply.Allowed || reply.RetryAfterMs != 250 {
+		t.Fatalf("request got %v; expected to retry after 250ms", reply)
+	}
+	if reply := take(1500); !reply.Allowed {
+		t.Fatal("refilled token isn't allowed")
+	}
+	if !sks.Expire(RateLimitKeyPrefix+"k", 0) {
+		t.Fatal("bucket isn't stored")
+	}
+
+	var reply RateLimitReply
+	if err := sks.TakeToken(&RateLimitArgs{Key: RateLimitKeyPrefix + "z", Burst: 1, Now: 1000}, &reply); err != nil || !reply.Allowed {
+		t.Fatalf("TakeToken at a zero rate = %v, %v; expected allowed", reply, err)
+	}
+}
@@ -0,0 +1,46 @@
+package shopping
+
+import (
+	"encoding/json"
+	"time"
+
+	"distributed-system/http"
+	"rush-shopping/kv"
+)
+
+type handlerFunc func(resp *http.Response, req *http.Request)
+
+// recoverHandler replies 500 with the ID of the request in the log if the
+// handler panics, instead of bringing the shop down. It counts the
+// requests of the pattern too.
+func recoverHandler(pattern string, handler handlerFunc) handlerFunc {
+	return func(resp *http.Response, req *http.Request) {
+		defer observeRequest(pattern, req, time.Now())
+		defer recoverReply(req.Method+" "+pattern, func(status int, body []byte) {
+			writeReply(resp, status, body)
+		})
+		handler(resp, req)
+	}
+}
+
+// recoverReply is deferred by recoverHandler to reply the panic of the
+// request where.
+func recoverReply(where string, reply func(status int, body []byte)) {
+	if r := recover(); r != nil {
+		reply(internalError(kv.Recovered(where, r)))
+	}
+}
+
+func internalError(requestID string) (int, []byte) {
+	body, _ := json.Marshal(struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}{"INTERNAL_ERROR", "服务器内部错误", requestID})
+	return http.StatusInternalServerError, body
+}
+
+// handle serves the pattern by the handler, recovering from its panics.
+func (ss *ShopServer) handle(pattern string, handler handlerFunc) {
+	ss.server.AddHandlerFunc(pattern, recoverHandler(pattern, handler))
+}
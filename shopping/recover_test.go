@@ -0,0 +1,41 @@
+package shopping
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"rush-shopping/kv"
+)
+
+func TestRecoverHandler(t *testing.T) {
+	var status int
+	var body []byte
+	reply := func(s int, b []byte) { status, body = s, b }
+
+	panics := kv.Panics()
+	func() {
+		defer recoverReply("GET /items", reply)
+		var stocks map[int]int
+		stocks[1]++
+	}()
+	var internal struct {
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(body, &internal); err != nil || status != http.StatusInternalServerError ||
+		internal.Code != "INTERNAL_ERROR" || internal.RequestID == "" {
+		t.Fatalf("reply of the panic = %v, %s", status, body)
+	}
+	if kv.Panics() != panics+1 {
+		t.Fatalf("%d panics counted; expected 1", kv.Panics()-panics)
+	}
+
+	status = 0
+	func() {
+		defer recoverReply("GET /items", reply)
+	}()
+	if status != 0 {
+		t.Fatalf("replied %v without a panic", status)
+	}
+}
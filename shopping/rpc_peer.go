@@ -0,0 +1,92 @@
+package shopping
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var ErrRPCTimeout = errors.New("rpc timeout")
+
+// rpcPeer is an RPC connection dialed on the first call and redialed
+// after it is broken. The calls fail fast with ErrCircuitOpen while the
+// peer is down. It is safe for concurrent use.
+type rpcPeer struct {
+	network string
+	addr    string
+	breaker *circuitBreaker
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func newRPCPeer(network, addr string) *rpcPeer {
+	return &rpcPeer{network: network, addr: addr,
+		breaker: newCircuitBreaker(BreakerFailures, BreakerCooldown, SystemClock)}
+}
+
+func (p *rpcPeer) getClient() (*rpc.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		client, err := rpc.Dial(p.network, p.addr)
+		if err != nil {
+			return nil, err
+		}
+		p.client = client
+	}
+	return p.client, nil
+}
+
+// resetClient drops the broken client, unless it has been replaced.
+func (p *rpcPeer) resetClient(client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == client {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// call invokes the method and waits for at most timeout. The reply must
+// not be used if an error is returned.
+func (p *rpcPeer) call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	if !p.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	err := p.callClient(method, args, reply, timeout)
+	// the peer is up if the method failed on it
+	_, isServerErr := err.(rpc.ServerError)
+	p.breaker.done(err == nil || isServerErr)
+	return err
+}
+
+func (p *rpcPeer) callClient(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client, err := p.getClient()
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = ErrRPCTimeout
+	}
+	if _, isServerErr := err.(rpc.ServerError); err != nil && !isServerErr && err != ErrRPCTimeout {
+		p.resetClient(client)
+	}
+	return err
+}
+
+func (p *rpcPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
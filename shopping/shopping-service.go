@@ -19,9 +19,10 @@ import(
 	"distributed-system/http"
 	"os"
 	"rush-shopping/kv"
+	"rush-shopping/metrics"
 	"strconv"
 	"strings"
-	//"sync"
+	"sync"
 	"time"
 )
 //url of API
@@ -33,17 +34,51 @@ const (
 	SUBMIT_OR_QUERY_ORDER = "/orders"
 	PAY_ORDER             = "/pay"
 	QUERY_ALL_ORDERS      = "/admin/orders"
+	QUERY_BALANCE         = "/balance"
+	QUERY_LEDGER          = "/ledger"
+	QUERY_ALL_LEDGER      = "/admin/ledger"
+	VERIFY_LEDGER         = "/admin/ledger/verify"
+	ADMIN_CREDIT          = "/admin/credit"
+	TOP_UP                = "/balance/topup"
+	ADMIN_ITEMS           = "/admin/items"
+	ADMIN_ITEM            = "/admin/items/"
+	ADMIN_COUPONS         = "/admin/coupons"
+	ADMIN_MIGRATE         = "/admin/migrate"
+	QUEUE_STATUS          = "/queue"
+	WATCH_ITEM            = "/items/"
+	CANCEL_ORDER          = "/orders/cancel"
+	STREAM_STOCK          = "/items/stream" // served on ShopOptions.StreamAddr
 )
 // Keys of kvstore
 const (
 	TokenKeyPrefix      = "token:"
 	OrderKeyPrefix      = "order:"
+	CartKeyPrefix       = "cart:" // cart:<id>:<token>
 	ItemsStockKeyPrefix = "items_stock:"
 	ItemsPriceKeyPrefix = "items_price:"
 	BalanceKeyPrefix    = "balance:"
+	LedgerKeyPrefix     = "ledger:"
+	LedgerAccountKeyPrefix = "ledger_account:" // ledger_account:<account>:<id> is a copy of the entry, see putLedgerEntry
+	// The balances loaded from users.csv, where the ledger starts from.
+	OpeningBalanceKeyPrefix = "balance_init:"
+	IdempotencyKeyPrefix    = "idem:"
+	ItemsRetiredKeyPrefix   = "items_retired:"
+	CatalogLogKeyPrefix     = "catalog_log:" // catalog_log:<version> is the changed item ID
+	ItemsSaleKeyPrefix      = "items_sale:" // items_sale:<id> is the sale window, see composeSaleValue
+	CouponKeyPrefix         = "coupon:"
+	CouponUsedKeyPrefix     = "coupon_used:" // coupon_used:<code>[:<token>] counts the redemptions
+	WaitlistKeyPrefix       = "waitlist:"    // waitlist:<id> is the ends of the waitlist, see composeWaitlist
+	WaitlistEntryKeyPrefix  = "waitlist_entry:" // waitlist_entry:<id>:<seq> is the token waiting
+	WaitlistUserKeyPrefix   = "waitlist_user:"  // waitlist_user:<id>:<token> is the seq of the user
+	ReservationKeyPrefix    = "reservation:" // reservation:<id>:<token>, see composeReservation
+	ReservationExpiryKeyPrefix = "reservation_expiry:" // reservation_expiry:<bucket>, see reservationBucket
+	RateLimitKeyPrefix      = "ratelimit:"   // ratelimit:<endpoint>:ip:<ip> or ratelimit:<endpoint>:token:<token>
+	TicketKeyPrefix         = "ticket:"      // ticket:<token> is the ticket in the waiting room, see roomTxn
 
 	CartIDMaxKey = "cartID"
 	ItemsSizeKey = "items_size"
+	CatalogVersionKey = "catalog_version"
+	WaitingRoomKey = "waiting_room"
 )
 
 const RootUserID = 0
@@ -56,6 +91,16 @@ const (
 	OrderOutOfLimit = 2
 	OrderPaid=3
 	BalanceInsufficient =4
+	RequestConflict = 5
+	ItemRetired = 6
+	CouponNotFound = 7
+	CouponExpired = 8
+	CouponMinSpend = 9
+	CouponExhausted = 10
+	ItemNotOnSale = 11
+	OrderNotFound = 12
+	MalformedValue = 13 // a cart or order value can't be decoded
+	UserNotFound = 14
 )
 const (
 	OrderPaidFlag   = "P" // have been paid
@@ -80,37 +125,107 @@ var (
 	NOT_AUTHORIZED_ORDER_MSG = []byte("{\"code\": \"NOT_AUTHORIZED_TO_ACCESS_ORDER\",\"message\": \"无权限访问指定的订单\"}")
 	ORDER_PAID_MSG           = []byte("{\"code\": \"ORDER_PAID\",\"message\": \"订单已支付\"}")
 	BALANCE_INSUFFICIENT_MSG = []byte("{\"code\": \"BALANCE_INSUFFICIENT\",\"message\": \"余额不足\"}")
+	LEDGER_UNAVAILABLE_MSG   = []byte("{\"code\": \"LEDGER_UNAVAILABLE\",\"message\": \"账本读取失败\"}")
+	INVALID_CREDIT_MSG       = []byte("{\"code\": \"INVALID_CREDIT\",\"message\": \"充值金额或请求ID无效\"}")
+	USER_NOT_FOUND_MSG       = []byte("{\"code\": \"USER_NOT_FOUND\",\"message\": \"用户不存在\"}")
+	REQUEST_CONFLICT_MSG     = []byte("{\"code\": \"REQUEST_CONFLICT\",\"message\": \"请求ID已被其他请求使用\"}")
+	TOPUP_UNAVAILABLE_MSG    = []byte("{\"code\": \"TOPUP_UNAVAILABLE\",\"message\": \"充值服务不可用\"}")
+	PAYMENT_FAILED_MSG       = []byte("{\"code\": \"PAYMENT_FAILED\",\"message\": \"支付渠道扣款失败\"}")
+	INVALID_ITEM_MSG         = []byte("{\"code\": \"INVALID_ITEM\",\"message\": \"物品价格或库存无效\"}")
+	IDEMPOTENCY_IN_PROGRESS_MSG = []byte("{\"code\": \"IDEMPOTENCY_IN_PROGRESS\",\"message\": \"相同幂等键的请求正在处理\"}")
+	INVALID_ADMIN_SECRET_MSG = []byte("{\"code\": \"INVALID_ADMIN_SECRET\",\"message\": \"无效的管理密钥\"}")
+	IDEMPOTENCY_KEY_REUSED_MSG  = []byte("{\"code\": \"IDEMPOTENCY_KEY_REUSED\",\"message\": \"幂等键已用于其他请求\"}")
+	ITEM_NOT_ON_SALE_MSG     = []byte("{\"code\": \"ITEM_NOT_ON_SALE\",\"message\": \"物品不在销售时间内\"}")
+	TOO_MANY_REQUESTS_MSG    = []byte("{\"code\": \"TOO_MANY_REQUESTS\",\"message\": \"请求过于频繁\"}")
+	TICKET_NOT_FOUND_MSG     = []byte("{\"code\": \"TICKET_NOT_FOUND\",\"message\": \"排队号不存在\"}")
+	INVALID_COUPON_MSG       = []byte("{\"code\": \"INVALID_COUPON\",\"message\": \"优惠券设置无效\"}")
+	COUPON_NOT_FOUND_MSG     = []byte("{\"code\": \"COUPON_NOT_FOUND\",\"message\": \"优惠券不存在\"}")
+	COUPON_EXPIRED_MSG       = []byte("{\"code\": \"COUPON_EXPIRED\",\"message\": \"优惠券已过期\"}")
+	COUPON_MIN_SPEND_MSG     = []byte("{\"code\": \"COUPON_MIN_SPEND_NOT_MET\",\"message\": \"未达到优惠券最低消费\"}")
+	DATA_CORRUPTED_MSG       = []byte("{\"code\": \"DATA_CORRUPTED\",\"message\": \"数据无法解析\"}")
+	SERVICE_UNAVAILABLE_MSG  = []byte("{\"code\": \"SERVICE_UNAVAILABLE\",\"message\": \"服务暂时不可用，请稍后重试\"}")
+	COUPON_EXHAUSTED_MSG     = []byte("{\"code\": \"COUPON_EXHAUSTED\",\"message\": \"优惠券已达使用上限\"}")
 )
 
 type ShopServer struct {
 	server    *http.Server
 	rootToken string
 
-	ClientPool *clientspool 
+	ClientPool kvClient
+	Options    ShopOptions
+	// PaymentProvider charges the top-ups, see ShopOptions.
+	PaymentProvider PaymentProvider
+	waitingRoom     *waitingRoom // nil if the checkouts aren't queued
+	stockHub        *stockHub    // nil if the stock isn't streamed
 
 	// resident memory
 	ItemListCache  []Item // real item start from index 1
-	//ItemLock       sync.Mutex
+	ItemLock       sync.RWMutex // guards the item caches and MaxItemID
 	ItemsJSONCache []byte
 	UserMap        map[string]UserIDAndPass // map[name]password
 	MaxItemID      int                      // The same with the number of types of items.
 	MaxUserID      int                      // The same with the number of normal users.
+
+	catalogMu      sync.Mutex
+	catalogVersion int // the last catalog version synced
+
+	metrics *metrics.Registry // served on METRICS with metrics.Default
 }
 
 const DefaultClientPoolMaxSize = 100
 
+// LoadBatchSize is the keys put by a call when loading the data.
+const LoadBatchSize = 1000
+
+// LoadMaxBackoff caps the wait before loading the data again.
+const LoadMaxBackoff = 5*time.Second
+
 func InitService(network,appAddr,kvstoreAddr,userCsv,itemCsv string) *ShopServer{
+	return InitServiceWithOptions(network,appAddr,kvstoreAddr,userCsv,itemCsv,DefaultShopOptions())
+}
+
+func InitServiceWithOptions(network,appAddr,kvstoreAddr,userCsv,itemCsv string,opts ShopOptions) *ShopServer{
 	ss := new(ShopServer)
-	ss.ClientPool = NewClientpools(network,kvstoreAddr,DefaultClientPoolMaxSize)
+	ss.Options = opts
+	ss.PaymentProvider = opts.PaymentProvider
+	ss.ClientPool = NewClientpoolsWithTimeout(network,kvstoreAddr,DefaultClientPoolMaxSize,opts.KVTimeout)
+	if opts.AdmitRate > 0 {
+		if opts.Clock == nil {
+			opts.Clock = SystemClock
+		}
+		ss.waitingRoom = newWaitingRoom(ss.ClientPool, opts.AdmitRate, opts.AdmissionTTL, opts.Clock)
+	}
 	ss.loadUsersAndItems(userCsv, itemCsv)
 
 	ss.server=http.NewServer(appAddr)
-	ss.server.AddHandlerFunc(LOGIN, ss.login)
-	ss.server.AddHandlerFunc(QUERY_ITEM, ss.queryItem)
-	ss.server.AddHandlerFunc(CREATE_CART, ss.createCart)
-	ss.server.AddHandlerFunc(Add_ITEM, ss.addItem)
-	ss.server.AddHandlerFunc(SUBMIT_OR_QUERY_ORDER, ss.orderProcess)
-	ss.server.AddHandlerFunc(PAY_ORDER, ss.payOrder)
+	ss.handle(LOGIN, ss.login)
+	ss.handle(QUERY_ITEM, ss.queryItem)
+	ss.handle(CREATE_CART, ss.createCart)
+	ss.handle(Add_ITEM, ss.addItem)
+	ss.handle(SUBMIT_OR_QUERY_ORDER, ss.orderProcess)
+	ss.handle(PAY_ORDER, ss.payOrder)
+	ss.handle(QUERY_BALANCE, ss.queryBalance)
+	ss.handle(QUERY_LEDGER, ss.queryLedger)
+	ss.handle(QUERY_ALL_LEDGER, ss.queryAllLedger)
+	ss.handle(VERIFY_LEDGER, ss.verifyLedger)
+	ss.handle(ADMIN_CREDIT, ss.adminCredit)
+	ss.handle(TOP_UP, ss.topUp)
+	ss.handle(ADMIN_ITEMS, ss.createItem)
+	ss.handle(ADMIN_ITEM, ss.manageItem)
+	ss.handle(ADMIN_COUPONS, ss.saveCoupon)
+	ss.handle(ADMIN_MIGRATE, ss.migrate)
+	ss.handle(QUEUE_STATUS, ss.queryTicket)
+	ss.handle(WATCH_ITEM, ss.watchItem)
+	ss.handle(CANCEL_ORDER, ss.cancelOrder)
+	ss.metrics = ss.newShopMetrics()
+	ss.handle(METRICS, ss.serveMetrics)
+	go ss.pollCatalog()
+	if opts.ReservationTTL > 0 {
+		go ss.sweepReservations()
+	}
+	if opts.StreamAddr != "" {
+		ss.serveStream(opts.StreamAddr)
+	}
 
 	log.Printf("Start shopping service on %s\n", appAddr)
 	go func() {
@@ -136,7 +251,47 @@ func (ss *ShopServer) loadUsersAndItems(userCsv, itemCsv string) {
 	defer func() {
 		log.Printf("Finished data loading, cost %v ms\n", time.Since(now).Nanoseconds()/int64(time.Millisecond))
 	}()
-	ss.ClientPool.Put(CartIDMaxKey, "0")
+	// The shop can't serve without the data, so it waits for the
+	// KV-Store. Loading the same data again is harmless.
+	must := func(call func() error) {
+		backoff := KVRetryBackoff
+		for err := call(); err != nil; err = call() {
+			log.Printf("Load data to kvstore error: %v, retry in %v\n", err, backoff)
+			time.Sleep(backoff)
+			if backoff < LoadMaxBackoff {
+				backoff *= 2
+			}
+		}
+	}
+	must(func() error {
+		_, err := ss.ClientPool.PutNX(CartIDMaxKey, "0", 0)
+		return err
+	})
+	// Put the data in batches of LoadBatchSize, not key by key.
+	var ops []kv.BatchOp
+	flush := func() {
+		if len(ops) > 0 {
+			must(func() error {
+				reply, err := ss.ClientPool.Batch(ops)
+				if err != nil {
+					return err
+				}
+				for i, e := range reply.Errors {
+					if e != "" {
+						return fmt.Errorf("%s %s: %s", ops[i].Op, ops[i].Key, e)
+					}
+				}
+				return nil
+			})
+			ops = ops[:0]
+		}
+	}
+	write := func(op, key, value string) {
+		ops = append(ops, kv.BatchOp{Op: op, Key: key, Value: value})
+		if len(ops) == LoadBatchSize {
+			flush()
+		}
+	}
 	ss.ItemListCache = make([]Item, 1, 512)
 	ss.ItemListCache[0] = Item{ID: 0}
 	
@@ -148,7 +303,9 @@ func (ss *ShopServer) loadUsersAndItems(userCsv, itemCsv string) {
 			userID, _ := strconv.Atoi(strs[0])
 			ss.UserMap[strs[1]] = UserIDAndPass{userID, strs[2]}
 			userToken := userID2Token(userID)
-			ss.ClientPool.Put(BalanceKeyPrefix+userToken, strs[3])
+			// A restart mustn't undo the payments in the ledger.
+			write(kv.OpPutNX, BalanceKeyPrefix+userToken, strs[3])
+			write(kv.OpPutNX, OpeningBalanceKeyPrefix+userToken, strs[3])
 			if userID > ss.MaxUserID {
 				ss.MaxUserID = userID
 			}
@@ -158,66 +315,85 @@ func (ss *ShopServer) loadUsersAndItems(userCsv, itemCsv string) {
 		panic(err.Error())
 	}
 	ss.rootToken = userID2Token(ss.UserMap["root"].ID)
-	// read items
-	itemCnt := 0
-	if file, err := os.Open(itemCsv); err == nil {
+	flush()
+	// The items are only seeded from the CSV by the first shop, as the
+	// catalog may have been changed since.
+	var seeded bool
+	must(func() error {
+		reply, err := ss.ClientPool.Get(ItemsSizeKey)
+		seeded = reply.Flag
+		return err
+	})
+	if file, err := os.Open(itemCsv); err != nil {
+		panic(err.Error())
+	} else if !seeded {
+		itemCnt := 0
 		reader := csv.NewReader(file)
 		for strs, err := reader.Read(); err == nil; strs, err = reader.Read() {
 			itemCnt++
-			itemID, _ := strconv.Atoi(strs[0])
-			price, _ := strconv.Atoi(strs[1])
-			stock, _ := strconv.Atoi(strs[2])
-			ss.ItemListCache = append(ss.ItemListCache, Item{ID: itemID, Price: price, Stock: stock})
-
-			ss.ClientPool.Put(ItemsPriceKeyPrefix+strs[0], strs[1])
-			ss.ClientPool.Put(ItemsStockKeyPrefix+strs[0], strs[2])
-
-			if itemID > ss.MaxItemID {
-				ss.MaxItemID = itemID
-			}
+			write(kv.OpPutNX, ItemsPriceKeyPrefix+strs[0], strs[1])
+			write(kv.OpPutNX, ItemsStockKeyPrefix+strs[0], strs[2])
 		}
-		ss.ItemsJSONCache, _ = json.Marshal(ss.ItemListCache[1:])
-		ss.ClientPool.Put(ItemsSizeKey, strconv.Itoa(itemCnt))
-
+		flush()
+		// Last, so that the items are complete once the size is seen.
+		must(func() error {
+			_, err := ss.ClientPool.PutNX(ItemsSizeKey, strconv.Itoa(itemCnt), 0)
+			return err
+		})
 		file.Close()
 	} else {
-		panic(err.Error())
+		file.Close()
 	}
+	// The changes after the version read are reloaded by the polls.
+	must(func() error {
+		reply, err := ss.ClientPool.Get(CatalogVersionKey)
+		ss.catalogVersion, _ = strconv.Atoi(reply.Value)
+		return err
+	})
+	must(func() error {
+		return ss.reloadItems(nil)
+	})
 	//ss.coordClients.LoadItemList(itemCnt)
 }
 
 func (ss *ShopServer) login(resp *http.Response, req *http.Request){
+	if !ss.limitIP(resp, req) {
+		return
+	}
 	isEmpty, body := isBodyEmpty(resp, req)
 	if isEmpty{
 		return
 	}
+	status, out := ss.doLogin(body)
+	writeReply(resp, status, out)
+}
+
+func (ss *ShopServer) doLogin(body []byte) (int, []byte) {
 	var user LoginJson
 	if err := json.Unmarshal(body, &user); err != nil {
-		resp.WriteStatus(http.StatusBadRequest)
-		resp.Write(MALFORMED_JSON_MSG)
-		return
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
 	}
 	userIDAndPass, ok := ss.UserMap[user.Username]
 	if !ok || userIDAndPass.Password != user.Password {
-		resp.WriteStatus(http.StatusForbidden)
-		resp.Write(USER_AUTH_FAIL_MSG)
-		return
+		return http.StatusForbidden, USER_AUTH_FAIL_MSG
 	}
 	userID := userIDAndPass.ID
 	token := userID2Token(userID)
-	ss.ClientPool.Put(TokenKeyPrefix+token, "1")
-	okMsg := []byte("{\"user_id\":" + strconv.Itoa(userID) + ",\"username\":\"" + user.Username + "\",\"access_token\":\"" + token + "\"}")
-	resp.WriteStatus(http.StatusOK)
-	resp.Write(okMsg)
-
+	if _, err := ss.ClientPool.Put(TokenKeyPrefix+token, "1"); err != nil {
+		return unavailable(err)
+	}
+	return http.StatusOK, []byte("{\"user_id\":" + strconv.Itoa(userID) + ",\"username\":\"" + user.Username + "\",\"access_token\":\"" + token + "\"}")
 }
 
 func (ss *ShopServer) queryItem(resp *http.Response, req *http.Request){
 	if exist, _ ,_:= ss.authorize(resp, req,  false); !exist {
 		return
 	}
+	ss.ItemLock.RLock()
+	itemsJSON := ss.ItemsJSONCache
+	ss.ItemLock.RUnlock()
 	resp.WriteStatus(http.StatusOK)
-	resp.Write(ss.ItemsJSONCache)
+	resp.Write(itemsJSON)
 	return
 }
 
@@ -227,20 +403,27 @@ func (ss *ShopServer) createCart(resp *http.Response, req *http.Request) {
 	if !exist {
 		return
 	}
-	_, reply := ss.ClientPool.Incr(CartIDMaxKey, 1)
+	status, out := ss.doCreateCart(token)
+	writeReply(resp, status, out)
+}
+
+func (ss *ShopServer) doCreateCart(token string) (int, []byte) {
+	reply, err := ss.ClientPool.Incr(CartIDMaxKey, 1)
+	if err != nil {
+		return unavailable(err)
+	}
 	cartIDStr := reply.Value
 
 	cartKey := getCartKey(cartIDStr, token)
-	_, reply = ss.ClientPool.Put(cartKey, "0")
-
-	resp.WriteStatus(http.StatusOK)
-	resp.Write([]byte("{\"cart_id\": \"" + cartIDStr + "\"}"))
-	return
+	if _, err = ss.ClientPool.Put(cartKey, newCart(ss.Options.ValueSchema).encode()); err != nil {
+		return unavailable(err)
+	}
+	return http.StatusOK, []byte("{\"cart_id\": \"" + cartIDStr + "\"}")
 }
 
 func (ss *ShopServer) addItem(resp *http.Response, req *http.Request) {
 	var token string
-	exist, token,body := ss.authorize(resp, req, false)
+	exist, token,body := ss.authorizeCart(resp, req)
 	if !exist {
 		return
 	}
@@ -250,35 +433,49 @@ func (ss *ShopServer) addItem(resp *http.Response, req *http.Request) {
 	}*/
 	var item ItemCount
 	if err := json.Unmarshal(body, &item); err != nil {
-		resp.WriteStatus(http.StatusBadRequest)
-		resp.Write(MALFORMED_JSON_MSG)
+		writeReply(resp, http.StatusBadRequest, MALFORMED_JSON_MSG)
 		return
 	}
 
-	if item.ItemID < 1 || item.ItemID > ss.MaxItemID {
-		resp.WriteStatus(http.StatusNotFound)
-		resp.Write(ITEM_NOT_FOUND_MSG)
+	if !ss.itemAvailable(item.ItemID) {
+		writeReply(resp, http.StatusNotFound, ITEM_NOT_FOUND_MSG)
+		return
+	}
+	if !ss.itemOnSale(item.ItemID) {
+		writeReply(resp, http.StatusForbidden, ITEM_NOT_ON_SALE_MSG)
 		return
 	}
 
 	cartIDStr := strings.Split(req.URL.Path, "/")[2]
 	cartKey := getCartKey(cartIDStr, token)
-	existed, cartValue := ss.checkCartExist(cartIDStr, cartKey, resp, req)
-	if !existed {
+	cartValue, status, msg := ss.checkCartExist(token, cartIDStr, cartKey)
+	if msg != nil {
+		writeReply(resp, status, msg)
+		return
+	}
+	cart, err := decodeCart(cartValue)
+	if err != nil {
+		log.Printf("Decode %s error: %v\n", cartKey, err)
+		writeReply(resp, http.StatusInternalServerError, DATA_CORRUPTED_MSG)
 		return
 	}
-	num, cartDetail := parseCartValue(cartValue)
 	
 	// Test whether #items in cart exceeds 3.
-	if num+item.Count > 3 {
-		resp.WriteStatus(http.StatusForbidden)
-		resp.Write(ITEM_OUT_OF_LIMIT_MSG)
+	if cart.Num+item.Count > 3 {
+		writeReply(resp, http.StatusForbidden, ITEM_OUT_OF_LIMIT_MSG)
 		return
 	}
-	num += item.Count
+	cart.Num += item.Count
 	// Set the new values of the cart.
-	cartDetail[item.ItemID] += item.Count
-	ss.ClientPool.Put(cartKey, composeCartValue(num, cartDetail))
+	cart.Detail[item.ItemID] += item.Count
+	// Capture the price when the item is first added.
+	if _, ok := cart.Prices[item.ItemID]; !ok {
+		cart.Prices[item.ItemID] = ss.itemPrice(item.ItemID)
+	}
+	if _, err = ss.ClientPool.Put(cartKey, cart.encode()); err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
 	resp.WriteStatus(http.StatusNoContent)
 	return
 }
@@ -295,55 +492,95 @@ func (ss *ShopServer) orderProcess(resp *http.Response, req *http.Request) {
 
 func (ss *ShopServer) submitOrder(resp *http.Response, req *http.Request) {
 	var token string
-	exist, token,body := ss.authorize(resp, req,  false)
+	exist, token,body := ss.authorizeCart(resp, req)
 	if !exist {
 		return
 	}
+	var admission TicketStatus
+	if ss.waitingRoom != nil {
+		admitted, status, err := ss.waitingRoom.enter(token)
+		if err != nil {
+			writeUnavailable(resp, err)
+			return
+		}
+		if !admitted {
+			writeQueued(resp, status)
+			return
+		}
+		admission = status
+	}
+	status, out := ss.doIdempotent(token, idempotencyKey(req, body), body, SUBMIT_OR_QUERY_ORDER, func() (int, []byte) {
+		return ss.doSubmitOrder(token, body)
+	})
+	if ss.waitingRoom != nil && status != http.StatusOK {
+		// Only an order placed uses up the admission.
+		if err := ss.waitingRoom.giveBack(token, admission); err != nil {
+			log.Printf("Give back the admission of %s error: %v\n", token, err)
+		}
+	}
+	writeReply(resp, status, out)
+}
 
-	/*isEmpty, body := isBodyEmpty(resp, req)
-	if isEmpty {
-		return
-	}*/
-
+func (ss *ShopServer) doSubmitOrder(token string, body []byte) (int, []byte) {
 	var cartIDJson CartIDJson
 
 	if err := json.Unmarshal(body, &cartIDJson); err != nil {
-		resp.WriteStatus(http.StatusBadRequest)
-		resp.Write(MALFORMED_JSON_MSG)
-		return
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
 	}
 	cartIDStr := cartIDJson.IDStr
 	cartKey := getCartKey(cartIDStr, token)
-	existed, cartValue := ss.checkCartExist(cartIDStr, cartKey,resp, req)
-	if !existed {
-		return
+	cartValue, status, msg := ss.checkCartExist(token, cartIDStr, cartKey)
+	if msg != nil {
+		return status, msg
 	}
 	
 	// Test whether the cart is empty.
-	num, _ := parseCartValue(cartValue)
-	if num == 0 {
-		resp.WriteStatus(http.StatusForbidden)
-		resp.Write(CART_EMPTY)
-		return
+	cart, err := decodeCart(cartValue)
+	if err != nil {
+		log.Printf("Decode %s error: %v\n", cartKey, err)
+		return http.StatusInternalServerError, DATA_CORRUPTED_MSG
 	}
-	_,flag:=ss.ClientPool.SubmitOrder(cartIDStr,token,cartValue)
-	switch flag{
-	case OK:
-		{
-			resp.WriteStatus(http.StatusOK)
-			resp.Write([]byte("{\"order_id\": \"" + token + "\"}"))
-		}
+	if cart.Num == 0 {
+		return http.StatusForbidden, CART_EMPTY
+	}
+	if cartIDJson.Coupon != "" && !validCouponCode(cartIDJson.Coupon) {
+		return http.StatusNotFound, COUPON_NOT_FOUND_MSG
+	}
+	args := &SubmitOrderArgs{CartIDStr: cartIDStr, UserToken: token, CartValue: cartValue,
+		PricePolicy: ss.Options.PricePolicy, Coupon: cartIDJson.Coupon,
+		Now: ss.nowMs()}
+	reply, err := ss.ClientPool.SubmitOrder(args)
+	if err != nil {
+		return unavailable(err)
+	}
+	if status, msg := couponStatusMsg(reply.Status); msg != nil {
+		return status, msg
+	}
+	switch reply.Status{
 	case OutOfStock:
-		{
-			resp.WriteStatus(http.StatusForbidden)
-			resp.Write(ITEM_OUT_OF_STOCK_MSG)
-		}
+		return http.StatusForbidden, ITEM_OUT_OF_STOCK_MSG
 	case OrderOutOfLimit:
-		{
-			resp.WriteStatus(http.StatusForbidden)
-			resp.Write(ORDER_OUT_OF_LIMIT_MSG)
-		}
-	}
+		return http.StatusForbidden, ORDER_OUT_OF_LIMIT_MSG
+	case ItemRetired:
+		return http.StatusNotFound, ITEM_NOT_FOUND_MSG
+	case ItemNotOnSale:
+		return http.StatusForbidden, ITEM_NOT_ON_SALE_MSG
+	case MalformedValue:
+		return http.StatusInternalServerError, DATA_CORRUPTED_MSG
+	}
+	okMsg := "{\"order_id\": \"" + token + "\""
+	if reply.PriceDiff != 0 || reply.Discount != 0 {
+		okMsg += ",\"total\": " + strconv.Itoa(reply.Total)
+	}
+	if reply.PriceDiff != 0 {
+		// Tell the user that the prices have changed since added.
+		okMsg += ",\"price_difference\": " + strconv.Itoa(reply.PriceDiff)
+	}
+	if reply.Discount != 0 {
+		okMsg += ",\"discount\": " + strconv.Itoa(reply.Discount)
+	}
+	ordersCreated.Inc()
+	return http.StatusOK, []byte(okMsg + "}")
 }
 
 func (ss *ShopServer) payOrder(resp *http.Response, req *http.Request){
@@ -353,60 +590,96 @@ func (ss *ShopServer) payOrder(resp *http.Response, req *http.Request){
 	if !exist {
 		return
 	}
+	ss.idempotent(resp, req, token, body, PAY_ORDER, func() (int, []byte) {
+		return ss.doPayOrder(token, body)
+	})
+}
 
-	/*isEmpty, body := isBodyEmpty(resp, req)
-	if isEmpty {
-		return
-	}*/
+func (ss *ShopServer) doPayOrder(token string, body []byte) (int, []byte) {
 	var orderIDJson OrderIDJson
 	if err := json.Unmarshal(body, &orderIDJson); err != nil {
-		resp.WriteStatus(http.StatusBadRequest)
-		resp.Write(MALFORMED_JSON_MSG)
-		return
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
 	}
 	
 	orderIDStr := orderIDJson.IDStr
 	if orderIDStr != token {
-		resp.WriteStatus(http.StatusUnauthorized)
-		resp.Write(NOT_AUTHORIZED_ORDER_MSG)
-		return
+		return http.StatusUnauthorized, NOT_AUTHORIZED_ORDER_MSG
 	}
 
-	orderKey := OrderKeyPrefix + orderIDStr
-	// Test whether the order exists, or it belongs other users.
-	_, reply := ss.ClientPool.Get(orderKey)
-	if !reply.Flag {
-		resp.WriteStatus(http.StatusNotFound)
-		resp.Write(ORDER_NOT_FOUND_MSG)
-		return
-	}
-	// Test whether the order have been paid.
-	hasPaid, price, _, _ := parseOrderValue(reply.Value)
-	if hasPaid {
-		resp.WriteStatus(http.StatusForbidden)
-		resp.Write(ORDER_PAID_MSG)
-		return
+	// The order is read by the transaction, which charges its total.
+	flag, err := ss.ClientPool.PayOrder(orderIDStr,token)
+	if err != nil {
+		return unavailable(err)
 	}
-	_,flag:=ss.ClientPool.PayOrder(orderIDStr,token,price)
 	switch flag {
-	case OK:
-		{
-			resp.WriteStatus(http.StatusOK)
-			resp.Write([]byte("{\"order_id\": \"" + token + "\"}"))
-		}
+	case OrderNotFound:
+		return http.StatusNotFound, ORDER_NOT_FOUND_MSG
+	case MalformedValue:
+		log.Printf("Decode %s error\n", OrderKeyPrefix+orderIDStr)
+		return http.StatusInternalServerError, DATA_CORRUPTED_MSG
 	case OrderPaid:
-		{
-			resp.WriteStatus(http.StatusForbidden)
-			resp.Write(ORDER_PAID_MSG)
-		}
+		return http.StatusForbidden, ORDER_PAID_MSG
 	case BalanceInsufficient:
-		{
-			resp.WriteStatus(http.StatusForbidden)
-			resp.Write(BALANCE_INSUFFICIENT_MSG)
-		}
+		return http.StatusForbidden, BALANCE_INSUFFICIENT_MSG
+	case UserNotFound:
+		return http.StatusNotFound, USER_NOT_FOUND_MSG
 	}
+	ordersPaid.Inc()
+	return http.StatusOK, []byte("{\"order_id\": \"" + token + "\"}")
+}
 
-	return
+// cancelOrder deletes the unpaid order of the user, and passes the items
+// returned to stock on to their waitlists.
+func (ss *ShopServer) cancelOrder(resp *http.Response, req *http.Request) {
+	exist, token, body := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	ss.idempotent(resp, req, token, body, CANCEL_ORDER, func() (int, []byte) {
+		return ss.doCancelOrder(token, body)
+	})
+}
+
+func (ss *ShopServer) doCancelOrder(token string, body []byte) (int, []byte) {
+	var orderIDJson OrderIDJson
+	if err := json.Unmarshal(body, &orderIDJson); err != nil {
+		return http.StatusBadRequest, MALFORMED_JSON_MSG
+	}
+	if orderIDJson.IDStr != token {
+		return http.StatusUnauthorized, NOT_AUTHORIZED_ORDER_MSG
+	}
+	reply, err := ss.ClientPool.Get(OrderKeyPrefix + token)
+	if err != nil {
+		return unavailable(err)
+	}
+	if !reply.Flag {
+		return http.StatusNotFound, ORDER_NOT_FOUND_MSG
+	}
+	order, err := decodeOrder(reply.Value)
+	if err != nil {
+		log.Printf("Decode %s error: %v\n", OrderKeyPrefix+token, err)
+		return http.StatusInternalServerError, DATA_CORRUPTED_MSG
+	}
+	status, err := ss.ClientPool.CancelOrder(token, reply.Value)
+	if err != nil {
+		return unavailable(err)
+	}
+	switch status {
+	case MalformedValue:
+		return http.StatusInternalServerError, DATA_CORRUPTED_MSG
+	case OrderNotFound:
+		return http.StatusNotFound, ORDER_NOT_FOUND_MSG
+	case RequestConflict:
+		// Paid meanwhile.
+		return http.StatusConflict, REQUEST_CONFLICT_MSG
+	case OrderPaid:
+		return http.StatusForbidden, ORDER_PAID_MSG
+	}
+	ordersCancelled.Inc()
+	for itemID, itemCnt := range order.Detail {
+		ss.notifyWaitlist(itemID, itemCnt)
+	}
+	return http.StatusOK, []byte("{\"order_id\": \"" + token + "\"}")
 }
 
 func (ss *ShopServer) queryOneOrder(resp *http.Response, req *http.Request) {
@@ -415,22 +688,34 @@ func (ss *ShopServer) queryOneOrder(resp *http.Response, req *http.Request) {
 	if !exist {
 		return
 	}
-	var reply kv.Reply
-	if _, reply = ss.ClientPool.Get(OrderKeyPrefix + token); !reply.Flag {
+	reply, err := ss.ClientPool.Get(OrderKeyPrefix + token)
+	if err != nil {
+		writeUnavailable(resp, err)
+		return
+	}
+	if !reply.Flag {
 		resp.WriteStatus(http.StatusOK)
 		resp.Write([]byte("[]"))
 		return
 	}
-	hasPaid, price, _, detail := parseOrderValue(reply.Value)
+	record, err := decodeOrder(reply.Value)
+	if err != nil {
+		log.Printf("Decode %s error: %v\n", OrderKeyPrefix+token, err)
+		writeReply(resp, http.StatusInternalServerError, DATA_CORRUPTED_MSG)
+		return
+	}
 	var orders [1]Order
 	order := &orders[0]
-	itemNum := len(detail) // it cannot be zero.
-	order.HasPaid = hasPaid
+	itemNum := len(record.Detail) // it cannot be zero.
+	order.HasPaid = record.Paid
 	order.IDStr = token
 	order.Items = make([]ItemCount, itemNum)
-	order.Total = price
+	order.Total = record.Total
+	if order.Coupon, order.Discount = record.Coupon, record.Discount; order.Coupon != "" {
+		order.Subtotal = record.Total + order.Discount
+	}
 	cnt := 0
-	for itemID, itemCnt := range detail {
+	for itemID, itemCnt := range record.Detail {
 		if itemCnt != 0 {
 			order.Items[cnt].ItemID = itemID
 			order.Items[cnt].Count = itemCnt
@@ -462,17 +747,29 @@ func isBodyEmpty(resp *http.Response, req *http.Request)(bool,[]byte){
 	}
 
 	if totalReadN == 0 {
-		resp.WriteStatus(http.StatusBadRequest)
-		resp.Write(EMPTY_REQUEST_MSG)
+		writeReply(resp, http.StatusBadRequest, EMPTY_REQUEST_MSG)
 		return true, nil
 	}
 	return false, ret
 }
 // return the flag that indicates whether is authroized or not
 func  (ss *ShopServer) authorize(resp *http.Response, req *http.Request,isRoot bool)(bool,string,[]byte){
+	return ss.checkToken(resp, req, isRoot, true)
+}
+
+// authorizeCart is authorize leaving the check that the user has logged in
+// to checkCartExist, which does it in the same round trip as the cart.
+func (ss *ShopServer) authorizeCart(resp *http.Response, req *http.Request) (bool, string, []byte) {
+	return ss.checkToken(resp, req, false, false)
+}
+
+func (ss *ShopServer) checkToken(resp *http.Response, req *http.Request, isRoot, loggedIn bool) (bool, string, []byte) {
 	valid := true
 	//var authUserID int
 	var authUserIDStr string
+	if !ss.limitIP(resp, req) {
+		return false,"",nil
+	}
 	isEmpty, body := isBodyEmpty(resp, req)
 	if isEmpty{
 		return false,"",nil
@@ -491,24 +788,55 @@ func  (ss *ShopServer) authorize(resp *http.Response, req *http.Request,isRoot b
 		authUserIDStr = strconv.Itoa(authUserID)
 		if isRoot && authUserIDStr != ss.rootToken || !isRoot && (authUserID < 1 || authUserID > ss.MaxUserID) {
 			valid = false
-		} else {
-			if _, reply :=ss.ClientPool.Get(TokenKeyPrefix + authUserIDStr); !reply.Flag {
+		} else if loggedIn {
+			reply, err := ss.ClientPool.Get(TokenKeyPrefix + authUserIDStr)
+			if err != nil {
+				writeUnavailable(resp, err)
+				return false, "", nil
+			}
+			if !reply.Flag {
 				valid = false
 			}
 		}
 	}
 	if !valid {
-		resp.WriteStatus(http.StatusUnauthorized)
-		resp.Write(INVALID_ACCESS_TOKEN_MSG)
+		writeReply(resp, http.StatusUnauthorized, INVALID_ACCESS_TOKEN_MSG)
+		return false, "",nil
+	}
+	if !ss.limitToken(resp, req, authUserIDStr) {
 		return false, "",nil
 	}
 	return true, authUserIDStr,body
 }
 
-func (ss *ShopServer) checkCartExist(cartIDStr, cartKey string, resp *http.Response, req *http.Request) ( bool, string) {
+// unavailable is the reply when the KV-Store fails, so that the client
+// retries later instead of taking the request as done.
+func unavailable(err error) (int, []byte) {
+	log.Println("Kvstore error:", err)
+	return http.StatusServiceUnavailable, SERVICE_UNAVAILABLE_MSG
+}
+
+func writeUnavailable(resp *http.Response, err error) {
+	status, msg := unavailable(err)
+	writeReply(resp, status, msg)
+}
+
+// checkCartExist returns the value of the cart if the user has logged in
+// and it exists and belongs to them, otherwise the status and message of
+// the error.
+func (ss *ShopServer) checkCartExist(token, cartIDStr, cartKey string) (cartValue string, status int, msg []byte) {
 	vaild:= true 
 	cartID, _ := strconv.Atoi(cartIDStr)
-	_, reply := ss.ClientPool.Get(CartIDMaxKey)
+	// All in one round trip.
+	replies, err := ss.ClientPool.MGet([]string{TokenKeyPrefix + token, CartIDMaxKey, cartKey})
+	if err != nil {
+		status, msg = unavailable(err)
+		return "", status, msg
+	}
+	if !replies.Replies[0].Flag {
+		return "", http.StatusUnauthorized, INVALID_ACCESS_TOKEN_MSG
+	}
+	reply := replies.Replies[1]
 	if reply.Flag{
 		maxCartID, _ := strconv.Atoi(reply.Value)
 		if cartID > maxCartID || cartID < 1 {
@@ -518,15 +846,10 @@ func (ss *ShopServer) checkCartExist(cartIDStr, cartKey string, resp *http.Respo
 		vaild=false
 	}
 	if !vaild{
-		resp.WriteStatus(http.StatusNotFound)
-		resp.Write(CART_NOT_FOUND_MSG)
-		return false,""
+		return "", http.StatusNotFound, CART_NOT_FOUND_MSG
 	}
-	_, reply = ss.ClientPool.Get(cartKey)
-	if !reply.Flag {
-		resp.WriteStatus(http.StatusUnauthorized)
-		resp.Write(NOT_AUTHORIZED_CART_MSG)
-		return false,""
+	if reply = replies.Replies[2]; !reply.Flag {
+		return "", http.StatusUnauthorized, NOT_AUTHORIZED_CART_MSG
 	}
-	return true,reply.Value
+	return reply.Value, http.StatusOK, nil
 }
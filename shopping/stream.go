@@ -0,0 +1,320 @@
+package shopping
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The shop watches the stock in the KV-Store by long polls of up to
+	// StreamWatchTimeout, and retries after StreamRetryInterval if the
+	// KV-Store fails.
+	StreamWatchTimeout  = 10 * time.Second
+	StreamRetryInterval = 500 * time.Millisecond
+	// A client lagging StreamBufferSize batches behind is dropped.
+	StreamBufferSize   = 64
+	StreamPingInterval = 15 * time.Second
+)
+
+type stockEvent struct {
+	ItemID  int  `json:"id"`
+	Stock   int  `json:"stock"`
+	Deleted bool `json:"deleted,omitempty"` // the stock of the item is gone
+}
+
+type stockSubscriber struct {
+	items map[int]bool // nil for all the items
+	ch    chan []stockEvent
+}
+
+func (sub *stockSubscriber) filter(stocks, last map[int]int, deleted map[int]bool) []stockEvent {
+	var evs []stockEvent
+	for itemID, stock := range stocks {
+		if sub.items != nil && !sub.items[itemID] {
+			continue
+		}
+		if old, ok := last[itemID]; !ok || old != stock {
+			evs = append(evs, stockEvent{ItemID: itemID, Stock: stock})
+		}
+	}
+	for itemID := range deleted {
+		if sub.items == nil || sub.items[itemID] {
+			evs = append(evs, stockEvent{ItemID: itemID, Deleted: true})
+		}
+	}
+	return evs
+}
+
+// stockHub fans the changes of the stock out to the subscribers, the
+// changes watched at once in one batch. It never blocks on a subscriber:
+// the one whose buffer is full is dropped, and its channel closed.
+type stockHub struct {
+	mu     sync.Mutex
+	subs   map[*stockSubscriber]bool
+	stocks map[int]int // the last stock seen, nil before the first scan
+}
+
+func newStockHub() *stockHub {
+	return &stockHub{subs: make(map[*stockSubscriber]bool)}
+}
+
+// subscribe returns the current stock of the items, which the changes
+// sent later are based on. items is nil to subscribe to all the items.
+func (h *stockHub) subscribe(items map[int]bool, current map[int]int) (*stockSubscriber, []stockEvent) {
+	sub := &stockSubscriber{items: items, ch: make(chan []stockEvent, StreamBufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stocks != nil {
+		current = h.stocks
+	}
+	h.subs[sub] = true
+	return sub, sub.filter(current, nil, nil)
+}
+
+func (h *stockHub) unsubscribe(sub *stockSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// update replaces all the stocks, and broadcasts the ones changed.
+func (h *stockHub) update(stocks map[int]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last := h.stocks
+	h.stocks = stocks
+	if last == nil {
+		return
+	}
+	deleted := make(map[int]bool)
+	for itemID := range last {
+		if _, ok := stocks[itemID]; !ok {
+			deleted[itemID] = true
+		}
+	}
+	h.broadcast(stocks, last, deleted)
+}
+
+// apply broadcasts the changes of some stocks, and drops the items whose
+// stock is deleted.
+func (h *stockHub) apply(changes map[int]int, deleted map[int]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stocks == nil {
+		return
+	}
+	last := make(map[int]int, len(changes))
+	for itemID := range changes {
+		if stock, ok := h.stocks[itemID]; ok {
+			last[itemID] = stock
+		}
+	}
+	for itemID, stock := range changes {
+		h.stocks[itemID] = stock
+	}
+	for itemID := range deleted {
+		if _, ok := h.stocks[itemID]; !ok {
+			delete(deleted, itemID)
+		}
+		delete(h.stocks, itemID)
+	}
+	h.broadcast(changes, last, deleted)
+}
+
+// broadcast must be called with mu held.
+func (h *stockHub) broadcast(stocks, last map[int]int, deleted map[int]bool) {
+	for sub := range h.subs {
+		evs := sub.filter(stocks, last, deleted)
+		if len(evs) == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- evs:
+		default:
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func parseStockKey(key string) (itemID int, ok bool) {
+	itemID, err := strconv.Atoi(strings.TrimPrefix(key, ItemsStockKeyPrefix))
+	return itemID, err == nil
+}
+
+// loadStocks scans all the stocks, and returns the versions of the
+// KV-Store to watch the changes after.
+func (ss *ShopServer) loadStocks() (versions []int64, ok bool) {
+	if reply, err := ss.ClientPool.WatchKeys(ItemsStockKeyPrefix, nil, 0); err == nil {
+		versions = reply.Versions
+	} else {
+		return nil, false
+	}
+	reply, err := ss.ClientPool.Scan(ItemsStockKeyPrefix)
+	if err != nil {
+		return nil, false
+	}
+	stocks := make(map[int]int, len(reply.Data))
+	for key, value := range reply.Data {
+		if itemID, ok := parseStockKey(key); ok {
+			stocks[itemID], _ = strconv.Atoi(value)
+		}
+	}
+	ss.stockHub.update(stocks)
+	return versions, true
+}
+
+// watchStock feeds the changes of the stock in the KV-Store to the hub. It
+// reloads all the stocks if it lost track of the changes.
+func (ss *ShopServer) watchStock() {
+	var versions []int64
+	for {
+		if versions == nil {
+			var ok bool
+			if versions, ok = ss.loadStocks(); !ok {
+				time.Sleep(StreamRetryInterval)
+				continue
+			}
+		}
+		reply, err := ss.ClientPool.WatchKeys(ItemsStockKeyPrefix, versions, StreamWatchTimeout)
+		if err != nil {
+			time.Sleep(StreamRetryInterval)
+		}
+		if err != nil || reply.Truncated {
+			versions = nil
+			continue
+		}
+		versions = reply.Versions
+		changes, deleted := make(map[int]int), make(map[int]bool)
+		for _, ev := range reply.Events {
+			itemID, ok := parseStockKey(ev.Key)
+			if !ok {
+				continue
+			}
+			if ev.Deleted {
+				delete(changes, itemID)
+				deleted[itemID] = true
+			} else {
+				delete(deleted, itemID)
+				changes[itemID], _ = strconv.Atoi(ev.New)
+			}
+		}
+		if len(changes) != 0 || len(deleted) != 0 {
+			ss.stockHub.apply(changes, deleted)
+		}
+	}
+}
+
+// cachedStocks returns the stock of the available items in the cache.
+func (ss *ShopServer) cachedStocks() map[int]int {
+	ss.ItemLock.RLock()
+	defer ss.ItemLock.RUnlock()
+	stocks := make(map[int]int, len(ss.ItemListCache))
+	for _, item := range ss.ItemListCache[1:] {
+		if !item.Retired {
+			stocks[item.ID] = item.Stock
+		}
+	}
+	return stocks
+}
+
+// streamStock serves GET /items/stream?access_token=<token>&items=1,2 as
+// Server-Sent Events. Every "stock" event holds a batch of changes, e.g.
+// [{"id":1,"stock":5}], the first being the current stock, or
+// {"id":1,"deleted":true} once the item is gone. Without items
+// all the items are streamed. A client too slow to keep up gets a
+// "dropped" event and is disconnected.
+func (ss *ShopServer) streamStock(w nethttp.ResponseWriter, req *nethttp.Request) {
+	query := req.URL.Query()
+	token := query.Get("access_token")
+	if userID, err := strconv.Atoi(token); err != nil || userID < 0 || userID > ss.MaxUserID {
+		w.WriteHeader(nethttp.StatusUnauthorized)
+		w.Write(INVALID_ACCESS_TOKEN_MSG)
+		return
+	}
+	if reply, err := ss.ClientPool.Get(TokenKeyPrefix + token); err != nil {
+		w.WriteHeader(nethttp.StatusServiceUnavailable)
+		w.Write(SERVICE_UNAVAILABLE_MSG)
+		return
+	} else if !reply.Flag {
+		w.WriteHeader(nethttp.StatusUnauthorized)
+		w.Write(INVALID_ACCESS_TOKEN_MSG)
+		return
+	}
+	var items map[int]bool
+	if list := query.Get("items"); list != "" {
+		items = make(map[int]bool)
+		for _, idStr := range strings.Split(list, ",") {
+			itemID, err := strconv.Atoi(idStr)
+			if err != nil || !ss.itemAvailable(itemID) {
+				w.WriteHeader(nethttp.StatusNotFound)
+				w.Write(ITEM_NOT_FOUND_MSG)
+				return
+			}
+			items[itemID] = true
+		}
+	}
+	flusher, ok := w.(nethttp.Flusher)
+	if !ok {
+		w.WriteHeader(nethttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(nethttp.StatusOK)
+	flusher.Flush()
+
+	sub, evs := ss.stockHub.subscribe(items, ss.cachedStocks())
+	defer ss.stockHub.unsubscribe(sub)
+	ping := time.NewTicker(StreamPingInterval)
+	defer ping.Stop()
+	for {
+		if evs != nil {
+			data, _ := json.Marshal(evs)
+			if _, err := fmt.Fprintf(w, "event: stock\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		select {
+		case evs, ok = <-sub.ch:
+			if !ok {
+				fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+		case <-ping.C:
+			evs = nil
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// serveStream listens for the event streams, apart from the API served
+// by distributed-system/http, which can't stream a response.
+func (ss *ShopServer) serveStream(addr string) {
+	ss.stockHub = newStockHub()
+	go ss.watchStock()
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc(STREAM_STOCK, ss.streamStock)
+	log.Printf("Start stock stream on %s\n", addr)
+	go func() {
+		if err := nethttp.ListenAndServe(addr, mux); err != nil {
+			log.Println("Stock stream error:", err)
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestStockHubDropsSlowClient(t *testing.T) {
+	h := newStockHub()
+	fast, evs := h.subscribe(map[int]bool{1: true}, map[int]int{1: 10, 2: 20})
+	if len(evs) != 1 || evs[0] != (stockEvent{ItemID: 1, Stock: 10}) {
+		t.Fatalf("snapshot %v; expected item 1 only", evs)
+	}
+	slow, _ := h.subscribe(nil, nil)
+	h.update(map[int]int{1: 10, 2: 20})
+
+	for i := 0; i < StreamBufferSize+1; i++ {
+		h.update(map[int]int{1: 10, 2: i})
+	}
+	select {
+	case evs := <-fast.ch:
+		t.Fatalf("client of item 1 got %v", evs)
+	default:
+	}
+	for i := 0; i < StreamBufferSize; i++ {
+		if evs := <-slow.ch; len(evs) != 1 || evs[0] != (stockEvent{ItemID: 2, Stock: i}) {
+			t.Fatalf("change %d is %v", i, evs)
+		}
+	}
+	if _, ok := <-slow.ch; ok {
+		t.Fatal("slow client isn't dropped")
+	}
+}
+
+func TestStockHubDeletesItem(t *testing.T) {
+	h := newStockHub()
+	h.update(map[int]int{1: 10, 2: 20})
+	sub, _ := h.subscribe(map[int]bool{1: true}, nil)
+	h.apply(map[int]int{2: 19}, map[int]bool{1: true, 3: true})
+	if evs := <-sub.ch; len(evs) != 1 || evs[0] != (stockEvent{ItemID: 1, Deleted: true}) {
+		t.Fatalf("deletion of item 1 is %v", evs)
+	}
+	if _, evs := h.subscribe(nil, nil); len(evs) != 1 || evs[0] != (stockEvent{ItemID: 2, Stock: 19}) {
+		t.Fatalf("snapshot after the deletion %v; expected item 2 only", evs)
+	}
+}
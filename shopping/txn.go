@@ -0,0 +1,318 @@
+package shopping
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"rush-shopping/kv"
+)
+
+// shoppingTxn is a transaction on the shopping data. It declares all the
+// keys it may read or write up front, so that they can be locked before
+// it runs, either inside one ShoppingKVStore or across the participants
+// of a two-phase commit.
+type shoppingTxn interface {
+	keys() []string
+	// run decides the transaction on the locked values. It must only
+	// touch the declared keys and must not write if it fails.
+	run(v *txnView)
+}
+
+// txnView holds the values of the locked keys and buffers the writes of
+// a transaction.
+type txnView struct {
+	values map[string]string // the existing keys only
+	writes map[string]string
+	ttls   map[string]time.Duration // of the writes expiring
+	dels   map[string]bool
+}
+
+func newTxnView(values map[string]string) *txnView {
+	return &txnView{values: values, writes: make(map[string]string),
+		ttls: make(map[string]time.Duration), dels: make(map[string]bool)}
+}
+
+func (v *txnView) get(key string) (value string, existed bool) {
+	if v.dels[key] {
+		return "", false
+	}
+	if value, existed = v.writes[key]; existed {
+		return
+	}
+	value, existed = v.values[key]
+	return
+}
+
+func (v *txnView) getInt(key string) (value int, existed bool) {
+	var str string
+	if str, existed = v.get(key); existed {
+		value, _ = strconv.Atoi(str)
+	}
+	return
+}
+
+func (v *txnView) put(key, value string) {
+	delete(v.dels, key)
+	delete(v.ttls, key)
+	v.writes[key] = value
+}
+
+// putTTL writes the key to expire after ttl since it is applied.
+func (v *txnView) putTTL(key, value string, ttl time.Duration) {
+	v.put(key, value)
+	v.ttls[key] = ttl
+}
+
+func (v *txnView) del(key string) {
+	delete(v.writes, key)
+	delete(v.ttls, key)
+	v.dels[key] = true
+}
+
+// runSafely runs the transaction, turning a panic into an error, so that
+// nothing is written and the keys are released.
+func runSafely(txn shoppingTxn, v *txnView) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("transaction failed, request %s", kv.Recovered(fmt.Sprintf("%T", txn), r))
+		}
+	}()
+	txn.run(v)
+	return nil
+}
+
+// orderTxn creates the order of a cart and takes its items from stock.
+type orderTxn struct {
+	args  *SubmitOrderArgs
+	cart  *cartRecord
+	reply *SubmitOrderReply
+}
+
+func newOrderTxn(args *SubmitOrderArgs, reply *SubmitOrderReply) (*orderTxn, error) {
+	cart, err := decodeCart(args.CartValue)
+	if err != nil {
+		return nil, err
+	}
+	return &orderTxn{args: args, cart: cart, reply: reply}, nil
+}
+
+func (t *orderTxn) keys() []string {
+	keys := make([]string, 0, 5*len(t.cart.Detail)+4)
+	keys = append(keys, OrderKeyPrefix+t.args.UserToken)
+	if t.args.Coupon != "" {
+		keys = append(keys, CouponKeyPrefix+t.args.Coupon, couponUsedKey(t.args.Coupon),
+			couponUserUsedKey(t.args.Coupon, t.args.UserToken))
+	}
+	for itemID := range t.cart.Detail {
+		itemIDStr := strconv.Itoa(itemID)
+		keys = append(keys, ItemsStockKeyPrefix+itemIDStr, ItemsPriceKeyPrefix+itemIDStr,
+			ItemsRetiredKeyPrefix+itemIDStr, ItemsSaleKeyPrefix+itemIDStr,
+			reservationKey(itemID, t.args.UserToken))
+	}
+	return keys
+}
+
+func (t *orderTxn) run(v *txnView) {
+	orderKey := OrderKeyPrefix + t.args.UserToken
+	t.reply.Status = OK
+	for itemID := range t.cart.Detail {
+		if _, retired := v.get(ItemsRetiredKeyPrefix + strconv.Itoa(itemID)); retired {
+			t.reply.Status = ItemRetired
+			return
+		}
+		if sale, existed := v.get(ItemsSaleKeyPrefix + strconv.Itoa(itemID)); existed {
+			if start, end, _ := parseSaleValue(sale); !onSale(start, end, t.args.Now) {
+				t.reply.Status = ItemNotOnSale
+				return
+			}
+		}
+	}
+	// The units reserved for the user count as in stock, and the expired
+	// reservations go back to stock.
+	stocks := make(map[int]int, len(t.cart.Detail))
+	reserved := make(map[int]int, len(t.cart.Detail))
+	reservedUntil := make(map[int]int64, len(t.cart.Detail))
+	for itemID, itemCnt := range t.cart.Detail {
+		stock, existed := v.getInt(ItemsStockKeyPrefix + strconv.Itoa(itemID))
+		if value, held := v.get(reservationKey(itemID, t.args.UserToken)); held {
+			count, expiresAt := parseReservation(value)
+			if expiresAt > t.args.Now {
+				reserved[itemID], reservedUntil[itemID] = count, expiresAt
+			} else {
+				stock += count
+			}
+		}
+		if existed {
+			if stock+reserved[itemID] < itemCnt {
+				t.reply.Status = OutOfStock
+				return
+			}
+			stocks[itemID] = stock
+		}
+	}
+	if _, existed := v.get(orderKey); existed {
+		t.reply.Status = OrderOutOfLimit
+		return
+	}
+	total, cartTotal := 0, 0
+	prices := make(map[int]int, len(t.cart.Detail))
+	for itemID, itemCnt := range t.cart.Detail {
+		price, _ := v.getInt(ItemsPriceKeyPrefix + strconv.Itoa(itemID))
+		if sale, existed := v.get(ItemsSaleKeyPrefix + strconv.Itoa(itemID)); existed {
+			if _, _, salePrice := parseSaleValue(sale); salePrice != nil {
+				price = *salePrice
+			}
+		}
+		captured, ok := t.cart.Prices[itemID]
+		if !ok {
+			captured = price
+		}
+		if t.args.PricePolicy == PriceAtCart {
+			price = captured
+		}
+		prices[itemID] = price
+		total += itemCnt * price
+		cartTotal += itemCnt * captured
+	}
+	discount := 0
+	if t.args.Coupon != "" {
+		if discount, t.reply.Status = redeemCoupon(v, t.args.Coupon, t.args.UserToken, total, t.args.Now); t.reply.Status != OK {
+			return
+		}
+	}
+	for itemID, itemCnt := range t.cart.Detail {
+		used := reserved[itemID]
+		if used > itemCnt {
+			used = itemCnt
+		}
+		key := reservationKey(itemID, t.args.UserToken)
+		if _, held := v.get(key); held {
+			if left := reserved[itemID] - used; left > 0 {
+				v.put(key, composeReservation(left, reservedUntil[itemID]))
+			} else {
+				v.del(key)
+			}
+		}
+		if stock, existed := stocks[itemID]; existed {
+			v.put(ItemsStockKeyPrefix+strconv.Itoa(itemID), strconv.Itoa(stock-itemCnt+used))
+		}
+	}
+	t.reply.PriceDiff = total - cartTotal
+	t.reply.Discount = discount
+	t.reply.Total = total - discount
+	order := &orderRecord{cartRecord: cartRecord{Schema: t.cart.Schema, Num: t.cart.Num,
+		Detail: t.cart.Detail, Prices: prices}, Total: t.reply.Total, Coupon: t.args.Coupon, Discount: discount}
+	v.put(orderKey, order.encode())
+}
+
+// cancelTxn deletes an unpaid order and returns its items to stock and
+// its coupon. The order must be the one read by the caller.
+type cancelTxn struct {
+	args  *CancelOrderArgs
+	order *orderRecord
+	reply *int
+}
+
+func newCancelTxn(args *CancelOrderArgs, reply *int) (*cancelTxn, error) {
+	order, err := decodeOrder(args.OrderValue)
+	if err != nil {
+		return nil, err
+	}
+	return &cancelTxn{args: args, order: order, reply: reply}, nil
+}
+
+func (t *cancelTxn) keys() []string {
+	keys := []string{OrderKeyPrefix + t.args.UserToken}
+	for itemID := range t.order.Detail {
+		keys = append(keys, ItemsStockKeyPrefix+strconv.Itoa(itemID))
+	}
+	if t.order.Coupon != "" {
+		keys = append(keys, couponUsedKey(t.order.Coupon), couponUserUsedKey(t.order.Coupon, t.args.UserToken))
+	}
+	return keys
+}
+
+func (t *cancelTxn) run(v *txnView) {
+	orderKey := OrderKeyPrefix + t.args.UserToken
+	value, existed := v.get(orderKey)
+	switch {
+	case !existed:
+		*t.reply = OrderNotFound
+		return
+	case value != t.args.OrderValue:
+		*t.reply = RequestConflict
+		return
+	}
+	if t.order.Paid {
+		*t.reply = OrderPaid
+		return
+	}
+	*t.reply = OK
+	for itemID, itemCnt := range t.order.Detail {
+		stockKey := ItemsStockKeyPrefix + strconv.Itoa(itemID)
+		if stock, existed := v.getInt(stockKey); existed {
+			v.put(stockKey, strconv.Itoa(stock+itemCnt))
+		}
+	}
+	if code := t.order.Coupon; code != "" {
+		for _, key := range []string{couponUsedKey(code), couponUserUsedKey(code, t.args.UserToken)} {
+			if used, _ := v.getInt(key); used > 0 {
+				v.put(key, strconv.Itoa(used-1))
+			}
+		}
+	}
+	v.del(orderKey)
+}
+
+// payTxn pays an order from the balance of the user to the root.
+type payTxn struct {
+	args  *PayOrderArgs
+	reply *int
+}
+
+func (t *payTxn) keys() []string {
+	return append([]string{BalanceKeyPrefix + t.args.UserToken,
+		BalanceKeyPrefix + RootUserToken, OrderKeyPrefix + t.args.OrderIDStr},
+		ledgerKeys(ledgerEntryID(LedgerPayment, t.args.OrderIDStr), t.args.UserToken, RootUserToken)...)
+}
+
+func (t *payTxn) run(v *txnView) {
+	balanceKey := BalanceKeyPrefix + t.args.UserToken
+	rootBalanceKey := BalanceKeyPrefix + RootUserToken
+	orderKey := OrderKeyPrefix + t.args.OrderIDStr
+	*t.reply = OK
+	orderValue, existed := v.get(orderKey)
+	if !existed {
+		*t.reply = OrderNotFound
+		return
+	}
+	order, err := decodeOrder(orderValue)
+	if err != nil {
+		*t.reply = MalformedValue
+		return
+	}
+	if order.Paid {
+		*t.reply = OrderPaid
+		return
+	}
+	balance, existed := v.getInt(balanceKey)
+	if !existed {
+		*t.reply = UserNotFound
+		return
+	}
+	// The total read here, as the order may have been cancelled and
+	// submitted again since the shop read it.
+	if balance < order.Total {
+		*t.reply = BalanceInsufficient
+		return
+	}
+	v.put(balanceKey, strconv.Itoa(balance-order.Total))
+	rootBalance, _ := v.getInt(rootBalanceKey)
+	v.put(rootBalanceKey, strconv.Itoa(rootBalance+order.Total))
+	order.Paid = true
+	v.put(orderKey, order.encode())
+	putLedgerEntry(v, &LedgerEntry{ID: ledgerEntryID(LedgerPayment, t.args.OrderIDStr),
+		Debit: t.args.UserToken, Credit: RootUserToken, Amount: order.Total,
+		OrderID: t.args.OrderIDStr, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+}
@@ -0,0 +1,595 @@
+package shopping
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"rush-shopping/kv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RedeliverInterval is how often the coordinator resends the commits
+	// not acknowledged by all the participants.
+	RedeliverInterval = time.Second
+	// DefaultTxnTimeoutMS bounds the phases of a transaction if the
+	// coordinator is given no timeout.
+	DefaultTxnTimeoutMS = 50
+)
+
+// ShoppingTxnCoordinator fronts the participants holding the shards of
+// the shopping data. It is registered as ShoppingKVStoreService too, so
+// the shop talks to it as to a single ShoppingKVStoreService: the plain
+// operations are forwarded to the participant owning the key, while
+// SubmitOrder and PayOrder run as two-phase commits.
+type ShoppingTxnCoordinator struct {
+	network string
+	addr    string
+	l       net.Listener
+	Dead    int32
+
+	ppts    []*rpcPeer
+	hash    kv.KeyHashFunc
+	timeout time.Duration
+	log     *txnLog
+
+	idPrefix string
+	nextID   uint64
+
+	mu        sync.Mutex
+	active    map[string]bool                  // not decided yet
+	committed map[string]map[string]*TxnWrites // not acknowledged yet
+}
+
+func txnLogPath(addr string) string {
+	return "coordinator-" + strings.NewReplacer(":", "_", "/", "_").Replace(addr) + ".txnlog"
+}
+
+func NewShoppingTxnCoordinator(network, addr string, pptAddrs []string,
+	hash kv.KeyHashFunc, timeoutMS int) *ShoppingTxnCoordinator {
+	log.Printf("Start kvstore coordinator on %s\n", addr)
+	if timeoutMS <= 0 {
+		timeoutMS = DefaultTxnTimeoutMS
+	}
+	txnLog, pending, err := openTxnLog(txnLogPath(addr))
+	if err != nil {
+		log.Fatal("Open txn log error:", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Recover %d committed transactions\n", len(pending))
+	}
+	c := &ShoppingTxnCoordinator{network: network, addr: addr,
+		hash: hash, timeout: time.Duration(timeoutMS) * time.Millisecond, log: txnLog,
+		idPrefix: strconv.FormatInt(time.Now().UnixNano(), 36) + "-",
+		active:   make(map[string]bool), committed: pending,
+	}
+	for _, pptAddr := range pptAddrs {
+		c.ppts = append(c.ppts, newRPCPeer(network, pptAddr))
+	}
+	c.Serve()
+	go c.redeliver()
+	return c
+}
+
+func (c *ShoppingTxnCoordinator) Serve() {
+	rpcs := rpc.NewServer()
+	rpcs.Register(c)
+	rpcs.RegisterName("ShoppingKVStoreService", c)
+	l, e := net.Listen(c.network, c.addr)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	c.l = l
+	go func() {
+		for !c.IsDead() {
+			if conn, err := l.Accept(); err == nil {
+				if !c.IsDead() {
+					// concurrent processing
+					go rpcs.ServeConn(conn)
+				} else if err == nil {
+					conn.Close()
+				}
+			} else {
+				if !c.IsDead() {
+					log.Fatalln(err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (c *ShoppingTxnCoordinator) IsDead() bool {
+	return atomic.LoadInt32(&c.Dead) != 0
+}
+
+func (c *ShoppingTxnCoordinator) Kill() {
+	log.Println("Kill the kvstore coordinator")
+	atomic.StoreInt32(&c.Dead, 1)
+	for _, ppt := range c.ppts {
+		ppt.close()
+	}
+	c.log.close()
+	if err := c.l.Close(); err != nil {
+		log.Fatal("Coordinator rPC server close error:", err)
+	}
+}
+
+func (c *ShoppingTxnCoordinator) owner(key string) int {
+	return c.hash(key, len(c.ppts))
+}
+
+// RPCPing answers for the coordinator itself, which the shops connect to.
+func (c *ShoppingTxnCoordinator) RPCPing(args *kv.PingArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCPing", &err)
+	reply.Flag = true
+	return nil
+}
+
+func (c *ShoppingTxnCoordinator) RPCPut(args *kv.PutArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCPut", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCPut", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) RPCPutNX(args *kv.PutArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCPutNX", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCPutNX", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) RPCExpire(args *kv.ExpireArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCExpire", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCExpire", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) RPCGet(args *kv.GetArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCGet", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCGet", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) RPCIncr(args *kv.IncrArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCIncr", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCIncr", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) RPCDel(args *kv.DelArgs, reply *kv.Reply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCDel", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.RPCDel", args, reply, c.timeout)
+}
+
+// groupByOwner groups the indexes of n keys by the participants owning
+// them.
+func (c *ShoppingTxnCoordinator) groupByOwner(n int, key func(i int) string) map[int][]int {
+	groups := make(map[int][]int)
+	for i := 0; i < n; i++ {
+		owner := c.owner(key(i))
+		groups[owner] = append(groups[owner], i)
+	}
+	return groups
+}
+
+// scatter calls fn for every group of keys on its participant in
+// parallel, and returns the first error.
+func (c *ShoppingTxnCoordinator) scatter(groups map[int][]int, fn func(ppt *rpcPeer, idx []int) error) error {
+	errs := make(chan error, len(groups))
+	for owner, idx := range groups {
+		go func(ppt *rpcPeer, idx []int) {
+			errs <- fn(ppt, idx)
+		}(c.ppts[owner], idx)
+	}
+	var firstErr error
+	for range groups {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RPCMGet gets the keys of every participant in one call to it.
+func (c *ShoppingTxnCoordinator) RPCMGet(args *kv.MGetArgs, reply *kv.MGetReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCMGet", &err)
+	reply.Replies = make([]kv.Reply, len(args.Keys))
+	groups := c.groupByOwner(len(args.Keys), func(i int) string { return args.Keys[i] })
+	return c.scatter(groups, func(ppt *rpcPeer, idx []int) error {
+		pargs := &kv.MGetArgs{Keys: make([]string, len(idx))}
+		for j, i := range idx {
+			pargs.Keys[j] = args.Keys[i]
+		}
+		var r kv.MGetReply
+		if err := ppt.call("ShoppingTxnKVStoreService.RPCMGet", pargs, &r, c.timeout); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			reply.Replies[i] = r.Replies[j]
+		}
+		return nil
+	})
+}
+
+// RPCMPut puts the pairs of every participant in one call to it.
+func (c *ShoppingTxnCoordinator) RPCMPut(args *kv.MPutArgs, reply *kv.MPutReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCMPut", &err)
+	reply.Replies = make([]kv.Reply, len(args.Pairs))
+	groups := c.groupByOwner(len(args.Pairs), func(i int) string { return args.Pairs[i].Key })
+	return c.scatter(groups, func(ppt *rpcPeer, idx []int) error {
+		pargs := &kv.MPutArgs{Pairs: make([]kv.PutArgs, len(idx))}
+		for j, i := range idx {
+			pargs.Pairs[j] = args.Pairs[i]
+		}
+		var r kv.MPutReply
+		if err := ppt.call("ShoppingTxnKVStoreService.RPCMPut", pargs, &r, c.timeout); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			reply.Replies[i] = r.Replies[j]
+		}
+		return nil
+	})
+}
+
+// RPCBatch runs the operations of every participant in one call to it.
+// The operations on a key run in order.
+func (c *ShoppingTxnCoordinator) RPCBatch(args *kv.BatchArgs, reply *kv.BatchReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCBatch", &err)
+	reply.Replies = make([]kv.Reply, len(args.Ops))
+	reply.Errors = make([]string, len(args.Ops))
+	groups := c.groupByOwner(len(args.Ops), func(i int) string { return args.Ops[i].Key })
+	return c.scatter(groups, func(ppt *rpcPeer, idx []int) error {
+		pargs := &kv.BatchArgs{Ops: make([]kv.BatchOp, len(idx))}
+		for j, i := range idx {
+			pargs.Ops[j] = args.Ops[i]
+		}
+		var r kv.BatchReply
+		if err := ppt.call("ShoppingTxnKVStoreService.RPCBatch", pargs, &r, c.timeout); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			reply.Replies[i], reply.Errors[i] = r.Replies[j], r.Errors[j]
+		}
+		return nil
+	})
+}
+
+// RPCScan merges the scans of all the participants.
+func (c *ShoppingTxnCoordinator) RPCScan(args *kv.ScanArgs, reply *kv.ScanReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCScan", &err)
+	replies := make([]kv.ScanReply, len(c.ppts))
+	errs := make([]error, len(c.ppts))
+	var wg sync.WaitGroup
+	for i, ppt := range c.ppts {
+		wg.Add(1)
+		go func(i int, ppt *rpcPeer) {
+			defer wg.Done()
+			errs[i] = ppt.call("ShoppingTxnKVStoreService.RPCScan", args, &replies[i], c.timeout)
+		}(i, ppt)
+	}
+	wg.Wait()
+	reply.Data = make(map[string]string)
+	for i := range replies {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		for key, value := range replies[i].Data {
+			reply.Data[key] = value
+		}
+	}
+	return nil
+}
+
+// RPCWatch watches all the participants, every one resumed after its own
+// version. It replies once any participant has changes, and the versions
+// of the others stay put, so their changes replied late are fetched again.
+// It fails if no participant replied.
+func (c *ShoppingTxnCoordinator) RPCWatch(args *kv.WatchArgs, reply *kv.WatchReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.RPCWatch", &err)
+	type result struct {
+		i     int
+		reply kv.WatchReply
+		err   error
+	}
+	n := len(c.ppts)
+	from := args.Versions
+	if len(from) != n {
+		// Start from the current versions.
+		from = nil
+	}
+	timeout := c.timeout
+	if from != nil {
+		timeout += time.Duration(args.TimeoutMs) * time.Millisecond
+	}
+	results := make(chan result, n)
+	for i, ppt := range c.ppts {
+		pargs := &kv.WatchArgs{Prefix: args.Prefix, TimeoutMs: args.TimeoutMs}
+		if from != nil {
+			pargs.Versions = from[i : i+1]
+		}
+		go func(i int, ppt *rpcPeer, pargs *kv.WatchArgs) {
+			var r kv.WatchReply
+			err := ppt.call("ShoppingTxnKVStoreService.RPCWatch", pargs, &r, timeout)
+			results <- result{i, r, err}
+		}(i, ppt, pargs)
+	}
+
+	reply.Versions = make([]int64, n)
+	copy(reply.Versions, from)
+	var firstErr error
+	failed := 0
+	for got := 0; got < n; got++ {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			failed++
+			continue
+		}
+		reply.Versions[r.i] = r.reply.Versions[0]
+		reply.Events = append(reply.Events, r.reply.Events...)
+		reply.Truncated = reply.Truncated || r.reply.Truncated
+		if from != nil && (len(reply.Events) != 0 || reply.Truncated) {
+			return nil
+		}
+	}
+	if (from == nil || failed == n) && firstErr != nil {
+		// The versions to start from are incomplete, or nothing was
+		// watched.
+		return firstErr
+	}
+	return nil
+}
+
+func (c *ShoppingTxnCoordinator) SubmitOrder(args *SubmitOrderArgs, reply *SubmitOrderReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.SubmitOrder", &err)
+	txn, err := newOrderTxn(args, reply)
+	if err != nil {
+		reply.Status = MalformedValue
+		return nil
+	}
+	return c.runTxn(txn)
+}
+
+func (c *ShoppingTxnCoordinator) PayOrder(args *PayOrderArgs, reply *int) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.PayOrder", &err)
+	return c.runTxn(&payTxn{args: args, reply: reply})
+}
+
+func (c *ShoppingTxnCoordinator) Credit(args *CreditArgs, reply *CreditReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.Credit", &err)
+	return c.runTxn(&creditTxn{args: args, reply: reply})
+}
+
+func (c *ShoppingTxnCoordinator) CancelOrder(args *CancelOrderArgs, reply *int) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.CancelOrder", &err)
+	txn, err := newCancelTxn(args, reply)
+	if err != nil {
+		*reply = MalformedValue
+		return nil
+	}
+	return c.runTxn(txn)
+}
+
+func (c *ShoppingTxnCoordinator) Watch(args *WatchArgs, reply *WatchReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.Watch", &err)
+	return c.runTxn(&watchTxn{args: args, reply: reply})
+}
+
+func (c *ShoppingTxnCoordinator) PopWaitlist(args *PopWaitlistArgs, reply *PopWaitlistReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.PopWaitlist", &err)
+	return c.runTxn(&popWaitlistTxn{args: args, reply: reply})
+}
+
+func (c *ShoppingTxnCoordinator) ReleaseReservation(args *ReleaseArgs, reply *int) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.ReleaseReservation", &err)
+	return c.runTxn(&releaseTxn{args: args, reply: reply})
+}
+
+// TakeToken takes a token of a rate limit on its owner, as the bucket is a
+// single key.
+func (c *ShoppingTxnCoordinator) TakeToken(args *RateLimitArgs, reply *RateLimitReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.TakeToken", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.TakeToken", args, reply, c.timeout)
+}
+
+func (c *ShoppingTxnCoordinator) AdjustStock(args *StockArgs, reply *StockReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.AdjustStock", &err)
+	return c.runTxn(&stockTxn{args: args, reply: reply})
+}
+
+func (c *ShoppingTxnCoordinator) WaitingRoom(args *WaitingRoomArgs, reply *WaitingRoomReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.WaitingRoom", &err)
+	return c.runTxn(&roomTxn{args: args, reply: reply})
+}
+
+// MigrateValue migrates a cart or order on its owner, as it is a single
+// key.
+func (c *ShoppingTxnCoordinator) MigrateValue(args *MigrateArgs, reply *int) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.MigrateValue", &err)
+	return c.ppts[c.owner(args.Key)].call("ShoppingTxnKVStoreService.MigrateValue", args, reply, c.timeout)
+}
+
+// TxnStatus tells an in-doubt participant the outcome of a transaction.
+func (c *ShoppingTxnCoordinator) TxnStatus(args *TxnStatusArgs, reply *TxnStatusReply) (err error) {
+	defer kv.RecoverRPC("ShoppingTxnCoordinator.TxnStatus", &err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[args.TxnID] {
+		reply.Status = TxnPending
+	} else if writes, ok := c.committed[args.TxnID]; ok {
+		reply.Status = TxnCommitted
+		if w := writes[args.Participant]; w != nil {
+			reply.Writes = *w
+		}
+	} else {
+		reply.Status = TxnUnknown
+	}
+	return nil
+}
+
+func (c *ShoppingTxnCoordinator) newTxnID() string {
+	return c.idPrefix + strconv.FormatUint(atomic.AddUint64(&c.nextID, 1), 36)
+}
+
+// runTxn prepares the keys of the transaction on their participants, runs
+// it on the prepared values and commits its writes.
+func (c *ShoppingTxnCoordinator) runTxn(txn shoppingTxn) error {
+	txnID := c.newTxnID()
+	groups := make(map[int][]string)
+	for _, key := range txn.keys() {
+		idx := c.owner(key)
+		groups[idx] = append(groups[idx], key)
+	}
+
+	c.mu.Lock()
+	c.active[txnID] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.active, txnID)
+		c.mu.Unlock()
+	}()
+
+	values, err := c.prepare(txnID, groups)
+	if err != nil {
+		c.abort(txnID, groups)
+		return err
+	}
+	v := newTxnView(values)
+	if err = runSafely(txn, v); err != nil {
+		c.abort(txnID, groups)
+		return err
+	}
+	if len(v.writes) == 0 && len(v.dels) == 0 {
+		// Nothing to commit, just release the locks.
+		c.abort(txnID, groups)
+		return nil
+	}
+
+	writes := make(map[string]*TxnWrites, len(groups))
+	for idx := range groups {
+		writes[c.ppts[idx].addr] = &TxnWrites{Puts: make(map[string]string)}
+	}
+	for key, value := range v.writes {
+		w := writes[c.ppts[c.owner(key)].addr]
+		w.Puts[key] = value
+		if ttl, ok := v.ttls[key]; ok {
+			if w.TTLMs == nil {
+				w.TTLMs = make(map[string]int64)
+			}
+			w.TTLMs[key] = int64(ttl / time.Millisecond)
+		}
+	}
+	for key := range v.dels {
+		w := writes[c.ppts[c.owner(key)].addr]
+		w.Dels = append(w.Dels, key)
+	}
+	if err = c.log.commit(txnID, writes); err != nil {
+		c.abort(txnID, groups)
+		return err
+	}
+	c.mu.Lock()
+	c.committed[txnID] = writes
+	delete(c.active, txnID)
+	c.mu.Unlock()
+	c.commit(txnID, writes)
+	return nil
+}
+
+func (c *ShoppingTxnCoordinator) prepare(txnID string, groups map[int][]string) (map[string]string, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	values := make(map[string]string)
+	for idx, keys := range groups {
+		wg.Add(1)
+		go func(ppt *rpcPeer, keys []string) {
+			defer wg.Done()
+			args := &PrepareArgs{TxnID: txnID, Keys: keys, TimeoutMS: int(c.timeout / time.Millisecond)}
+			var reply PrepareReply
+			// Leave the participant enough time to wait for the locks.
+			err := ppt.call("ShoppingTxnKVStoreService.Prepare", args, &reply, 2*c.timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for key, value := range reply.Values {
+				values[key] = value
+			}
+		}(c.ppts[idx], keys)
+	}
+	wg.Wait()
+	return values, firstErr
+}
+
+// abort releases the participants in background. A lost Abort is
+// resolved by the participant asking TxnStatus.
+func (c *ShoppingTxnCoordinator) abort(txnID string, groups map[int][]string) {
+	for idx := range groups {
+		go func(ppt *rpcPeer) {
+			var ok bool
+			if err := ppt.call("ShoppingTxnKVStoreService.Abort", &TxnIDArgs{txnID}, &ok, c.timeout); err != nil {
+				log.Printf("Abort txn %s on %s error: %v\n", txnID, ppt.addr, err)
+			}
+		}(c.ppts[idx])
+	}
+}
+
+// commit delivers a committed transaction to its participants. It ends
+// the transaction if all of them acknowledge, otherwise it is left to
+// redeliver.
+func (c *ShoppingTxnCoordinator) commit(txnID string, writes map[string]*TxnWrites) {
+	var wg sync.WaitGroup
+	var failed int32
+	for _, ppt := range c.ppts {
+		w, ok := writes[ppt.addr]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(ppt *rpcPeer, w *TxnWrites) {
+			defer wg.Done()
+			var ok bool
+			args := &CommitArgs{TxnID: txnID, Writes: *w}
+			if err := ppt.call("ShoppingTxnKVStoreService.Commit", args, &ok, c.timeout); err != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(ppt, w)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&failed) != 0 {
+		return
+	}
+	c.mu.Lock()
+	delete(c.committed, txnID)
+	c.mu.Unlock()
+	if err := c.log.end(txnID); err != nil {
+		log.Printf("Log end of txn %s error: %v\n", txnID, err)
+	}
+}
+
+// redeliver resends the commits which haven't been acknowledged, including
+// the ones recovered from the log after a crash.
+func (c *ShoppingTxnCoordinator) redeliver() {
+	for _ = range time.Tick(RedeliverInterval) {
+		if c.IsDead() {
+			return
+		}
+		c.mu.Lock()
+		pending := make(map[string]map[string]*TxnWrites, len(c.committed))
+		for txnID, writes := range c.committed {
+			pending[txnID] = writes
+		}
+		c.mu.Unlock()
+		for txnID, writes := range pending {
+			c.commit(txnID, writes)
+		}
+	}
+}
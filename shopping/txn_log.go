@@ -0,0 +1,143 @@
+package shopping
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+const (
+	txnLogCommit = "commit"
+	txnLogEnd    = "end"
+)
+
+// The log is compacted to the transactions not ended once it has
+// txnLogCompactRecords records.
+var txnLogCompactRecords = 10000
+
+// txnLogRecord is one line of the coordinator log. The commit record
+// carries the writes of every participant, so that a committed
+// transaction can be redelivered after a crash of the coordinator.
+type txnLogRecord struct {
+	ID     string
+	Op     string
+	Writes map[string]*TxnWrites `json:",omitempty"` // by participant address
+}
+
+// txnLog is the append-only decision log of the coordinator. Only the
+// commit decisions are logged: a transaction without a commit record is
+// presumed aborted.
+type txnLog struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	enc     *json.Encoder
+	pending map[string]map[string]*TxnWrites // committed but not ended
+	records int                              // in the file
+}
+
+// openTxnLog opens the log at path and returns the transactions committed
+// but not ended. The log is compacted to these transactions.
+func openTxnLog(path string) (*txnLog, map[string]map[string]*TxnWrites, error) {
+	pending := make(map[string]map[string]*TxnWrites)
+	if file, err := os.Open(path); err == nil {
+		dec := json.NewDecoder(bufio.NewReader(file))
+		for {
+			var rec txnLogRecord
+			// A torn record at the tail is the one being written
+			// at the crash, and its transaction is not committed.
+			if err := dec.Decode(&rec); err != nil {
+				break
+			}
+			switch rec.Op {
+			case txnLogCommit:
+				pending[rec.ID] = rec.Writes
+			case txnLogEnd:
+				delete(pending, rec.ID)
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	l := &txnLog{path: path, pending: make(map[string]map[string]*TxnWrites, len(pending))}
+	for id, writes := range pending {
+		l.pending[id] = writes
+	}
+	if err := l.compact(); err != nil {
+		return nil, nil, err
+	}
+	return l, pending, nil
+}
+
+// compact replaces the file by one of the commit records pending, and
+// must be called with mu held.
+func (l *txnLog) compact() error {
+	tmpPath := l.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for id, writes := range l.pending {
+		if err = enc.Encode(&txnLogRecord{ID: id, Op: txnLogCommit, Writes: writes}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.enc, l.records = file, enc, len(l.pending)
+	return nil
+}
+
+// commit durably records the commit decision of the transaction.
+func (l *txnLog) commit(id string, writes map[string]*TxnWrites) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&txnLogRecord{ID: id, Op: txnLogCommit, Writes: writes}); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.pending[id] = writes
+	l.records++
+	return nil
+}
+
+// end records that all the participants have applied the transaction.
+// It is not synced, losing it only causes a redundant redelivery. The
+// log is compacted once it has grown to txnLogCompactRecords.
+func (l *txnLog) end(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&txnLogRecord{ID: id, Op: txnLogEnd}); err != nil {
+		return err
+	}
+	delete(l.pending, id)
+	if l.records++; l.records >= txnLogCompactRecords {
+		return l.compact()
+	}
+	return nil
+}
+
+func (l *txnLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,303 @@
+package shopping
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rush-shopping/kv"
+)
+
+// Status of a transaction reported by the coordinator.
+const (
+	TxnUnknown = iota // never committed, so it is presumed aborted
+	TxnPending        // the coordinator hasn't decided yet
+	TxnCommitted
+)
+
+const (
+	// A participant asks the coordinator for the outcome of the
+	// transactions prepared longer than InDoubtTimeout.
+	InDoubtTimeout       = 2 * time.Second
+	InDoubtCheckInterval = time.Second
+	// The decided transactions are remembered for finishedRetention,
+	// so that a late Prepare of an aborted transaction is refused.
+	finishedRetention = time.Minute
+)
+
+var (
+	ErrTxnLockTimeout = errors.New("txn: lock timeout")
+	ErrTxnFinished    = errors.New("txn: already finished")
+)
+
+type PrepareArgs struct {
+	TxnID     string
+	Keys      []string
+	TimeoutMS int // how long to wait for the locks
+}
+
+// PrepareReply holds the values of the existing prepared keys.
+type PrepareReply struct {
+	Values map[string]string
+}
+
+// TxnWrites is the part of a transaction applied by one participant.
+type TxnWrites struct {
+	Puts  map[string]string
+	TTLMs map[string]int64 `json:",omitempty"` // of the puts expiring
+	Dels  []string
+}
+
+type CommitArgs struct {
+	TxnID  string
+	Writes TxnWrites
+}
+
+type TxnIDArgs struct {
+	TxnID string
+}
+
+type TxnStatusArgs struct {
+	TxnID       string
+	Participant string
+}
+
+type TxnStatusReply struct {
+	Status int
+	Writes TxnWrites
+}
+
+type preparedTxn struct {
+	keys   map[string]bool
+	values map[string]string
+	unlock func()
+	since  time.Time
+	locked []string // the keys in the order prepared, for the slowlog
+}
+
+// release releases the locks of the transaction.
+func (p *preparedTxn) release() {
+	p.unlock()
+}
+
+// ShoppingTxnKVStoreService is a participant of the two-phase commits
+// run by the ShoppingTxnCoordinator. A prepared transaction holds the
+// locks of its keys until it is committed or aborted.
+type ShoppingTxnKVStoreService struct {
+	*ShoppingKVStore
+	network string
+	addr    string
+	l       net.Listener
+	coord   *rpcPeer
+
+	mu       sync.Mutex
+	prepared map[string]*preparedTxn
+	finished map[string]time.Time
+}
+
+func NewShoppingTxnKVStoreService(network, addr, coordAddr string) *ShoppingTxnKVStoreService {
+	log.Printf("Start kvstore participant on %s\n", addr)
+	service := &ShoppingTxnKVStoreService{ShoppingKVStore: NewShoppingKVStore(),
+		network: network, addr: addr, coord: newRPCPeer(network, coordAddr),
+		prepared: make(map[string]*preparedTxn), finished: make(map[string]time.Time),
+	}
+	service.Serve()
+	go service.resolveInDoubt()
+	return service
+}
+
+func (service *ShoppingTxnKVStoreService) Serve() {
+	rpcs := rpc.NewServer()
+	rpcs.Register(service)
+	l, e := net.Listen(service.network, service.addr)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	service.l = l
+	go func() {
+		for !service.IsDead() {
+			if conn, err := l.Accept(); err == nil {
+				if !service.IsDead() {
+					// concurrent processing
+					go kv.ServeConn(rpcs, conn)
+				} else if err == nil {
+					conn.Close()
+				}
+			} else {
+				if !service.IsDead() {
+					log.Fatalln(err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (service *ShoppingTxnKVStoreService) IsDead() bool {
+	return atomic.LoadInt32(&service.Dead) != 0
+}
+
+// Clear the data and close the participant.
+func (service *ShoppingTxnKVStoreService) Kill() {
+	log.Println("Kill the kvstore participant")
+	atomic.StoreInt32(&service.Dead, 1)
+	service.Clear()
+	service.Close()
+	service.coord.close()
+	if err := service.l.Close(); err != nil {
+		log.Fatal("Kvsotre rPC server close error:", err)
+	}
+}
+
+// Prepare locks the keys of the transaction and returns their values.
+// The locks are held until the transaction is committed or aborted, but
+// the slowlog times the Prepare and the Commit or Abort as their own
+// entries, so the wait for the coordinator in between isn't counted.
+func (service *ShoppingTxnKVStoreService) Prepare(args *PrepareArgs, reply *PrepareReply) (err error) {
+	defer service.RecoverRPC("ShoppingTxnKVStoreService.Prepare", time.Now(), &err)
+	if service.ReadOnly() {
+		return kv.ErrReadOnly
+	}
+	service.mu.Lock()
+	if p, ok := service.prepared[args.TxnID]; ok {
+		service.mu.Unlock()
+		reply.Values = p.values
+		return nil
+	}
+	if _, ok := service.finished[args.TxnID]; ok {
+		service.mu.Unlock()
+		return ErrTxnFinished
+	}
+	service.mu.Unlock()
+
+	op := service.StartOp("ShoppingTxnKVStoreService.Prepare", args)
+	defer op.Finish()
+	timeout := time.Duration(args.TimeoutMS) * time.Millisecond
+	unlock, ok := op.TryLock(timeout, args.Keys...)
+	if !ok {
+		return ErrTxnLockTimeout
+	}
+	p := &preparedTxn{keys: make(map[string]bool, len(args.Keys)),
+		values: make(map[string]string, len(args.Keys)), unlock: unlock, since: time.Now(), locked: args.Keys}
+	for _, key := range args.Keys {
+		p.keys[key] = true
+		if value, existed := service.RawGet(key); existed {
+			p.values[key] = value
+		}
+	}
+
+	service.mu.Lock()
+	// The coordinator may have given up while we were waiting.
+	if _, ok := service.finished[args.TxnID]; ok {
+		service.mu.Unlock()
+		p.release()
+		return ErrTxnFinished
+	}
+	service.prepared[args.TxnID] = p
+	service.mu.Unlock()
+	reply.Values = p.values
+	return nil
+}
+
+// Commit applies the writes of a prepared transaction and releases its
+// locks. Committing a finished transaction is a no-op.
+func (service *ShoppingTxnKVStoreService) Commit(args *CommitArgs, reply *bool) (err error) {
+	defer service.RecoverRPC("ShoppingTxnKVStoreService.Commit", time.Now(), &err)
+	op := service.StartOp("ShoppingTxnKVStoreService.Commit", args)
+	defer op.Finish()
+	if p := service.finish(args.TxnID); p != nil {
+		op.AddKeys(p.locked...)
+		service.apply(p, &args.Writes)
+	}
+	*reply = true
+	return nil
+}
+
+// Abort releases the locks of a prepared transaction. Aborting an unknown
+// transaction prevents it from being prepared later.
+func (service *ShoppingTxnKVStoreService) Abort(args *TxnIDArgs, reply *bool) (err error) {
+	defer service.RecoverRPC("ShoppingTxnKVStoreService.Abort", time.Now(), &err)
+	op := service.StartOp("ShoppingTxnKVStoreService.Abort", args)
+	defer op.Finish()
+	if p := service.finish(args.TxnID); p != nil {
+		op.AddKeys(p.locked...)
+		p.release()
+	}
+	*reply = true
+	return nil
+}
+
+// finish marks the transaction as decided and returns it if it is prepared.
+func (service *ShoppingTxnKVStoreService) finish(txnID string) *preparedTxn {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	p := service.prepared[txnID]
+	delete(service.prepared, txnID)
+	service.finished[txnID] = time.Now()
+	return p
+}
+
+func (service *ShoppingTxnKVStoreService) apply(p *preparedTxn, writes *TxnWrites) {
+	defer p.release()
+	for key, value := range writes.Puts {
+		if p.keys[key] {
+			service.RawPut(key, value)
+			if ttlMs, ok := writes.TTLMs[key]; ok {
+				service.RawExpire(key, time.Duration(ttlMs)*time.Millisecond)
+			}
+		} else {
+			log.Printf("Ignore the write of unprepared key %s\n", key)
+		}
+	}
+	for _, key := range writes.Dels {
+		if p.keys[key] {
+			service.RawDel(key)
+		}
+	}
+}
+
+// resolveInDoubt asks the coordinator for the outcome of the transactions
+// prepared for too long, e.g. because the coordinator crashed before
+// delivering its decision.
+func (service *ShoppingTxnKVStoreService) resolveInDoubt() {
+	for _ = range time.Tick(InDoubtCheckInterval) {
+		if service.IsDead() {
+			return
+		}
+		var inDoubt []string
+		service.mu.Lock()
+		for txnID, p := range service.prepared {
+			if time.Since(p.since) > InDoubtTimeout {
+				inDoubt = append(inDoubt, txnID)
+			}
+		}
+		for txnID, at := range service.finished {
+			if time.Since(at) > finishedRetention {
+				delete(service.finished, txnID)
+			}
+		}
+		service.mu.Unlock()
+
+		for _, txnID := range inDoubt {
+			args := &TxnStatusArgs{TxnID: txnID, Participant: service.addr}
+			var reply TxnStatusReply
+			if err := service.coord.call("ShoppingTxnCoordinator.TxnStatus", args, &reply, InDoubtTimeout); err != nil {
+				log.Printf("Query status of txn %s error: %v\n", txnID, err)
+				continue
+			}
+			switch reply.Status {
+			case TxnCommitted:
+				if p := service.finish(txnID); p != nil {
+					service.apply(p, &reply.Writes)
+				}
+			case TxnUnknown:
+				if p := service.finish(txnID); p != nil {
+					p.release()
+				}
+			}
+		}
+	}
+}
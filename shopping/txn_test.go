@@ -0,0 +1,371 @@
+package shopping
+
+import (
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rush-shopping/kv"
+)
+
+func startTxnCluster(coordAddr string, pptAddrs []string) (*ShoppingTxnCoordinator, []*ShoppingTxnKVStoreService) {
+	var ppts []*ShoppingTxnKVStoreService
+	for _, addr := range pptAddrs {
+		ppts = append(ppts, NewShoppingTxnKVStoreService("tcp", addr, coordAddr))
+	}
+	coord := NewShoppingTxnCoordinator("tcp", coordAddr, pptAddrs, kv.DefaultKeyHashFunc, 100)
+	return coord, ppts
+}
+
+func stopTxnCluster(coord *ShoppingTxnCoordinator, ppts []*ShoppingTxnKVStoreService) {
+	coord.Kill()
+	for _, ppt := range ppts {
+		ppt.Kill()
+	}
+	os.Remove(txnLogPath(coord.addr))
+}
+
+func TestTxnSubmitAndPay(t *testing.T) {
+	coordAddr := "localhost:12100"
+	coord, ppts := startTxnCluster(coordAddr, []string{"localhost:12101", "localhost:12102"})
+	defer stopTxnCluster(coord, ppts)
+	for _, ppt := range ppts {
+		ppt.SetSlowlogThreshold(0)
+	}
+
+	client, err := rpc.Dial("tcp", coordAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	put := func(key, value string) {
+		var reply kv.Reply
+		if err := client.Call("ShoppingKVStoreService.RPCPut", &kv.PutArgs{Key: key, Value: value}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key string) string {
+		var reply kv.Reply
+		if err := client.Call("ShoppingKVStoreService.RPCGet", &kv.GetArgs{Key: key}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Value
+	}
+	put(ItemsStockKeyPrefix+"1", "2")
+	put(ItemsPriceKeyPrefix+"1", "10")
+	put(ItemsStockKeyPrefix+"2", "1")
+	put(ItemsPriceKeyPrefix+"2", "7")
+	put(BalanceKeyPrefix+"1", "100")
+	put(BalanceKeyPrefix+"2", "100")
+	put(BalanceKeyPrefix+RootUserToken, "0")
+
+	var watchReply kv.WatchReply
+	if err := client.Call("ShoppingKVStoreService.RPCWatch", &kv.WatchArgs{Prefix: ItemsStockKeyPrefix}, &watchReply); err != nil {
+		t.Fatal(err)
+	}
+	var orderReply SubmitOrderReply
+	cart := newCart(ValueSchemaV1)
+	cart.Num, cart.Detail[1], cart.Detail[2], cart.Prices[1] = 3, 2, 1, 9
+	args := &SubmitOrderArgs{CartIDStr: "1", UserToken: "1", CartValue: cart.encode()}
+	if err := client.Call("ShoppingKVStoreService.SubmitOrder", args, &orderReply); err != nil ||
+		orderReply != (SubmitOrderReply{Status: OK, Total: 27, PriceDiff: 2}) {
+		t.Fatalf("SubmitOrder = %v, %v; expected OK with total 27", orderReply, err)
+	}
+	if stock := get(ItemsStockKeyPrefix + "1"); stock != "0" {
+		t.Fatalf("stock of item 1 = %v; expected 0", stock)
+	}
+	// The changes of both the participants are watched.
+	changed := make(map[string]string)
+	for i := 0; i < 2 && len(changed) < 2; i++ {
+		args := &kv.WatchArgs{Prefix: ItemsStockKeyPrefix, Versions: watchReply.Versions, TimeoutMs: 1000}
+		if err := client.Call("ShoppingKVStoreService.RPCWatch", args, &watchReply); err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range watchReply.Events {
+			changed[ev.Key] = ev.New
+		}
+	}
+	if changed[ItemsStockKeyPrefix+"1"] != "0" || changed[ItemsStockKeyPrefix+"2"] != "0" {
+		t.Fatalf("watched changes %v; expected both the stocks to be 0", changed)
+	}
+	args = &SubmitOrderArgs{CartIDStr: "2", UserToken: "2", CartValue: "1.2:1"}
+	if err := client.Call("ShoppingKVStoreService.SubmitOrder", args, &orderReply); err != nil || orderReply.Status != OutOfStock {
+		t.Fatalf("SubmitOrder = %v, %v; expected OutOfStock", orderReply, err)
+	}
+
+	var status int
+	payArgs := &PayOrderArgs{OrderIDStr: "1", UserToken: "1"}
+	if err := client.Call("ShoppingKVStoreService.PayOrder", payArgs, &status); err != nil || status != OK {
+		t.Fatalf("PayOrder = %v, %v; expected OK", status, err)
+	}
+	if err := client.Call("ShoppingKVStoreService.PayOrder", payArgs, &status); err != nil || status != OrderPaid {
+		t.Fatalf("PayOrder = %v, %v; expected OrderPaid", status, err)
+	}
+	if b, rb := get(BalanceKeyPrefix+"1"), get(BalanceKeyPrefix+RootUserToken); b != "73" || rb != "27" {
+		t.Fatalf("balances = %v, %v; expected 73, 27", b, rb)
+	}
+
+	// The Prepare and Commit of the transactions are logged apart, as
+	// called by the coordinator.
+	pptClient, err := rpc.Dial("tcp", ppts[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pptClient.Close()
+	var slowlog kv.SlowlogReply
+	if err := pptClient.Call("ShoppingTxnKVStoreService.RPCSlowlog", &kv.SlowlogArgs{}, &slowlog); err != nil {
+		t.Fatal(err)
+	}
+	logged := make(map[string]int)
+	for _, e := range slowlog.Entries {
+		if e.Op == "ShoppingTxnKVStoreService.Prepare" || e.Op == "ShoppingTxnKVStoreService.Commit" {
+			logged[e.Op]++
+			if e.Caller == "" || len(e.Keys) == 0 || e.Duration < e.LockWait {
+				t.Fatalf("slowlog entry %+v", e)
+			}
+		}
+	}
+	if len(logged) != 2 {
+		t.Fatalf("no Prepare or Commit in the slowlog %+v", slowlog.Entries)
+	}
+}
+
+func TestPayOrderLedger(t *testing.T) {
+	f := newFlakyKV()
+	ss := &ShopServer{ClientPool: f, Options: DefaultShopOptions()}
+	sks := f.sks
+	sks.Put(ItemsStockKeyPrefix+"1", "5")
+	sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	sks.Put(BalanceKeyPrefix+"1", "100")
+	sks.Put(BalanceKeyPrefix+RootUserToken, "0")
+	for _, token := range []string{"1", "2"} {
+		var reply SubmitOrderReply
+		sks.SubmitOrder(&SubmitOrderArgs{CartIDStr: token, UserToken: token, CartValue: "1.1:1"}, &reply)
+		if reply.Status != OK {
+			t.Fatalf("SubmitOrder of %s = %v", token, reply)
+		}
+	}
+
+	var status int
+	payArgs := &PayOrderArgs{OrderIDStr: "1", UserToken: "1"}
+	for i := 0; i < 2; i++ {
+		sks.PayOrder(payArgs, &status)
+	}
+	if status != OrderPaid {
+		t.Fatalf("PayOrder again = %v; expected OrderPaid", status)
+	}
+	// The user without a balance pays nothing, and writes no entry.
+	sks.PayOrder(&PayOrderArgs{OrderIDStr: "2", UserToken: "2"}, &status)
+	if status != UserNotFound {
+		t.Fatalf("PayOrder without a balance = %v; expected UserNotFound", status)
+	}
+	if _, existed := sks.Get(LedgerKeyPrefix + ledgerEntryID(LedgerPayment, "2")); existed {
+		t.Fatal("ledger entry of the order not paid")
+	}
+
+	for account, n := range map[string]int{"": 1, "1": 1, RootUserToken: 1, "2": 0} {
+		entries, err := ss.loadLedger(account)
+		if err != nil || len(entries) != n {
+			t.Fatalf("ledger of %q = %v, %v; expected %d entries", account, entries, err, n)
+		}
+		if n > 0 && (entries[0].Debit != "1" || entries[0].Credit != RootUserToken || entries[0].Amount != 10) {
+			t.Fatalf("wrong ledger entry %+v", entries[0])
+		}
+	}
+	if b, existed := sks.Get(BalanceKeyPrefix + "1"); !existed || b != "90" {
+		t.Fatalf("balance of 1 = %v; expected 90", b)
+	}
+	if stat := sks.RPCStats()["ShoppingKVStore.PayOrder"]; stat.Calls != 3 {
+		t.Fatalf("PayOrder stats %+v; expected 3 calls", stat)
+	}
+}
+
+func TestTxnLogCompaction(t *testing.T) {
+	defer func(n int) { txnLogCompactRecords = n }(txnLogCompactRecords)
+	txnLogCompactRecords = 5
+	dir, err := ioutil.TempDir("", "txnlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "coordinator.txnlog")
+
+	l, _, err := openTxnLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string]*TxnWrites{"ppt": {Puts: map[string]string{"k": "v"}}}
+	for _, id := range []string{"txn-1", "txn-2", "txn-3"} {
+		if err = l.commit(id, writes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.end("txn-1")
+	l.end("txn-3") // the 5th record compacts the log to txn-2
+	l.commit("txn-4", writes)
+	l.close()
+
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Fatalf("log of %d records after the compaction:\n%s", lines, data)
+	}
+	l, pending, err := openTxnLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	if len(pending) != 2 || pending["txn-2"] == nil || pending["txn-4"] == nil {
+		t.Fatalf("pending %v; expected txn-2 and txn-4", pending)
+	}
+}
+
+func TestTxnRecovery(t *testing.T) {
+	coordAddr := "localhost:12200"
+	pptAddr := "localhost:12201"
+	ppts := []*ShoppingTxnKVStoreService{NewShoppingTxnKVStoreService("tcp", pptAddr, coordAddr)}
+
+	// A transaction committed by a coordinator crashed before delivering
+	// it, and another one it never decided.
+	l, _, err := openTxnLog(txnLogPath(coordAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string]*TxnWrites{pptAddr: {Puts: map[string]string{"k1": "committed"}}}
+	if err = l.commit("txn-1", writes); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	var reply PrepareReply
+	ppts[0].Prepare(&PrepareArgs{TxnID: "txn-1", Keys: []string{"k1"}, TimeoutMS: 100}, &reply)
+	ppts[0].Prepare(&PrepareArgs{TxnID: "txn-2", Keys: []string{"k2"}, TimeoutMS: 100}, &reply)
+
+	coord := NewShoppingTxnCoordinator("tcp", coordAddr, []string{pptAddr}, kv.DefaultKeyHashFunc, 100)
+	defer stopTxnCluster(coord, ppts)
+
+	deadline := time.Now().Add(InDoubtTimeout + 3*InDoubtCheckInterval)
+	for time.Now().Before(deadline) {
+		if v, _ := ppts[0].Get("k1"); v == "committed" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if v, _ := ppts[0].Get("k1"); v != "committed" {
+		t.Fatalf("committed txn is not redelivered, k1 = %q", v)
+	}
+	// The undecided transaction is presumed aborted and releases k2.
+	unlock, ok := ppts[0].TryLockKeys(InDoubtTimeout+3*InDoubtCheckInterval, "k2")
+	if !ok {
+		t.Fatalf("in-doubt txn still holds its locks")
+	}
+	unlock()
+}
+
+// panicTxn writes and then panics, like a txn on a malformed value.
+type panicTxn struct{}
+
+func (panicTxn) keys() []string { return []string{"k"} }
+
+func (panicTxn) run(v *txnView) {
+	v.put("k", "written")
+	panic("malformed value")
+}
+
+func TestTxnPanicRecovered(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put("k", "v")
+	panics := kv.Panics()
+	if err := sks.runTxn("Panic", nil, panicTxn{}); err == nil {
+		t.Fatal("panicking txn returned no error")
+	}
+	if kv.Panics() != panics+1 {
+		t.Fatalf("%d panics counted; expected %d", kv.Panics(), panics+1)
+	}
+	if v, _ := sks.Get("k"); v != "v" {
+		t.Fatalf("k = %q; the panicking txn must not write", v)
+	}
+	unlock, ok := sks.TryLockKeys(100*time.Millisecond, "k")
+	if !ok {
+		t.Fatal("panicking txn still holds its locks")
+	}
+	unlock()
+
+	// An RPC method panicking out of its txn, here on no args, fails.
+	var status int
+	panics = sks.Panics()
+	if err := sks.PayOrder(nil, &status); err == nil {
+		t.Fatal("PayOrder of no args returned no error")
+	}
+	if sks.Panics() != panics+1 || sks.RPCStats()["ShoppingKVStore.PayOrder"].Errors != 1 {
+		t.Fatalf("%d panics, stats %+v", sks.Panics()-panics, sks.RPCStats()["ShoppingKVStore.PayOrder"])
+	}
+}
+
+func TestCoordinatorBatch(t *testing.T) {
+	coordAddr := "localhost:12300"
+	coord, ppts := startTxnCluster(coordAddr, []string{"localhost:12301", "localhost:12302"})
+	defer stopTxnCluster(coord, ppts)
+
+	client, err := rpc.Dial("tcp", coordAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var keys []string
+	var pairs []kv.PutArgs
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		keys = append(keys, key)
+		pairs = append(pairs, kv.PutArgs{Key: key, Value: strconv.Itoa(i)})
+	}
+	var putReply kv.MPutReply
+	if err := client.Call("ShoppingKVStoreService.RPCMPut", &kv.MPutArgs{Pairs: pairs}, &putReply); err != nil {
+		t.Fatal(err)
+	}
+	for _, ppt := range ppts {
+		if len(ppt.Scan("k")) == len(keys) {
+			t.Fatal("all the keys are put on one participant")
+		}
+	}
+	var getReply kv.MGetReply
+	if err := client.Call("ShoppingKVStoreService.RPCMGet", &kv.MGetArgs{Keys: append(keys, "none")}, &getReply); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range getReply.Replies[:len(keys)] {
+		if !r.Flag || r.Value != strconv.Itoa(i) {
+			t.Fatalf("MGet %s = %+v", keys[i], r)
+		}
+	}
+	if getReply.Replies[len(keys)].Flag {
+		t.Fatal("MGet of a missing key found it")
+	}
+
+	ops := []kv.BatchOp{{Op: kv.OpIncr, Key: "k1", Delta: 2}, {Op: kv.OpGet, Key: "k1"},
+		{Op: kv.OpDel, Key: "k2"}, {Op: "bad", Key: "k3"}}
+	var batchReply kv.BatchReply
+	if err := client.Call("ShoppingKVStoreService.RPCBatch", &kv.BatchArgs{Ops: ops}, &batchReply); err != nil {
+		t.Fatal(err)
+	}
+	if batchReply.Replies[1].Value != "3" || !batchReply.Replies[2].Flag || batchReply.Errors[3] == "" {
+		t.Fatalf("batch = %+v", batchReply)
+	}
+}
+
+func TestCoordinatorWatchFails(t *testing.T) {
+	// No participant is listening, and no timeout is given.
+	coord := NewShoppingTxnCoordinator("tcp", "localhost:12400", []string{"localhost:12401", "localhost:12402"},
+		kv.DefaultKeyHashFunc, 0)
+	defer stopTxnCluster(coord, nil)
+	if coord.timeout != DefaultTxnTimeoutMS*time.Millisecond {
+		t.Fatalf("timeout %v; expected the default", coord.timeout)
+	}
+	var reply kv.WatchReply
+	args := &kv.WatchArgs{Prefix: ItemsStockKeyPrefix, Versions: []int64{1, 1}, TimeoutMs: 10}
+	if err := coord.RPCWatch(args, &reply); err == nil {
+		t.Fatal("RPCWatch of no participant returned no error")
+	}
+}
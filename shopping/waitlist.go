@@ -0,0 +1,436 @@
+package shopping
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-system/http"
+)
+
+// The shops return the expired reservations to stock every
+// ReservationSweepInterval, which is also the width of the buckets of the
+// expiry index. The buckets are kept for ReservationIndexRetention after
+// they end, which is how far back a shop sweeps when it starts.
+const (
+	ReservationSweepInterval  = 5 * time.Second
+	ReservationIndexRetention = time.Hour
+)
+
+// RestockNotifier tells a waitlisted user that the item is back in stock.
+// reservedUntil is the unix milliseconds the user's reservation lasts, or
+// 0 if nothing is reserved.
+type RestockNotifier interface {
+	Notify(token string, itemID int, reservedUntil int64) error
+}
+
+// LogNotifier only logs the notifications.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(token string, itemID int, reservedUntil int64) error {
+	log.Printf("Notify user %s of restocked item %d, reserved until %d\n", token, itemID, reservedUntil)
+	return nil
+}
+
+type Notification struct {
+	Token         string
+	ItemID        int
+	ReservedUntil int64
+}
+
+// InMemoryNotifier records the notifications. It is meant for tests.
+type InMemoryNotifier struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func (n *InMemoryNotifier) Notify(token string, itemID int, reservedUntil int64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = append(n.notifications, Notification{token, itemID, reservedUntil})
+	return nil
+}
+
+// Notifications returns the notifications in the order sent.
+func (n *InMemoryNotifier) Notifications() []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Notification(nil), n.notifications...)
+}
+
+func waitlistKey(itemID int) string {
+	return WaitlistKeyPrefix + strconv.Itoa(itemID)
+}
+
+func waitlistEntryKey(itemID, seq int) string {
+	return WaitlistEntryKeyPrefix + strconv.Itoa(itemID) + ":" + strconv.Itoa(seq)
+}
+
+func waitlistUserKey(itemID int, token string) string {
+	return WaitlistUserKeyPrefix + strconv.Itoa(itemID) + ":" + token
+}
+
+func reservationKey(itemID int, token string) string {
+	return ReservationKeyPrefix + strconv.Itoa(itemID) + ":" + token
+}
+
+// composeWaitlist encodes the ends of a waitlist: the seq of its head and
+// the seq the next user gets. The users waiting are the entries between.
+// 3|5
+func composeWaitlist(head, tail int) string {
+	return strconv.Itoa(head) + "|" + strconv.Itoa(tail)
+}
+
+func parseWaitlist(value string) (head, tail int) {
+	info := strings.Split(value, "|")
+	if len(info) != 2 {
+		return
+	}
+	head, _ = strconv.Atoi(info[0])
+	tail, _ = strconv.Atoi(info[1])
+	return
+}
+
+// reservationBucket is the bucket of the expiry index holding the
+// reservations which expire at expiresAt. A bucket lists them by
+// <id>:<token>, so that the sweep reads them without a scan.
+// 1:3,2:7
+func reservationBucket(expiresAt int64) int64 {
+	return expiresAt / int64(ReservationSweepInterval/time.Millisecond)
+}
+
+func reservationExpiryKey(bucket int64) string {
+	return ReservationExpiryKeyPrefix + strconv.FormatInt(bucket, 10)
+}
+
+// composeReservation encodes the units of an item held for a user.
+// 1|1500000060000
+func composeReservation(count int, expiresAt int64) string {
+	return strconv.Itoa(count) + "|" + strconv.FormatInt(expiresAt, 10)
+}
+
+func parseReservation(value string) (count int, expiresAt int64) {
+	info := strings.Split(value, "|")
+	if len(info) != 2 {
+		return
+	}
+	count, _ = strconv.Atoi(info[0])
+	expiresAt, _ = strconv.ParseInt(info[1], 10, 64)
+	return
+}
+
+// WatchArgs appends the user to the waitlist, expected to end at Tail.
+type WatchArgs struct {
+	ItemID    int
+	UserToken string
+	Tail      int // read before, or from the reply of the last try
+}
+
+type WatchReply struct {
+	Status   int // RequestConflict if the waitlist doesn't end at Tail
+	Position int // 1 for the head of the waitlist
+	Tail     int // where the waitlist ends, to try again with
+}
+
+// watchTxn appends the user to the waitlist of the item, unless the user
+// is already in it.
+type watchTxn struct {
+	args  *WatchArgs
+	reply *WatchReply
+}
+
+func (t *watchTxn) keys() []string {
+	return []string{waitlistKey(t.args.ItemID), waitlistUserKey(t.args.ItemID, t.args.UserToken),
+		waitlistEntryKey(t.args.ItemID, t.args.Tail)}
+}
+
+func (t *watchTxn) run(v *txnView) {
+	value, _ := v.get(waitlistKey(t.args.ItemID))
+	head, tail := parseWaitlist(value)
+	if seq, existed := v.getInt(waitlistUserKey(t.args.ItemID, t.args.UserToken)); existed {
+		t.reply.Status, t.reply.Position = OK, seq-head+1
+		return
+	}
+	if tail != t.args.Tail {
+		t.reply.Status, t.reply.Tail = RequestConflict, tail
+		return
+	}
+	t.reply.Status, t.reply.Position = OK, tail-head+1
+	v.put(waitlistEntryKey(t.args.ItemID, tail), t.args.UserToken)
+	v.put(waitlistUserKey(t.args.ItemID, t.args.UserToken), strconv.Itoa(tail))
+	v.put(waitlistKey(t.args.ItemID), composeWaitlist(head, tail+1))
+}
+
+// PopWaitlistArgs takes Tokens off the head of the waitlist. If ReserveMs
+// is positive, a unit of stock is reserved for each of them until Now
+// plus ReserveMs, and only as many as in stock are taken.
+type PopWaitlistArgs struct {
+	ItemID    int
+	Head      int      // the seq of the head, read before
+	Tokens    []string // the entries from Head, read before
+	ReserveMs int64
+	Now       int64
+}
+
+type PopWaitlistReply struct {
+	Status int
+	Popped []string
+}
+
+type popWaitlistTxn struct {
+	args  *PopWaitlistArgs
+	reply *PopWaitlistReply
+}
+
+func (t *popWaitlistTxn) keys() []string {
+	keys := []string{waitlistKey(t.args.ItemID), ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)}
+	for i, token := range t.args.Tokens {
+		keys = append(keys, waitlistEntryKey(t.args.ItemID, t.args.Head+i),
+			waitlistUserKey(t.args.ItemID, token), reservationKey(t.args.ItemID, token))
+	}
+	if t.args.ReserveMs > 0 {
+		keys = append(keys, reservationExpiryKey(reservationBucket(t.args.Now+t.args.ReserveMs)))
+	}
+	return keys
+}
+
+func (t *popWaitlistTxn) run(v *txnView) {
+	value, _ := v.get(waitlistKey(t.args.ItemID))
+	head, tail := parseWaitlist(value)
+	if head != t.args.Head || tail-head < len(t.args.Tokens) {
+		t.reply.Status = RequestConflict
+		return
+	}
+	for i, token := range t.args.Tokens {
+		if entry, _ := v.get(waitlistEntryKey(t.args.ItemID, head+i)); entry != token {
+			t.reply.Status = RequestConflict
+			return
+		}
+	}
+	t.reply.Status = OK
+	tokens := t.args.Tokens
+	n := len(tokens)
+	stockKey := ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)
+	if t.args.ReserveMs > 0 {
+		stock, _ := v.getInt(stockKey)
+		held := make(map[string]int, n)
+		for _, token := range tokens {
+			key := reservationKey(t.args.ItemID, token)
+			if value, existed := v.get(key); existed {
+				// The expired units go back to stock.
+				if count, expiresAt := parseReservation(value); expiresAt > t.args.Now {
+					held[token] = count
+				} else {
+					stock += count
+					v.del(key)
+				}
+			}
+		}
+		if stock < n {
+			n = stock
+		}
+		if n < 0 {
+			n = 0
+		}
+		v.put(stockKey, strconv.Itoa(stock-n))
+		if n == 0 {
+			return
+		}
+		expiresAt := t.args.Now + t.args.ReserveMs
+		bucket := reservationBucket(expiresAt)
+		indexKey := reservationExpiryKey(bucket)
+		index, _ := v.get(indexKey)
+		for _, token := range tokens[:n] {
+			v.put(reservationKey(t.args.ItemID, token), composeReservation(held[token]+1, expiresAt))
+			if index != "" {
+				index += ","
+			}
+			index += strconv.Itoa(t.args.ItemID) + ":" + token
+		}
+		// The bucket ends at the start of the next one.
+		end := (bucket + 1) * int64(ReservationSweepInterval/time.Millisecond)
+		v.putTTL(indexKey, index, time.Duration(end-t.args.Now)*time.Millisecond+ReservationIndexRetention)
+	}
+	t.reply.Popped = tokens[:n]
+	for i, token := range tokens[:n] {
+		v.del(waitlistEntryKey(t.args.ItemID, head+i))
+		v.del(waitlistUserKey(t.args.ItemID, token))
+	}
+	if head+n == tail {
+		v.del(waitlistKey(t.args.ItemID))
+	} else {
+		v.put(waitlistKey(t.args.ItemID), composeWaitlist(head+n, tail))
+	}
+}
+
+type ReleaseArgs struct {
+	ItemID    int
+	UserToken string
+	Now       int64
+}
+
+// releaseTxn returns the units of an expired reservation to stock.
+type releaseTxn struct {
+	args  *ReleaseArgs
+	reply *int // the units returned
+}
+
+func (t *releaseTxn) keys() []string {
+	return []string{reservationKey(t.args.ItemID, t.args.UserToken),
+		ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)}
+}
+
+func (t *releaseTxn) run(v *txnView) {
+	key := reservationKey(t.args.ItemID, t.args.UserToken)
+	value, existed := v.get(key)
+	if !existed {
+		return
+	}
+	count, expiresAt := parseReservation(value)
+	if expiresAt > t.args.Now {
+		return
+	}
+	stockKey := ItemsStockKeyPrefix + strconv.Itoa(t.args.ItemID)
+	stock, _ := v.getInt(stockKey)
+	v.put(stockKey, strconv.Itoa(stock+count))
+	v.del(key)
+	*t.reply = count
+}
+
+// notifyWaitlist takes up to n users off the waitlist of the restocked
+// item and notifies them, reserving a unit for each if the shop reserves.
+func (ss *ShopServer) notifyWaitlist(itemID, n int) {
+	if ss.Options.Notifier == nil || n <= 0 {
+		return
+	}
+	reserveMs := int64(ss.Options.ReservationTTL / time.Millisecond)
+	for retry := 0; retry < 3; retry++ {
+		reply, err := ss.ClientPool.Get(waitlistKey(itemID))
+		if err != nil {
+			log.Printf("Read waitlist of item %d error: %v\n", itemID, err)
+			return
+		}
+		head, tail := parseWaitlist(reply.Value)
+		if tail > head+n {
+			tail = head + n
+		}
+		if tail <= head {
+			return
+		}
+		keys := make([]string, 0, tail-head)
+		for seq := head; seq < tail; seq++ {
+			keys = append(keys, waitlistEntryKey(itemID, seq))
+		}
+		entries, err := ss.ClientPool.MGet(keys)
+		if err != nil {
+			log.Printf("Read waitlist of item %d error: %v\n", itemID, err)
+			return
+		}
+		tokens := make([]string, 0, len(keys))
+		for _, entry := range entries.Replies {
+			tokens = append(tokens, entry.Value)
+		}
+		args := &PopWaitlistArgs{ItemID: itemID, Head: head, Tokens: tokens, ReserveMs: reserveMs, Now: ss.nowMs()}
+		popReply, err := ss.ClientPool.PopWaitlist(args)
+		if err != nil {
+			log.Printf("Pop waitlist of item %d error: %v\n", itemID, err)
+			return
+		}
+		if popReply.Status == RequestConflict {
+			continue
+		}
+		var reservedUntil int64
+		if reserveMs > 0 {
+			reservedUntil = args.Now + reserveMs
+		}
+		for _, token := range popReply.Popped {
+			if err := ss.Options.Notifier.Notify(token, itemID, reservedUntil); err != nil {
+				log.Printf("Notify user %s of item %d error: %v\n", token, itemID, err)
+			}
+		}
+		return
+	}
+}
+
+// sweepReservations returns the expired reservations to stock, and
+// passes the units on to the waitlists. It reads the buckets of the
+// expiry index up to now, the current one again next time as its
+// reservations may not have expired yet.
+func (ss *ShopServer) sweepReservations() {
+	next := reservationBucket(ss.nowMs() - int64(ReservationIndexRetention/time.Millisecond))
+	for _ = range time.Tick(ReservationSweepInterval) {
+		now := ss.nowMs()
+		last := reservationBucket(now)
+		keys := make([]string, 0, last-next+1)
+		for bucket := next; bucket <= last; bucket++ {
+			keys = append(keys, reservationExpiryKey(bucket))
+		}
+		reply, err := ss.ClientPool.MGet(keys)
+		if err != nil {
+			continue
+		}
+		for _, index := range reply.Replies {
+			if index.Value == "" {
+				continue
+			}
+			for _, entry := range strings.Split(index.Value, ",") {
+				info := strings.SplitN(entry, ":", 2)
+				if len(info) != 2 {
+					continue
+				}
+				itemID, _ := strconv.Atoi(info[0])
+				// The units ordered or still held aren't released.
+				released, err := ss.ClientPool.ReleaseReservation(&ReleaseArgs{ItemID: itemID, UserToken: info[1], Now: now})
+				if err == nil {
+					ss.notifyWaitlist(itemID, released)
+				}
+			}
+		}
+		next = last
+	}
+}
+
+// watchItem serves POST /items/:id/watch, which puts the user on the
+// waitlist of the item.
+func (ss *ShopServer) watchItem(resp *http.Response, req *http.Request) {
+	exist, token, _ := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	paths := strings.Split(req.URL.Path, "/")
+	if len(paths) != 4 || paths[3] != "watch" {
+		writeReply(resp, http.StatusNotFound, ITEM_NOT_FOUND_MSG)
+		return
+	}
+	itemID, err := strconv.Atoi(paths[2])
+	if err != nil || !ss.itemAvailable(itemID) {
+		writeReply(resp, http.StatusNotFound, ITEM_NOT_FOUND_MSG)
+		return
+	}
+	args := &WatchArgs{ItemID: itemID, UserToken: token}
+	var reply WatchReply
+	for retry := 0; retry < 3; retry++ {
+		if reply, err = ss.ClientPool.Watch(args); err != nil {
+			writeUnavailable(resp, err)
+			return
+		}
+		if reply.Status != RequestConflict {
+			break
+		}
+		args.Tail = reply.Tail
+	}
+	if reply.Status != OK {
+		// Too many users joined at once, let the client retry.
+		writeReply(resp, http.StatusServiceUnavailable, SERVICE_UNAVAILABLE_MSG)
+		return
+	}
+	body, _ := json.Marshal(struct {
+		ItemID   int `json:"item_id"`
+		Position int `json:"position"`
+	}{itemID, reply.Position})
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(body)
+}
@@ -0,0 +1,78 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestWaitlistReservation(t *testing.T) {
+	sks := NewShoppingKVStore()
+	sks.Put(ItemsPriceKeyPrefix+"1", "10")
+	sks.Put(ItemsStockKeyPrefix+"1", "0")
+	for i, token := range []string{"1", "2", "1"} {
+		var reply WatchReply
+		sks.Watch(&WatchArgs{ItemID: 1, UserToken: token, Tail: i}, &reply)
+		if reply.Status != OK || reply.Position != []int{1, 2, 1}[i] {
+			t.Fatalf("Watch #%d = %+v", i, reply)
+		}
+	}
+	var watchReply WatchReply
+	sks.Watch(&WatchArgs{ItemID: 1, UserToken: "3", Tail: 1}, &watchReply)
+	if watchReply.Status != RequestConflict || watchReply.Tail != 2 {
+		t.Fatalf("Watch at a wrong tail = %+v", watchReply)
+	}
+	head, _ := sks.Get(waitlistKey(1))
+	first, _ := sks.Get(waitlistEntryKey(1, 0))
+	second, _ := sks.Get(waitlistEntryKey(1, 1))
+	if head != "0|2" || first != "1" || second != "2" {
+		t.Fatalf("waitlist %q with %q, %q; expected 0|2 with 1, 2", head, first, second)
+	}
+
+	var stock StockReply
+	sks.AdjustStock(&StockArgs{ItemID: 1, Stock: 1, Delta: true}, &stock)
+	if stock.Restocked != 1 {
+		t.Fatalf("restock reply %v; expected 1 restocked", stock)
+	}
+	var popReply PopWaitlistReply
+	sks.PopWaitlist(&PopWaitlistArgs{ItemID: 1, Tokens: []string{"2"}, ReserveMs: 1000, Now: 100}, &popReply)
+	if popReply.Status != RequestConflict {
+		t.Fatalf("popping a wrong head returned %v", popReply)
+	}
+	sks.PopWaitlist(&PopWaitlistArgs{ItemID: 1, Tokens: []string{"1", "2"}, ReserveMs: 1000, Now: 100}, &popReply)
+	if popReply.Status != OK || len(popReply.Popped) != 1 || popReply.Popped[0] != "1" {
+		t.Fatalf("PopWaitlist = %v; expected user 1 only, as 1 is in stock", popReply)
+	}
+	if head, _ := sks.Get(waitlistKey(1)); head != "1|2" {
+		t.Fatalf("waitlist %q after the pop; expected 1|2", head)
+	}
+	if index, _ := sks.Get(reservationExpiryKey(reservationBucket(1100))); index != "1:1" {
+		t.Fatalf("expiry index %q; expected 1:1", index)
+	}
+
+	// The reserved unit is only for user 1.
+	var orderReply SubmitOrderReply
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "2", CartValue: "1.1:1", Now: 200}, &orderReply)
+	if orderReply.Status != OutOfStock {
+		t.Fatalf("user 2 took the reserved unit: %v", orderReply)
+	}
+	sks.SubmitOrder(&SubmitOrderArgs{UserToken: "1", CartValue: "1.1:1", Now: 200}, &orderReply)
+	if orderReply.Status != OK {
+		t.Fatalf("user 1 can't order the reserved unit: %v", orderReply)
+	}
+
+	// Cancelling returns the unit, and an expired reservation is released.
+	order, _ := sks.Get(OrderKeyPrefix + "1")
+	var status int
+	sks.CancelOrder(&CancelOrderArgs{UserToken: "1", OrderValue: order}, &status)
+	if stock, _ := sks.Get(ItemsStockKeyPrefix + "1"); status != OK || stock != "1" {
+		t.Fatalf("cancel returned %v with stock %v; expected OK with stock 1", status, stock)
+	}
+	sks.PopWaitlist(&PopWaitlistArgs{ItemID: 1, Head: 1, Tokens: []string{"2"}, ReserveMs: 1000, Now: 300}, &popReply)
+	if _, existed := sks.Get(waitlistKey(1)); popReply.Status != OK || existed {
+		t.Fatalf("PopWaitlist = %v; expected the waitlist emptied", popReply)
+	}
+	var released int
+	sks.ReleaseReservation(&ReleaseArgs{ItemID: 1, UserToken: "2", Now: 1300}, &released)
+	if stock, _ := sks.Get(ItemsStockKeyPrefix + "1"); released != 1 || stock != "1" {
+		t.Fatalf("released %d with stock %v; expected 1", released, stock)
+	}
+}
@@ -0,0 +1,211 @@
+package shopping
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-system/http"
+)
+
+// The admitted users who don't check out within DefaultAdmissionTTL lose
+// their admissions.
+const DefaultAdmissionTTL = time.Minute
+
+// TicketStatus is the place of a user in the waiting room.
+type TicketStatus struct {
+	Ticket       string `json:"ticket"`
+	Position     int64  `json:"position"` // 0 once admitted
+	Admitted     bool   `json:"admitted"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// WaitingRoomArgs runs Op on the waiting room for the user. The room and
+// the tickets live in the KV-Store, so that all the shops share them.
+type WaitingRoomArgs struct {
+	Op     int
+	Token  string
+	Ticket int64 // given back by WaitingRoomGiveBack
+	Rate   int
+	TTLMs  int64 // of the admissions unused
+	Now    int64 // unix milliseconds
+}
+
+const (
+	// WaitingRoomEnter queues the user, or uses up the admission.
+	WaitingRoomEnter = iota
+	// WaitingRoomGiveBack returns the admission of a failed checkout.
+	WaitingRoomGiveBack
+	// WaitingRoomStatus looks the ticket up.
+	WaitingRoomStatus
+)
+
+type WaitingRoomReply struct {
+	Found  bool // the user holds a ticket, or used it up now
+	Status TicketStatus
+}
+
+// roomTxn runs an operation of the waiting room. The room is the next
+// ticket to issue, the tickets admitted below, and when they were
+// advanced to, at WaitingRoomKey. The ticket of a user is its seq, which
+// expires unused AdmissionTTL after it is admitted.
+// 12|8|1500000000000
+type roomTxn struct {
+	args  *WaitingRoomArgs
+	reply *WaitingRoomReply
+}
+
+func (t *roomTxn) keys() []string {
+	return []string{WaitingRoomKey, TicketKeyPrefix + t.args.Token}
+}
+
+func (t *roomTxn) run(v *txnView) {
+	rate := int64(t.args.Rate)
+	if rate <= 0 {
+		// Like AdmitRate, a room admitting nobody isn't queueing.
+		t.reply.Found, t.reply.Status.Admitted = true, true
+		return
+	}
+	next, admitted, last := int64(0), rate, t.args.Now
+	if value, existed := v.get(WaitingRoomKey); existed {
+		info := strings.Split(value, "|")
+		if len(info) == 3 {
+			next, _ = strconv.ParseInt(info[0], 10, 64)
+			admitted, _ = strconv.ParseInt(info[1], 10, 64)
+			last, _ = strconv.ParseInt(info[2], 10, 64)
+		}
+	}
+	// Admit the tickets due since the last advance. Up to one second of
+	// admissions is banked ahead of the queue, so that the users of an
+	// idle room are admitted at once.
+	if n := (t.args.Now - last) * rate / 1000; n > 0 {
+		admitted += n
+		last += n * 1000 / rate
+		if limit := next + rate; admitted > limit {
+			admitted, last = limit, t.args.Now
+		}
+	}
+
+	ticketKey := TicketKeyPrefix + t.args.Token
+	ttl := time.Duration(t.args.TTLMs) * time.Millisecond
+	seq, held := int64(0), false
+	if value, existed := v.get(ticketKey); existed {
+		seq, _ = strconv.ParseInt(value, 10, 64)
+		held = true
+	}
+	switch t.args.Op {
+	case WaitingRoomEnter:
+		if !held {
+			seq, held = next, true
+			next++
+		}
+		if status := ticketStatus(seq, admitted, rate); status.Admitted {
+			v.del(ticketKey)
+		} else {
+			v.putTTL(ticketKey, strconv.FormatInt(seq, 10),
+				time.Duration(status.RetryAfterMs)*time.Millisecond+ttl)
+		}
+		v.put(WaitingRoomKey, strconv.FormatInt(next, 10)+"|"+strconv.FormatInt(admitted, 10)+"|"+
+			strconv.FormatInt(last, 10))
+	case WaitingRoomGiveBack:
+		if !held {
+			seq, held = t.args.Ticket, true
+			v.putTTL(ticketKey, strconv.FormatInt(seq, 10), ttl)
+		}
+	}
+	if held {
+		t.reply.Found, t.reply.Status = true, ticketStatus(seq, admitted, rate)
+	}
+}
+
+func ticketStatus(seq, admitted, rate int64) TicketStatus {
+	status := TicketStatus{Ticket: strconv.FormatInt(seq, 10)}
+	if seq < admitted {
+		status.Admitted = true
+		return status
+	}
+	status.Position = seq - admitted + 1
+	status.RetryAfterMs = status.Position * 1000 / rate
+	return status
+}
+
+// waitingRoom lets the users check out in the order of their tickets, at
+// rate admissions per second of all the shops. Every user holds at most
+// one ticket, which is used up by checking out once admitted.
+type waitingRoom struct {
+	pool  kvClient
+	rate  int
+	ttl   time.Duration
+	clock Clock
+}
+
+func newWaitingRoom(pool kvClient, rate int, ttl time.Duration, clock Clock) *waitingRoom {
+	if ttl <= 0 {
+		ttl = DefaultAdmissionTTL
+	}
+	return &waitingRoom{pool: pool, rate: rate, ttl: ttl, clock: clock}
+}
+
+func (w *waitingRoom) run(op int, token string, ticket int64) (WaitingRoomReply, error) {
+	return w.pool.WaitingRoom(&WaitingRoomArgs{Op: op, Token: token, Ticket: ticket, Rate: w.rate,
+		TTLMs: int64(w.ttl / time.Millisecond), Now: w.clock.Now().UnixNano() / int64(time.Millisecond)})
+}
+
+// enter tells whether the user may check out now, and uses up the
+// admission if so. Otherwise the user is queued, with a new ticket if the
+// user holds none.
+func (w *waitingRoom) enter(token string) (bool, TicketStatus, error) {
+	reply, err := w.run(WaitingRoomEnter, token, 0)
+	return reply.Status.Admitted, reply.Status, err
+}
+
+// giveBack returns the admission of a checkout which failed, so that the
+// user may try again without queueing.
+func (w *waitingRoom) giveBack(token string, status TicketStatus) error {
+	seq, err := strconv.ParseInt(status.Ticket, 10, 64)
+	if err != nil {
+		return nil
+	}
+	_, err = w.run(WaitingRoomGiveBack, token, seq)
+	return err
+}
+
+// status returns the ticket of the user, if any.
+func (w *waitingRoom) status(token string) (TicketStatus, bool, error) {
+	reply, err := w.run(WaitingRoomStatus, token, 0)
+	return reply.Status, reply.Found, err
+}
+
+func writeQueued(resp *http.Response, status TicketStatus) {
+	body, _ := json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		TicketStatus
+	}{"QUEUED", "排队中，请稍后重试", status})
+	resp.WriteStatus(http.StatusAccepted)
+	resp.Write(body)
+}
+
+// queryTicket serves the polling of the ticket of the user.
+func (ss *ShopServer) queryTicket(resp *http.Response, req *http.Request) {
+	exist, token, _ := ss.authorize(resp, req, false)
+	if !exist {
+		return
+	}
+	var status TicketStatus
+	if ss.waitingRoom != nil {
+		var err error
+		if status, exist, err = ss.waitingRoom.status(token); err != nil {
+			writeUnavailable(resp, err)
+			return
+		}
+	}
+	if ss.waitingRoom == nil || !exist {
+		writeReply(resp, http.StatusNotFound, TICKET_NOT_FOUND_MSG)
+		return
+	}
+	body, _ := json.Marshal(status)
+	resp.WriteStatus(http.StatusOK)
+	resp.Write(body)
+}
@@ -0,0 +1,66 @@
+package shopping
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWaitingRoom(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	f := newFlakyKV()
+	w := newWaitingRoom(f, 2, time.Minute, clock)
+	// Another shop shares the room.
+	w2 := newWaitingRoom(f, 2, time.Minute, clock)
+
+	// The idle room admits a second of checkouts at once.
+	for i := 0; i < 2; i++ {
+		if admitted, _, _ := w.enter(strconv.Itoa(i)); !admitted {
+			t.Fatalf("user %d isn't admitted by the idle room", i)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		if admitted, status, _ := w2.enter(strconv.Itoa(i)); admitted || status.Position != int64(i-1) {
+			t.Fatalf("user %d got %v; expected position %d", i, status, i-1)
+		}
+	}
+	if admitted, status, _ := w.enter("3"); admitted || status.Ticket != "3" {
+		t.Fatalf("user 3 got a new ticket %v", status)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if status, _, _ := w2.status("3"); !status.Admitted {
+		t.Fatalf("user 3 isn't admitted after a second: %v", status)
+	}
+	if status, _, _ := w.status("4"); status.Admitted || status.Position != 1 || status.RetryAfterMs != 500 {
+		t.Fatalf("user 4 got %v; expected position 1", status)
+	}
+	admitted, admission, _ := w.enter("3")
+	if !admitted {
+		t.Fatal("admitted user 3 can't check out")
+	}
+	if _, ok, _ := w2.status("3"); ok {
+		t.Fatal("the admission isn't used up")
+	}
+
+	// A failed checkout gives the admission back.
+	w.giveBack("3", admission)
+	if status, _, _ := w.status("3"); !status.Admitted || status.Ticket != "3" {
+		t.Fatalf("user 3 got %v after the failed checkout; expected admitted", status)
+	}
+	if admitted, _, _ := w.enter("3"); !admitted {
+		t.Fatal("user 3 can't check out again")
+	}
+
+	// The admission unused expires with the ticket, a minute after user
+	// 4, queued third, is admitted.
+	if ttl, _ := f.sks.TTL(TicketKeyPrefix + "4"); ttl <= time.Minute || ttl > time.Minute+1500*time.Millisecond {
+		t.Fatalf("the ticket of user 4 expires in %v; expected a minute after its admission", ttl)
+	}
+
+	// The room fails with the KV-Store.
+	f.setDown(true)
+	if _, _, err := w.enter("5"); err == nil {
+		t.Fatal("enter succeeded with the KV-Store down")
+	}
+}
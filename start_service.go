@@ -1,15 +1,17 @@
 package main
 
 import (
-	"distributed-system/twopc"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"runtime/pprof"
+	"rush-shopping/kv"
 	"rush-shopping/shopping"
 	"rush-shopping/util"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -31,15 +33,32 @@ func main() {
 
 	cfg := util.ParseCfg(*config)
 
-	keyHashFunc := twopc.DefaultKeyHashFunc
+	keyHashFunc := kv.DefaultKeyHashFunc
 
 	blocked := false
 	if *parti {
-		for _, pptAddr := range cfg.KVStoreAddrs {
+		for i, pptAddr := range cfg.KVStoreAddrs {
 			if ip, _, err := net.SplitHostPort(pptAddr); err == nil {
 				if _, err := net.LookupHost(ip); err == nil {
 					blocked = true
-					go shopping.NewShoppingTxnKVStoreService(cfg.Protocol, pptAddr, cfg.CoordinatorAddr)
+					go func(i int, pptAddr string) {
+						ppt := shopping.NewShoppingTxnKVStoreService(cfg.Protocol, pptAddr, cfg.CoordinatorAddr)
+						if cfg.SlowlogThresholdMS != 0 {
+							ppt.SetSlowlogThreshold(time.Duration(cfg.SlowlogThresholdMS) * time.Millisecond)
+						}
+						if i < len(cfg.RESPAddrs) && cfg.RESPAddrs[i] != "" {
+							if _, err := kv.ListenRESP(ppt.KVStore, cfg.Protocol, cfg.RESPAddrs[i]); err != nil {
+								log.Fatal(err)
+							}
+						}
+						if i < len(cfg.AdminAddrs) && cfg.AdminAddrs[i] != "" {
+							opts := kv.AdminOptions{Secret: cfg.AdminSecret,
+								SnapshotPath: "kvstore-" + strings.NewReplacer(":", "_", "/", "_").Replace(pptAddr) + ".snapshot.json"}
+							if _, err := kv.ListenAdmin(ppt.KVStore, cfg.Protocol, cfg.AdminAddrs[i], opts); err != nil {
+								log.Fatal(err)
+							}
+						}
+					}(i, pptAddr)
 				} else {
 					fmt.Println(err)
 				}
@@ -60,12 +79,38 @@ func main() {
 	}
 
 	if *web {
-		for _, appAddr := range cfg.APPAddrs {
+		opts := shopping.DefaultShopOptions()
+		var err error
+		if opts.PricePolicy, err = shopping.ParsePricePolicy(cfg.PricePolicy); err != nil {
+			log.Fatal(err)
+		}
+		if opts.ValueSchema, err = shopping.ParseValueSchema(cfg.ValueSchema); err != nil {
+			log.Fatal(err)
+		}
+		if opts.PaymentProvider, err = shopping.NewPaymentProvider(cfg.PaymentProvider); err != nil {
+			log.Fatal(err)
+		}
+		opts.AdmitRate = cfg.AdmitRate
+		opts.AdminSecret = cfg.AdminSecret
+		opts.KVTimeout = time.Duration(cfg.TimeoutMS) * time.Millisecond
+		opts.Notifier = shopping.LogNotifier{}
+		opts.ReservationTTL = time.Duration(cfg.ReservationTTLMS) * time.Millisecond
+		opts.RateLimits = make(map[string]shopping.EndpointLimit)
+		for pattern, l := range cfg.RateLimits {
+			opts.RateLimits[pattern] = shopping.EndpointLimit{
+				PerToken: shopping.RateLimit{Rate: l.TokenRate, Burst: l.TokenBurst},
+				PerIP:    shopping.RateLimit{Rate: l.IPRate, Burst: l.IPBurst},
+			}
+		}
+		for i, appAddr := range cfg.APPAddrs {
 			if ip, _, err := net.SplitHostPort(appAddr); err == nil {
 				if _, err := net.LookupHost(ip); err == nil {
 					blocked = true
-					shopping.InitService(cfg.Protocol, appAddr, cfg.CoordinatorAddr, cfg.UserCSV, cfg.ItemCSV,
-						cfg.KVStoreAddrs, keyHashFunc)
+					opts.StreamAddr = ""
+					if i < len(cfg.StreamAddrs) {
+						opts.StreamAddr = cfg.StreamAddrs[i]
+					}
+					shopping.InitServiceWithOptions(cfg.Protocol, appAddr, cfg.CoordinatorAddr, cfg.UserCSV, cfg.ItemCSV, opts)
 				}
 			}
 
@@ -0,0 +1,36 @@
+# -*- coding: utf-8 -*-
+
+from __future__ import absolute_import
+
+import random
+import re
+
+import requests
+
+from conftest import conf, url, user_store
+
+
+def _metrics(secret):
+    return requests.get(url + "/metrics", headers={"Authorization": "Bearer " + secret}, timeout=3)
+
+
+def _errors(code):
+    res = _metrics(conf["admin_secret"])
+    assert res.status_code == 200
+    m = re.search(r'^shop_errors_total\{code="%s"\} (\d+)$' % code, res.text, re.M)
+    return int(m.group(1)) if m else 0
+
+
+def test_metrics_secret():
+    assert requests.get(url + "/metrics", timeout=3).status_code == 401
+    assert _metrics(conf["admin_secret"] + "x").status_code == 401
+
+
+def test_metrics_errors():
+    before = _errors("USER_AUTH_FAIL")
+
+    username, password, _ = user_store[random.choice(list(user_store.keys()))]
+    res = requests.post(url + "/login", json={"username": username, "password": password + "x"})
+    assert res.status_code == 403
+
+    assert _errors("USER_AUTH_FAIL") == before + 1
@@ -0,0 +1,25 @@
+# -*- coding: utf-8 -*-
+
+from __future__ import absolute_import
+
+import uuid
+
+from conftest import json_get, json_post, token_gen
+
+
+def test_topup():
+    # The shop runs with the fake payment provider of cfg.json.
+    uid, token = next(token_gen)
+    res = json_get("/balance", token)
+    assert res.status_code == 200
+    balance = res.json()["balance"]
+
+    request_id = uuid.uuid4().hex
+    for _ in range(2):
+        res = json_post("/balance/topup", token, {"amount": 30, "request_id": request_id})
+        assert res.status_code == 200
+        assert res.json() == {"user_id": uid, "balance": balance + 30, "request_id": request_id}
+
+    res = json_get("/balance", token)
+    assert res.status_code == 200
+    assert res.json()["balance"] == balance + 30
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// Cfg is the deployment configuration, see cfg.json.
+type Cfg struct {
+	Protocol        string
+	APPAddrs        []string
+	CoordinatorAddr string
+	KVStoreAddrs    []string
+	ItemCSV         string
+	UserCSV         string
+	// PaymentProvider charges the top-ups of the users: "fake" accepts
+	// every charge, for local runs, and "" refuses the top-ups.
+	PaymentProvider string
+	// TimeoutMS bounds every RPC between the coordinator and the
+	// participants of a transaction, e.g. waiting for the locks, and from
+	// the shops to the KV-Store, shopping.DefaultTxnTimeoutMS if it's 0.
+	// A transaction is given longer, see shopping.ShopOptions.KVTimeout.
+	TimeoutMS int
+	// PricePolicy is "checkout" (the default) or "cart", see
+	// shopping.PricePolicy.
+	PricePolicy string
+	// AdmitRate is the checkouts admitted per second by all the shops
+	// together, 0 if they aren't queued.
+	AdmitRate int
+	// RateLimits by the patterns of the shop endpoints, e.g. "/carts".
+	RateLimits map[string]RateLimitCfg
+	// How long a unit restocked is reserved for a waitlisted user, 0 if
+	// the users are only notified.
+	ReservationTTLMS int
+	// StreamAddrs[i] streams the stock for APPAddrs[i], if any.
+	StreamAddrs []string
+	// ValueSchema is "legacy" (the default) until every shop runs a
+	// version reading "v1", and "v1" after, see shopping.ValueSchema.
+	ValueSchema string
+	// RESPAddrs[i] serves KVStoreAddrs[i] in the Redis protocol, for
+	// redis-cli, if any.
+	RESPAddrs []string
+	// AdminAddrs[i] serves the admin API of KVStoreAddrs[i], if any,
+	// guarded by AdminSecret, as is /metrics of the shops.
+	AdminAddrs  []string
+	AdminSecret string
+	// SlowlogThresholdMS is how long an operation of a KV-Store takes to
+	// be logged, see kv.SlowEntry. 0 is kv.DefaultSlowlogThreshold, and a
+	// negative one turns the slowlog off.
+	SlowlogThresholdMS int
+}
+
+// RateLimitCfg is the requests per second and the burst of an endpoint,
+// per access token and per client IP. A zero rate doesn't limit.
+type RateLimitCfg struct {
+	TokenRate  int
+	TokenBurst int
+	IPRate     int
+	IPBurst    int
+}
+
+// ParseCfg reads the configuration file and exits if it is invalid.
+func ParseCfg(path string) *Cfg {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalln("Open config error:", err)
+	}
+	defer file.Close()
+	cfg := new(Cfg)
+	if err = json.NewDecoder(file).Decode(cfg); err != nil {
+		log.Fatalln("Parse config error:", err)
+	}
+	return cfg
+}